@@ -60,8 +60,15 @@ var (
 	promOut             string
 	showVersion         bool
 
-	initializeTimeout time.Duration
-	reporter          benchrun.Reporter
+	initializeTimeout     time.Duration
+	conditionCursorPaging bool
+	isuLifecycle          bool
+	isuSharing            bool
+	graphResolution       bool
+	trendFilter           bool
+	jsonError             bool
+	trace                 bool
+	reporter              benchrun.Reporter
 )
 
 func getEnv(key, defaultValue string) string {
@@ -99,6 +106,13 @@ func init() {
 	flag.BoolVar(&noLoad, "no-load", false, "exit on finished prepare")
 	flag.StringVar(&promOut, "prom-out", "", "Prometheus textfile output path")
 	flag.BoolVar(&showVersion, "version", false, "show version and exit 1")
+	flag.BoolVar(&conditionCursorPaging, "condition-cursor", false, "page GET /api/condition/:jia_isu_uuid with next_cursor instead of end_time")
+	flag.BoolVar(&isuLifecycle, "isu-lifecycle", false, "check PATCH and DELETE /api/isu/:jia_isu_uuid in prepare")
+	flag.BoolVar(&isuSharing, "isu-sharing", false, "check that a second user can view a shared ISU in prepare")
+	flag.BoolVar(&graphResolution, "graph-resolution", false, "check GET /api/isu/:jia_isu_uuid/graph with resolution=day and week in prepare")
+	flag.BoolVar(&trendFilter, "trend-filter", false, "check filtered GET /api/trend and GET /api/trend/history, and send filtered trend requests in load")
+	flag.BoolVar(&jsonError, "json-error", false, "request JSON error responses with Accept: application/json and check the error envelope")
+	flag.BoolVar(&trace, "trace", false, "send a W3C traceparent header with agent requests and add trace ids to logged errors")
 
 	var jiaServiceURLStr, timeoutDuration, initializeTimeoutDuration string
 	flag.StringVar(&jiaServiceURLStr, "jia-service-url", getEnv("JIA_SERVICE_URL", "http://apitest:5000"), "jia service url")
@@ -333,6 +347,13 @@ func main() {
 		panic(err)
 	}
 	s = s.WithInitializeTimeout(initializeTimeout)
+	s = s.WithConditionCursorPaging(conditionCursorPaging)
+	s = s.WithIsuLifecycle(isuLifecycle)
+	s = s.WithIsuSharing(isuSharing)
+	s = s.WithGraphResolution(graphResolution)
+	s = s.WithTrendFilter(trendFilter)
+	s = s.WithJSONError(jsonError)
+	s = s.WithTrace(trace)
 
 	// IPAddr と FQDN の相互参照可能なmapをシナリオに登録
 	var addrAndFqdn []string
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 const (
 	// graph の1要素 (1h) を構成するコンディション数のボーダー値
 	// この値を下回った分だけ減点処理される
@@ -18,6 +20,30 @@ var (
 	}
 )
 
+// グラフの解像度。Step 毎のデータ点を Points 個 (Range 分) 返す
+type GraphResolution struct {
+	Name   string
+	Range  string
+	Step   time.Duration
+	Points int
+}
+
+var (
+	GraphResolutionHour = GraphResolution{Name: "hour", Range: "day", Step: time.Hour, Points: 24}
+	GraphResolutionDay  = GraphResolution{Name: "day", Range: "week", Step: 24 * time.Hour, Points: 7}
+	GraphResolutionWeek = GraphResolution{Name: "week", Range: "quarter", Step: 7 * 24 * time.Hour, Points: 13}
+)
+
+// date を含むデータ点の開始時刻。日と週の境界は UTC で、週は月曜始まり
+func (r GraphResolution) StartAt(date int64) int64 {
+	return time.Unix(date, 0).Truncate(r.Step).Unix()
+}
+
+// date から Range 分の終了時刻
+func (r GraphResolution) EndAt(date int64) int64 {
+	return r.StartAt(date) + int64(r.Step/time.Second)*int64(r.Points)
+}
+
 // Graph Model は verifyGraph にて利用される。
 // getGraph のレスポンスボディのうち condition_timestamps を元にモデルを組み立て、
 // モデルを用いて getGraph のレスポンスボディの他フィールドが適切な値かどうかを検証する。
@@ -95,3 +121,30 @@ func (g Graph) Match(
 		isDirtyPercentage == g.percentage.isDirty &&
 		isOverweightPercentage == g.percentage.isOverweight
 }
+
+// conditions を startAt から r.Step 毎のデータ点に分けてそれぞれの Graph を作る。
+// 範囲外のコンディションは無視し、コンディションの無いデータ点は nil になる
+func NewGraphsByResolution(conditions []*IsuCondition, startAt int64, r GraphResolution) []*Graph {
+	step := int64(r.Step / time.Second)
+	buckets := make([][]*IsuCondition, r.Points)
+	for _, c := range conditions {
+		if c.TimestampUnix < startAt {
+			continue
+		}
+		i := (c.TimestampUnix - startAt) / step
+		if i >= int64(r.Points) {
+			continue
+		}
+		buckets[i] = append(buckets[i], c)
+	}
+
+	graphs := make([]*Graph, r.Points)
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		graph := NewGraph(bucket)
+		graphs[i] = &graph
+	}
+	return graphs
+}
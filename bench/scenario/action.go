@@ -14,6 +14,9 @@ package scenario
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -22,6 +25,7 @@ import (
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -390,10 +394,47 @@ func postIsuAction(ctx context.Context, a *agent.Agent, req service.PostIsuReque
 		logger.AdminLogger.Panic(err)
 	}
 	isu := &service.Isu{}
-	res, err := reqMultipartResJSON(ctx, a, http.MethodPost, "/api/isu", buf, writer, isu, []int{http.StatusCreated})
+	res, err := reqMultipartResJSON(ctx, a, http.MethodPost, "/api/isu", buf, writer, isu, []int{http.StatusCreated, http.StatusAccepted})
 	if err != nil {
 		return nil, res, err
 	}
+	if res.StatusCode == http.StatusAccepted {
+		// 非同期で activate する実装では pending で返り、activate されるまで GET /api/isu/:jia_isu_uuid を待つ
+		isu, res, err = pollIsuActivation(ctx, a, isu, res)
+		if err != nil {
+			return nil, res, err
+		}
+		switch isu.ActivationStatus {
+		case isuActivationStatusActive:
+		case isuActivationStatusFailed:
+			return nil, res, errorMismatch(res, "椅子(JIA_ISU_UUID=%s)の activate に失敗しました: %s", isu.JIAIsuUUID, isu.ActivationError)
+		default:
+			return nil, res, errorMismatch(res, "椅子(JIA_ISU_UUID=%s)の activation_status が不正です (%s)", isu.JIAIsuUUID, isu.ActivationStatus)
+		}
+	}
+	return isu, res, nil
+}
+
+// activation_status が pending でなくなるまで椅子を取得し直す
+func pollIsuActivation(ctx context.Context, a *agent.Agent, isu *service.Isu, res *http.Response) (*service.Isu, *http.Response, error) {
+	deadline := time.Now().Add(isuActivationPollTimeout)
+	for isu.ActivationStatus == isuActivationStatusPending {
+		if time.Now().After(deadline) {
+			return nil, res, failure.NewError(ErrInvalid, errorFormatWithResponse(res, "椅子(JIA_ISU_UUID=%s)が時間内に activate されませんでした", isu.JIAIsuUUID))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, res, ctx.Err()
+		case <-time.After(isuActivationPollInterval):
+		}
+
+		var err error
+		isu, res, err = getIsuIdAction(ctx, a, isu.JIAIsuUUID)
+		if err != nil {
+			return nil, res, err
+		}
+	}
 	return isu, res, nil
 }
 
@@ -438,13 +479,145 @@ func postIsuErrorAction(ctx context.Context, a *agent.Agent, req service.PostIsu
 	if err != nil {
 		logger.AdminLogger.Panic(err)
 	}
-	res, text, err := reqMultipartResError(ctx, a, http.MethodPost, "/api/isu", buf, writer, []int{http.StatusBadRequest, http.StatusConflict, http.StatusUnauthorized, http.StatusNotFound, http.StatusForbidden})
+	res, text, err := reqMultipartResError(ctx, a, http.MethodPost, "/api/isu", buf, writer, []int{http.StatusAccepted, http.StatusBadRequest, http.StatusConflict, http.StatusUnauthorized, http.StatusNotFound, http.StatusForbidden})
+	if err != nil {
+		return "", res, err
+	}
+	return text, res, nil
+}
+
+func patchIsuMultipart(req service.PatchIsuRequest) (*bytes.Buffer, *multipart.Writer) {
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+
+	if req.IsuName != nil {
+		part, err := writer.CreateFormField("isu_name")
+		if err != nil {
+			logger.AdminLogger.Panic(err)
+		}
+		_, err = part.Write([]byte(*req.IsuName))
+		if err != nil {
+			logger.AdminLogger.Panic(err)
+		}
+	}
+
+	if req.Img != nil {
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Type", "image/jpeg")
+		partHeader.Set("Content-Disposition", `form-data; name="image"; filename="image.jpeg"`)
+
+		part, err := writer.CreatePart(partHeader)
+		if err != nil {
+			logger.AdminLogger.Panic(err)
+		}
+		_, err = part.Write(req.Img)
+		if err != nil {
+			logger.AdminLogger.Panic(err)
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		logger.AdminLogger.Panic(err)
+	}
+	return buf, writer
+}
+
+func patchIsuAction(ctx context.Context, a *agent.Agent, id string, req service.PatchIsuRequest) (*service.Isu, *http.Response, error) {
+	buf, writer := patchIsuMultipart(req)
+	isu := &service.Isu{}
+	reqUrl := fmt.Sprintf("/api/isu/%s", id)
+	res, err := reqMultipartResJSON(ctx, a, http.MethodPatch, reqUrl, buf, writer, isu, []int{http.StatusOK})
+	if err != nil {
+		return nil, res, err
+	}
+	return isu, res, nil
+}
+
+func patchIsuErrorAction(ctx context.Context, a *agent.Agent, id string, req service.PatchIsuRequest) (string, *http.Response, error) {
+	buf, writer := patchIsuMultipart(req)
+	reqUrl := fmt.Sprintf("/api/isu/%s", id)
+	res, text, err := reqMultipartResError(ctx, a, http.MethodPatch, reqUrl, buf, writer, []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound})
 	if err != nil {
 		return "", res, err
 	}
 	return text, res, nil
 }
 
+func deleteIsuAction(ctx context.Context, a *agent.Agent, id string) (*http.Response, error) {
+	reqUrl := fmt.Sprintf("/api/isu/%s", id)
+	res, err := reqNoContentResNoContent(ctx, a, http.MethodDelete, reqUrl, []int{http.StatusNoContent})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func deleteIsuErrorAction(ctx context.Context, a *agent.Agent, id string) (string, *http.Response, error) {
+	reqUrl := fmt.Sprintf("/api/isu/%s", id)
+	res, text, err := reqNoContentResError(ctx, a, http.MethodDelete, reqUrl, []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound})
+	if err != nil {
+		return "", nil, err
+	}
+	return text, res, nil
+}
+
+func postIsuInvitationAction(ctx context.Context, a *agent.Agent, id string, req service.PostIsuInvitationRequest) (*service.IsuInvitation, *http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		logger.AdminLogger.Panic(err)
+	}
+	invitation := &service.IsuInvitation{}
+	reqUrl := fmt.Sprintf("/api/isu/%s/invitation", id)
+	res, err := reqJSONResJSON(ctx, a, http.MethodPost, reqUrl, bytes.NewReader(body), invitation, []int{http.StatusCreated})
+	if err != nil {
+		return nil, res, err
+	}
+	return invitation, res, nil
+}
+
+func postIsuInvitationErrorAction(ctx context.Context, a *agent.Agent, id string, req service.PostIsuInvitationRequest) (string, *http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		logger.AdminLogger.Panic(err)
+	}
+	reqUrl := fmt.Sprintf("/api/isu/%s/invitation", id)
+	res, text, err := reqJSONResError(ctx, a, http.MethodPost, reqUrl, bytes.NewReader(body),
+		[]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict})
+	if err != nil {
+		return "", nil, err
+	}
+	return text, res, nil
+}
+
+func getInvitationListAction(ctx context.Context, a *agent.Agent) ([]*service.IsuInvitation, *http.Response, error) {
+	var invitations []*service.IsuInvitation
+	res, err := reqJSONResJSON(ctx, a, http.MethodGet, "/api/invitation", nil, &invitations, []int{http.StatusOK})
+	if err != nil {
+		return nil, res, err
+	}
+	return invitations, res, nil
+}
+
+func postInvitationAcceptAction(ctx context.Context, a *agent.Agent, invitationID int64) (*service.IsuMember, *http.Response, error) {
+	member := &service.IsuMember{}
+	reqUrl := fmt.Sprintf("/api/invitation/%d/accept", invitationID)
+	res, err := reqJSONResJSON(ctx, a, http.MethodPost, reqUrl, nil, member, []int{http.StatusOK})
+	if err != nil {
+		return nil, res, err
+	}
+	return member, res, nil
+}
+
+func deleteIsuMemberAction(ctx context.Context, a *agent.Agent, id string, jiaUserID string) (*http.Response, error) {
+	reqUrl := fmt.Sprintf("/api/isu/%s/member/%s", id, jiaUserID)
+	res, err := reqNoContentResNoContent(ctx, a, http.MethodDelete, reqUrl, []int{http.StatusNoContent})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 func getIsuIdAction(ctx context.Context, a *agent.Agent, id string) (*service.Isu, *http.Response, error) {
 	isu := &service.Isu{}
 	reqUrl := fmt.Sprintf("/api/isu/%s", id)
@@ -483,7 +656,7 @@ func getIsuIconErrorAction(ctx context.Context, a *agent.Agent, id string) (stri
 	return text, res, nil
 }
 
-func postIsuConditionAction(ctx context.Context, httpClient http.Client, targetUrl string, req *[]service.PostIsuConditionRequest) (*http.Response, error) {
+func postIsuConditionAction(ctx context.Context, httpClient http.Client, targetUrl string, secret string, req *[]service.PostIsuConditionRequest) (*http.Response, error) {
 	conditionByte, err := json.Marshal(req)
 	if err != nil {
 		logger.AdminLogger.Panic(err)
@@ -494,6 +667,7 @@ func postIsuConditionAction(ctx context.Context, httpClient http.Client, targetU
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("User-Agent", "JIA-Members-Client/1.2")
+	signIsuConditionRequest(httpReq, secret, conditionByte)
 	res, err := httpClient.Do(httpReq)
 	if err != nil {
 		return nil, err
@@ -502,6 +676,17 @@ func postIsuConditionAction(ctx context.Context, httpClient http.Client, targetU
 	return res, nil
 }
 
+// activate で払い出した secret で "<X-Isucondition-Timestamp>.<body>" の HMAC-SHA256 を付ける
+func signIsuConditionRequest(httpReq *http.Request, secret string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	httpReq.Header.Set("X-Isucondition-Timestamp", timestamp)
+	httpReq.Header.Set("X-Isucondition-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
 func postIsuConditionErrorAction(ctx context.Context, httpClient http.Client, targetUrl string, req []map[string]interface{}) (string, *http.Response, error) {
 	conditionByte, err := json.Marshal(req)
 	if err != nil {
@@ -513,18 +698,21 @@ func postIsuConditionErrorAction(ctx context.Context, httpClient http.Client, ta
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("User-Agent", "JIA-Members-Client/1.2")
+	if acceptJSONError {
+		httpReq.Header.Set("Accept", "application/json")
+	}
 	res, err := httpClient.Do(httpReq)
 	if err != nil {
 		return "", nil, err
 	}
 	defer res.Body.Close()
 
-	resBody, err := checkContentTypeAndGetBody(res, "text/plain")
+	text, err := getErrorMessage(res)
 	if err != nil {
 		return "", nil, err
 	}
 
-	return string(resBody), res, nil
+	return text, res, nil
 }
 
 func getIsuConditionAction(ctx context.Context, a *agent.Agent, id string, req service.GetIsuConditionRequest) (service.GetIsuConditionResponseArray, *http.Response, error) {
@@ -538,6 +726,17 @@ func getIsuConditionAction(ctx context.Context, a *agent.Agent, id string, req s
 	return conditions, res, nil
 }
 
+// limit か cursor を指定したときの GET /api/condition/:jia_isu_uuid
+func getIsuConditionPageAction(ctx context.Context, a *agent.Agent, id string, req service.GetIsuConditionRequest) (*service.GetIsuConditionPageResponse, *http.Response, error) {
+	reqUrl := getIsuConditionRequestParams(fmt.Sprintf("/api/condition/%s", id), req)
+	page := &service.GetIsuConditionPageResponse{}
+	res, err := reqJSONResJSON(ctx, a, http.MethodGet, reqUrl, nil, page, []int{http.StatusOK})
+	if err != nil {
+		return nil, nil, err
+	}
+	return page, res, nil
+}
+
 func getIsuConditionErrorAction(ctx context.Context, a *agent.Agent, id string, query url.Values) (string, *http.Response, error) {
 	path := fmt.Sprintf("/api/condition/%s", id)
 	rpath := getPathWithParams(path, query)
@@ -555,11 +754,18 @@ func getIsuConditionRequestParams(base string, req service.GetIsuConditionReques
 	}
 
 	q := url.Values{}
-	if req.StartTime != nil {
-		q.Set("start_time", fmt.Sprint(*req.StartTime))
+	if req.Cursor != "" {
+		q.Set("cursor", req.Cursor)
+	} else {
+		if req.StartTime != nil {
+			q.Set("start_time", fmt.Sprint(*req.StartTime))
+		}
+		q.Set("end_time", fmt.Sprint(req.EndTime))
+		q.Set("condition_level", req.ConditionLevel)
+	}
+	if req.Limit != 0 {
+		q.Set("limit", fmt.Sprint(req.Limit))
 	}
-	q.Set("end_time", fmt.Sprint(req.EndTime))
-	q.Set("condition_level", req.ConditionLevel)
 	targetURL.RawQuery = q.Encode()
 	return targetURL.String()
 }
@@ -567,6 +773,12 @@ func getIsuConditionRequestParams(base string, req service.GetIsuConditionReques
 func getIsuGraphAction(ctx context.Context, a *agent.Agent, id string, req service.GetGraphRequest) (service.GraphResponse, *http.Response, error) {
 	graph := service.GraphResponse{}
 	reqUrl := fmt.Sprintf("/api/isu/%s/graph?datetime=%d", id, req.Date)
+	if req.Resolution != "" {
+		reqUrl += "&resolution=" + req.Resolution
+	}
+	if req.Range != "" {
+		reqUrl += "&range=" + req.Range
+	}
 	res, err := reqJSONResJSON(ctx, a, http.MethodGet, reqUrl, nil, &graph, []int{http.StatusOK})
 	if err != nil {
 		return nil, nil, err
@@ -585,8 +797,24 @@ func getIsuGraphErrorAction(ctx context.Context, a *agent.Agent, id string, quer
 	return text, res, nil
 }
 
-func getTrendAction(ctx context.Context, a *agent.Agent) (service.GetTrendResponse, *http.Response, error) {
+func getTrendAction(ctx context.Context, a *agent.Agent, req service.GetTrendRequest) (service.GetTrendResponse, *http.Response, error) {
 	reqUrl := "/api/trend"
+	if req.Filtered() {
+		query := url.Values{}
+		if req.Character != "" {
+			query.Set("character", req.Character)
+		}
+		if req.ConditionLevel != "" {
+			query.Set("condition_level", req.ConditionLevel)
+		}
+		if req.Since != nil {
+			query.Set("since", strconv.FormatInt(*req.Since, 10))
+		}
+		if req.Limit != 0 {
+			query.Set("limit", strconv.Itoa(req.Limit))
+		}
+		reqUrl = getPathWithParams(reqUrl, query)
+	}
 	trend, res, err := reqJSONResTrend(ctx, a, http.MethodGet, reqUrl, nil, []int{http.StatusOK})
 	if err != nil {
 		return nil, nil, err
@@ -595,13 +823,39 @@ func getTrendAction(ctx context.Context, a *agent.Agent) (service.GetTrendRespon
 	return trend, res, nil
 }
 
+func getTrendErrorAction(ctx context.Context, a *agent.Agent, query url.Values) (string, *http.Response, error) {
+	rpath := getPathWithParams("/api/trend", query)
+	res, text, err := reqNoContentResError(ctx, a, http.MethodGet, rpath, []int{http.StatusBadRequest})
+	if err != nil {
+		return "", nil, err
+	}
+	return text, res, nil
+}
+
+func getTrendHistoryAction(ctx context.Context, a *agent.Agent, req service.GetTrendHistoryRequest) (service.GetTrendHistoryResponse, *http.Response, error) {
+	query := url.Values{}
+	query.Set("datetime", strconv.FormatInt(req.Date, 10))
+	if req.Resolution != "" {
+		query.Set("resolution", req.Resolution)
+	}
+	if req.Range != "" {
+		query.Set("range", req.Range)
+	}
+	history, res, err := reqJSONResTrendHistory(ctx, a, http.MethodGet, getPathWithParams("/api/trend/history", query), []int{http.StatusOK})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return history, res, nil
+}
+
 func browserGetLandingPageAction(ctx context.Context, user AgentWithStaticCache) (service.GetTrendResponse, *http.Response, []error) {
 	// 静的ファイルのGET
 	if err := BrowserAccess(ctx, user, "/", TrendPage); err != nil {
 		return nil, nil, err
 	}
 
-	trend, res, err := getTrendAction(ctx, user.GetAgent())
+	trend, res, err := getTrendAction(ctx, user.GetAgent(), service.GetTrendRequest{})
 	if err != nil {
 		return nil, nil, []error{err}
 	}
@@ -746,7 +1000,9 @@ func BrowserAccess(ctx context.Context, user AgentWithStaticCache, rpath string,
 }
 
 func AgentDo(a *agent.Agent, ctx context.Context, req *http.Request) (*http.Response, error) {
-	return a.Do(ctx, req)
+	setTraceparent(req)
+	res, err := a.Do(ctx, req)
+	return res, withTraceID(req, err)
 }
 
 type AgentWithStaticCache interface {
@@ -759,9 +1015,10 @@ type AgentWithStaticCache interface {
 
 // User.StaticCachedHash を使って静的ファイルのキャッシュを更新する
 func AgentStaticDo(ctx context.Context, user AgentWithStaticCache, req *http.Request, cachePath string) (*http.Response, error) {
+	setTraceparent(req)
 	res, err := user.GetAgent().Do(ctx, req)
 	if err != nil {
-		return res, err
+		return res, withTraceID(req, err)
 	}
 
 	return res, nil
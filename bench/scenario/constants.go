@@ -1,5 +1,7 @@
 package scenario
 
+import "time"
+
 // score関係の定数には「Score」プレフィックスをつける
 
 type IScoreGraphTimestampCount struct {
@@ -65,3 +67,16 @@ const TimeoutLimitPerUser = 20
 
 // GET /api/isu/:id/graph と GET /api/condition/:id の間で許される condition 反映の遅延
 const ConditionDelayTime = 1
+
+// 非同期で activate する実装での POST /api/isu 後の activation_status
+const (
+	isuActivationStatusPending = "pending"
+	isuActivationStatusActive  = "active"
+	isuActivationStatusFailed  = "failed"
+)
+
+// POST /api/isu が 202 を返したとき、activate されるまで GET /api/isu/:jia_isu_uuid を投げる間隔と待つ時間の上限
+const (
+	isuActivationPollInterval = 100 * time.Millisecond
+	isuActivationPollTimeout  = 10 * time.Second
+)
@@ -2,6 +2,8 @@ package scenario
 
 import (
 	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
@@ -23,12 +25,17 @@ var (
 	streamsForPoster      = map[string]*model.StreamsForPoster{}
 	//isuDetailInfomation   = map[string]*IsuDetailInfomation{}
 	isuFromUUID = map[string]*model.Isu{}
+	// deactivate で poster Goroutine を止めるためのもの
+	posterCancels = map[string]context.CancelFunc{}
+	// activate で払い出した POST /api/condition の署名に使う secret
+	isuConditionSecrets = map[string]string{}
 
 	posterRootContext context.Context
 )
 
 type IsuDetailInfomation struct {
-	Character string `json:"character"`
+	Character       string `json:"character"`
+	ConditionSecret string `json:"condition_secret"`
 }
 
 //シナリオ Goroutineからの呼び出し
@@ -57,6 +64,7 @@ func (s *Scenario) JiaAPIService(ctx context.Context) {
 
 	// Initialize
 	e.POST("/api/activate", func(c echo.Context) error { return s.postActivate(c) })
+	e.POST("/api/deactivate", func(c echo.Context) error { return s.postDeactivate(c) })
 
 	// Start
 	var bindPort string
@@ -99,7 +107,8 @@ func (s *Scenario) postActivate(c echo.Context) error {
 	var isu *model.Isu
 	var scenarioChan *model.StreamsForPoster
 	var fqdn string
-	posterContext := posterRootContext
+	var secret string
+	posterContext, posterCancel := context.WithCancel(posterRootContext)
 	errCode, errMsg := func() (int, string) {
 		var ok bool
 		streamsForPosterMutex.Lock()
@@ -118,6 +127,8 @@ func (s *Scenario) postActivate(c echo.Context) error {
 		_, ok = isuIsActivated[state.IsuUUID]
 		if ok {
 			//activate済み
+			posterCancel()
+			secret = isuConditionSecrets[state.IsuUUID]
 			return 0, ""
 		}
 
@@ -143,21 +154,69 @@ func (s *Scenario) postActivate(c echo.Context) error {
 			targetBaseURL.Host = ipAddr
 		}
 
+		secret, err = generateIsuConditionSecret()
+		if err != nil {
+			return http.StatusInternalServerError, "Failed to generate secret"
+		}
+
 		// activate 済みフラグを立てる
 		isuIsActivated[state.IsuUUID] = struct{}{}
+		isuConditionSecrets[state.IsuUUID] = secret
+		posterCancels[state.IsuUUID] = posterCancel
 		//activate
 		s.loadWaitGroup.Add(1)
 		go func() {
 			defer s.loadWaitGroup.Done()
 			defer logger.AdminLogger.Println("defer s.loadWaitGroup.Done() keepPosting")
-			s.keepPosting(posterContext, targetBaseURL, fqdn, isu, scenarioChan)
+			s.keepPosting(posterContext, targetBaseURL, fqdn, isu, secret, scenarioChan)
 		}()
 		return 0, ""
 	}()
 	if errCode != 0 {
+		posterCancel()
 		return c.String(errCode, errMsg)
 	}
 
 	time.Sleep(50 * time.Millisecond)
-	return c.JSON(http.StatusAccepted, IsuDetailInfomation{isu.Character})
+	return c.JSON(http.StatusAccepted, IsuDetailInfomation{isu.Character, secret})
+}
+
+func (s *Scenario) postDeactivate(c echo.Context) error {
+	state := &service.JIADeactivationRequest{}
+	err := c.Bind(state)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Bad Request")
+	}
+
+	streamsForPosterMutex.Lock()
+	defer streamsForPosterMutex.Unlock()
+	if _, ok := streamsForPoster[state.IsuUUID]; !ok {
+		return c.String(http.StatusNotFound, "Bad isu_uuid")
+	}
+	// activate されていなくても成功として扱う
+	if cancel, ok := posterCancels[state.IsuUUID]; ok {
+		cancel()
+		delete(posterCancels, state.IsuUUID)
+	}
+	delete(isuIsActivated, state.IsuUUID)
+	delete(isuConditionSecrets, state.IsuUUID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func generateIsuConditionSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := crand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// activate されていなければ false を返す
+func getIsuConditionSecret(jiaIsuUUID string) (string, bool) {
+	streamsForPosterMutex.Lock()
+	defer streamsForPosterMutex.Unlock()
+	secret, ok := isuConditionSecrets[jiaIsuUUID]
+	return secret, ok
 }
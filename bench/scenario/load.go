@@ -17,6 +17,7 @@ import (
 	"github.com/isucon/isucandar/score"
 	"github.com/isucon/isucon11-qualify/bench/logger"
 	"github.com/isucon/isucon11-qualify/bench/model"
+	"github.com/isucon/isucon11-qualify/bench/random"
 	"github.com/isucon/isucon11-qualify/bench/service"
 )
 
@@ -356,7 +357,7 @@ func (s *Scenario) loadViewer(ctx context.Context, step *isucandar.BenchmarkStep
 			}
 			continue
 		}
-		updatedCount, err := s.verifyTrend(ctx, res, viewer, trend, requestTime)
+		updatedCount, err := s.verifyTrend(ctx, res, viewer, trend, service.GetTrendRequest{}, requestTime)
 		if err != nil {
 			addErrorWithContext(ctx, step, err)
 			viewer.ErrorCount += 1
@@ -364,6 +365,35 @@ func (s *Scenario) loadViewer(ctx context.Context, step *isucandar.BenchmarkStep
 		}
 		atomic.AddInt32(&viewUpdatedTrendCounter, int32(updatedCount))
 		step.AddScore(ScoreViewerLoop)
+
+		// 絞り込んだトレンドも時々見る。スコアと viewer を増やす件数には数えない
+		if s.trendFilter && rand.Intn(4) == 0 {
+			query := randomTrendRequest()
+			requestTime = time.Now()
+			trend, res, err := getTrendAction(ctx, viewer.Agent, query)
+			if err != nil {
+				addErrorWithContext(ctx, step, err)
+				viewer.ErrorCount += 1
+				continue
+			}
+			if _, err := s.verifyTrend(ctx, res, viewer, trend, query, requestTime); err != nil {
+				addErrorWithContext(ctx, step, err)
+				viewer.ErrorCount += 1
+				continue
+			}
+		}
+	}
+}
+
+// 性格、コンディションレベル、件数のいずれかで絞り込んだトレンドのリクエスト
+func randomTrendRequest() service.GetTrendRequest {
+	switch rand.Intn(3) {
+	case 0:
+		return service.GetTrendRequest{Character: random.CharacterData[rand.Intn(len(random.CharacterData))]}
+	case 1:
+		return service.GetTrendRequest{ConditionLevel: "warning,critical"}
+	default:
+		return service.GetTrendRequest{Limit: 1 + rand.Intn(10)}
 	}
 }
 
@@ -569,20 +599,41 @@ func (s *Scenario) getIsuConditionUntilAlreadyRead(
 	// 今回のこの関数で取得した condition の配列
 	conditions := service.GetIsuConditionResponseArray{}
 
+	// -condition-cursor のときは limit を付けて next_cursor 付きのレスポンスを受け取り、続きは next_cursor で取得する
+	nextCursor := ""
+	getConditionPage := func(request service.GetIsuConditionRequest) (service.GetIsuConditionResponseArray, *http.Response, error) {
+		if !s.conditionCursorPaging {
+			return getIsuConditionAction(ctx, user.Agent, targetIsu.JIAIsuUUID, request)
+		}
+		if nextCursor != "" {
+			request = service.GetIsuConditionRequest{Cursor: nextCursor}
+		} else {
+			request.Limit = service.ConditionLimit
+		}
+		page, hres, err := getIsuConditionPageAction(ctx, user.Agent, targetIsu.JIAIsuUUID, request)
+		if err != nil {
+			return nil, nil, err
+		}
+		if page.NextCursor == nil {
+			if len(page.Conditions) == service.ConditionLimit {
+				return nil, nil, errorInvalid(hres, "next_cursor がありません")
+			}
+			nextCursor = ""
+		} else {
+			nextCursor = *page.NextCursor
+		}
+		return page.Conditions, hres, nil
+	}
+
 	requestTimeUnix := time.Now().Unix()
 	// GET condition/{jia_isu_uuid} を取得してバリデーション
-	firstPageConditions, errs := browserGetIsuConditionAction(ctx, user.Agent, targetIsu.JIAIsuUUID,
-		request,
-		func(res *http.Response, conditions service.GetIsuConditionResponseArray) []error {
-			err := verifyIsuConditions(res, user, targetIsu.JIAIsuUUID, &request, conditions, targetIsu.LastReadConditionTimestamps, requestTimeUnix)
-			if err != nil {
-				return []error{err}
-			}
-			return []error{}
-		},
-	)
-	if len(errs) > 0 {
-		return nil, newLastReadConditionTimestamps, errs
+	firstPageConditions, hres, err := getConditionPage(request)
+	if err != nil {
+		return nil, newLastReadConditionTimestamps, []error{err}
+	}
+	err = verifyIsuConditions(hres, user, targetIsu.JIAIsuUUID, &request, firstPageConditions, targetIsu.LastReadConditionTimestamps, requestTimeUnix)
+	if err != nil {
+		return nil, newLastReadConditionTimestamps, []error{err}
 	}
 	for i, c := range firstPageConditions {
 		newLastReadConditionTimestamps[i] = c.Timestamp
@@ -618,7 +669,7 @@ func (s *Scenario) getIsuConditionUntilAlreadyRead(
 		}
 
 		requestTimeUnix = time.Now().Unix()
-		tmpConditions, hres, err := getIsuConditionAction(ctx, user.Agent, targetIsu.JIAIsuUUID, request)
+		tmpConditions, hres, err := getConditionPage(request)
 		if err != nil {
 			return nil, newLastReadConditionTimestamps, []error{err}
 		}
@@ -95,7 +95,7 @@ func (s *Scenario) postConditionNumReporter(ctx context.Context, step *isucandar
 }
 
 //POST /api/condition/{jia_isu_id}をたたく Goroutine
-func (s *Scenario) keepPosting(ctx context.Context, targetBaseURL *url.URL, fqdn string, isu *model.Isu, scenarioChan *model.StreamsForPoster) {
+func (s *Scenario) keepPosting(ctx context.Context, targetBaseURL *url.URL, fqdn string, isu *model.Isu, secret string, scenarioChan *model.StreamsForPoster) {
 
 	targetBaseURLMapMutex.Lock()
 	targetBaseURLMap[targetBaseURL.String()] = fqdn
@@ -227,7 +227,7 @@ func (s *Scenario) keepPosting(ctx context.Context, targetBaseURL *url.URL, fqdn
 		isu.AddIsuConditions(conditions)
 
 		// timeout も無視するので全てのエラーを見ない
-		postIsuConditionAction(ctx, httpClient, targetBaseURL.String(), &conditionsReq)
+		postIsuConditionAction(ctx, httpClient, targetBaseURL.String(), secret, &conditionsReq)
 	}
 }
 
@@ -385,6 +385,11 @@ func (s *Scenario) keepPostingError(ctx context.Context) {
 		if isu == nil {
 			continue
 		}
+		// 署名は正しく付け、コンディションのフォーマットの誤りだけを送る
+		secret, ok := getIsuConditionSecret(isu.JIAIsuUUID)
+		if !ok {
+			continue
+		}
 
 		//状態変化
 		stateChange := model.IsuStateChangeNone
@@ -464,6 +469,6 @@ func (s *Scenario) keepPostingError(ctx context.Context) {
 		targetPath = path.Join(targetPath, "/api/condition/", isu.JIAIsuUUID)
 		httpClient.Transport.(*http.Transport).TLSClientConfig.ServerName = targetServer
 		// timeout も無視するので全てのエラーを見ない
-		postIsuConditionAction(ctx, httpClient, targetPath, &conditionsReq)
+		postIsuConditionAction(ctx, httpClient, targetPath, secret, &conditionsReq)
 	}
 }
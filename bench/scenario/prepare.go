@@ -164,6 +164,15 @@ func (s *Scenario) prepareCheck(parent context.Context, step *isucandar.Benchmar
 	// ユーザのISUが増えるので他の検証終わった後に実行
 	s.prepareCheckPostIsu(ctx, isuconUser, s.noIsuUser, guestAgent, step)
 	s.prepareCheckPostIsuWithPrevCondition(ctx, isuconUser, step, unregisteredIsu)
+	if s.isuLifecycle {
+		s.prepareCheckIsuLifecycle(ctx, isuconUser, s.noIsuUser, guestAgent, step)
+	}
+	if s.isuSharing {
+		s.prepareCheckIsuSharing(ctx, isuconUser, s.noIsuUser, guestAgent, step)
+	}
+	if s.graphResolution {
+		s.prepareCheckGraphResolution(ctx, isuconUser, s.noIsuUser, guestAgent, step)
+	}
 	if hasErrors() {
 		return failure.NewError(ErrCritical, fmt.Errorf("アプリケーション互換性チェックに失敗しました"))
 	}
@@ -585,6 +594,9 @@ func (s *Scenario) prepareNormal(ctx context.Context, step *isucandar.BenchmarkS
 		step.AddError(err)
 		return
 	}
+	if s.trendFilter {
+		s.prepareCheckTrendFilter(ctx, viewerAgent, step)
+	}
 
 }
 
@@ -866,11 +878,344 @@ func (s *Scenario) prepareCheckPostIsu(ctx context.Context, loginUser *model.Use
 		step.AddError(err)
 		return
 	}
-	if err := verifyStatusCode(res, http.StatusNotFound); err != nil {
+	if res.StatusCode == http.StatusAccepted {
+		// 非同期で activate する実装では failed になることを確かめ、以降の検証のために削除する
+		if err := verifyIsuActivationFailed(ctx, loginUser.Agent, res, resBody); err != nil {
+			step.AddError(err)
+			return
+		}
+		_, err = deleteIsuAction(ctx, loginUser.Agent, NotExistJiaIsuUUID)
+		if err != nil {
+			step.AddError(err)
+			return
+		}
+	} else {
+		if err := verifyStatusCode(res, http.StatusNotFound); err != nil {
+			step.AddError(err)
+			return
+		}
+		if err := verifyText(res, resBody, "JIAService returned error"); err != nil {
+			step.AddError(err)
+			return
+		}
+	}
+}
+
+func (s *Scenario) prepareCheckIsuLifecycle(ctx context.Context, loginUser *model.User, noIsuUser *model.User, guestAgent *agent.Agent, step *isucandar.BenchmarkStep) {
+	// 他の検証に影響しないようユーザには追加しない
+	isu := s.NewIsuWithCustomImg(ctx, step, loginUser, false, nil, false)
+	if isu == nil {
+		return
+	}
+
+	//Isuの変更 e.PATCH("/api/isu/:jia_isu_uuid", patchIsu)
+	newName := random.IsuName()
+	req := service.PatchIsuRequest{IsuName: &newName}
+
+	// check: 未ログイン状態
+	resBody, res, err := patchIsuErrorAction(ctx, guestAgent, isu.JIAIsuUUID, req)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyNotSignedIn(res, resBody); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 他ユーザの椅子に対するリクエスト
+	resBody, res, err = patchIsuErrorAction(ctx, noIsuUser.Agent, isu.JIAIsuUUID, req)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "not found: isu", http.StatusNotFound); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 変更する項目が無い
+	resBody, res, err = patchIsuErrorAction(ctx, loginUser.Agent, isu.JIAIsuUUID, service.PatchIsuRequest{})
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "bad request body", http.StatusBadRequest); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 名前の変更
+	actual, res, err := patchIsuAction(ctx, loginUser.Agent, isu.JIAIsuUUID, req)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	isu.Name = newName
+	if err := verifyIsu(res, isu, actual); err != nil {
+		step.AddError(err)
+		return
+	}
+	actual, res, err = getIsuIdAction(ctx, loginUser.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyIsu(res, isu, actual); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: アイコンの変更
+	img, err := random.Image()
+	if err != nil {
+		logger.AdminLogger.Panic(err)
+	}
+	actual, res, err = patchIsuAction(ctx, loginUser.Agent, isu.JIAIsuUUID, service.PatchIsuRequest{Img: img})
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	isu.SetImage(img)
+	if err := verifyIsu(res, isu, actual); err != nil {
+		step.AddError(err)
+		return
+	}
+	icon, res, err := getIsuIconAction(ctx, loginUser.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyIsuIcon(isu, icon, res.StatusCode); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	//Isuの削除 e.DELETE("/api/isu/:jia_isu_uuid", deleteIsu)
+	// check: 未ログイン状態
+	resBody, res, err = deleteIsuErrorAction(ctx, guestAgent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyNotSignedIn(res, resBody); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 他ユーザの椅子に対するリクエスト
+	resBody, res, err = deleteIsuErrorAction(ctx, noIsuUser.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "not found: isu", http.StatusNotFound); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 削除が成功し、以降は取得できない
+	_, err = deleteIsuAction(ctx, loginUser.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	resBody, res, err = getIsuIdErrorAction(ctx, loginUser.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyIsuDeleted(res, resBody); err != nil {
+		step.AddError(err)
+		return
+	}
+	resBody, res, err = deleteIsuErrorAction(ctx, loginUser.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyIsuDeleted(res, resBody); err != nil {
+		step.AddError(err)
+		return
+	}
+}
+
+func (s *Scenario) prepareCheckIsuSharing(ctx context.Context, loginUser *model.User, noIsuUser *model.User, guestAgent *agent.Agent, step *isucandar.BenchmarkStep) {
+	// 初期データの ISU を共有し、共有されたユーザーから所有者と同じ内容が見えることを確かめる
+	isu := loginUser.IsuListOrderByCreatedAt[0]
+
+	// noIsuUser は他の検証で ISU を持たないことを前提にしているので、共有先のユーザーは新しく作る
+	viewerAgent, err := s.NewAgent(agent.WithTimeout(s.prepareTimeout))
+	if err != nil {
+		logger.AdminLogger.Panicln(err)
+	}
+	viewer := s.NewUser(ctx, step, viewerAgent, model.UserTypeNormal, false)
+	if viewer == nil {
+		return
+	}
+
+	// check: 共有前は参照できない
+	resBody, res, err := getIsuIdErrorAction(ctx, viewer.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "not found: isu", http.StatusNotFound); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	//ISUへの招待 e.POST("/api/isu/:jia_isu_uuid/invitation", postIsuInvitation)
+	req := service.PostIsuInvitationRequest{JIAUserID: viewer.UserID, Role: "viewer"}
+
+	// check: 未ログイン状態
+	resBody, res, err = postIsuInvitationErrorAction(ctx, guestAgent, isu.JIAIsuUUID, req)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyNotSignedIn(res, resBody); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 他ユーザの椅子に対するリクエスト
+	resBody, res, err = postIsuInvitationErrorAction(ctx, noIsuUser.Agent, isu.JIAIsuUUID, req)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "not found: isu", http.StatusNotFound); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 招待と受け入れ
+	invitation, res, err := postIsuInvitationAction(ctx, loginUser.Agent, isu.JIAIsuUUID, req)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if invitation.JIAIsuUUID != isu.JIAIsuUUID || invitation.JIAUserID != viewer.UserID || invitation.Role != req.Role {
+		step.AddError(errorMismatch(res, "招待の内容が異なります"))
+		return
+	}
+	invitations, res, err := getInvitationListAction(ctx, viewer.Agent)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if len(invitations) != 1 || invitations[0].ID != invitation.ID || invitations[0].IsuName != isu.Name {
+		step.AddError(errorMismatch(res, "招待の一覧が異なります"))
+		return
+	}
+	member, res, err := postInvitationAcceptAction(ctx, viewer.Agent, invitation.ID)
+	if err != nil {
 		step.AddError(err)
 		return
 	}
-	if err := verifyText(res, resBody, "JIAService returned error"); err != nil {
+	if member.JIAIsuUUID != isu.JIAIsuUUID || member.JIAUserID != viewer.UserID || member.Role != req.Role {
+		step.AddError(errorMismatch(res, "メンバーの内容が異なります"))
+		return
+	}
+
+	// check: 共有された ISU の一覧、情報、アイコン
+	isuList, res, err := getIsuAction(ctx, viewer.Agent)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if len(isuList) != 1 {
+		step.AddError(errorMismatch(res, "椅子の数が異なります"))
+		return
+	}
+	if err := verifyIsu(res, isu, isuList[0]); err != nil {
+		step.AddError(err)
+		return
+	}
+	actual, res, err := getIsuIdAction(ctx, viewer.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyIsu(res, isu, actual); err != nil {
+		step.AddError(err)
+		return
+	}
+	icon, res, err := getIsuIconAction(ctx, viewer.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyIsuIcon(isu, icon, res.StatusCode); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 共有された ISU のグラフとコンディションは所有者のものと同じ
+	isu.CondMutex.RLock()
+	lastCond := isu.Conditions.Back()
+	isu.CondMutex.RUnlock()
+	if lastCond != nil {
+		graphReq := service.GetGraphRequest{Date: trancateTimestampToDate(time.Unix(lastCond.TimestampUnix, 0))}
+		graph, res, err := getIsuGraphAction(ctx, viewer.Agent, isu.JIAIsuUUID, graphReq)
+		if err != nil {
+			step.AddError(err)
+			return
+		}
+		if err := verifyPrepareGraph(res, loginUser, isu.JIAIsuUUID, &graphReq, graph); err != nil {
+			step.AddError(err)
+			return
+		}
+
+		conditionReq := service.GetIsuConditionRequest{
+			EndTime:        lastCond.TimestampUnix,
+			ConditionLevel: "info,warning,critical",
+		}
+		conditions, res, err := getIsuConditionAction(ctx, viewer.Agent, isu.JIAIsuUUID, conditionReq)
+		if err != nil {
+			step.AddError(err)
+			return
+		}
+		if err := verifyPrepareIsuConditions(res, loginUser, isu.JIAIsuUUID, &conditionReq, conditions); err != nil {
+			step.AddError(err)
+			return
+		}
+	}
+
+	// check: 名前の変更と削除は所有者しかできない
+	newName := random.IsuName()
+	resBody, res, err = patchIsuErrorAction(ctx, viewer.Agent, isu.JIAIsuUUID, service.PatchIsuRequest{IsuName: &newName})
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "forbidden", http.StatusForbidden); err != nil {
+		step.AddError(err)
+		return
+	}
+	resBody, res, err = deleteIsuErrorAction(ctx, viewer.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "forbidden", http.StatusForbidden); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: メンバーから外すと参照できなくなる
+	_, err = deleteIsuMemberAction(ctx, loginUser.Agent, isu.JIAIsuUUID, viewer.UserID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	resBody, res, err = getIsuIdErrorAction(ctx, viewer.Agent, isu.JIAIsuUUID)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "not found: isu", http.StatusNotFound); err != nil {
 		step.AddError(err)
 		return
 	}
@@ -1219,7 +1564,8 @@ func (s *Scenario) prepareStartInvalidIsuPost(ctx context.Context) (*model.Isu,
 	posterCtx, cancel := context.WithCancel(ctx)
 	go func() {
 		defer close(posterStop)
-		s.keepPosting(posterCtx, targetBaseURL, agent.DefaultTLSConfig.ServerName, isu, streamsForPoster)
+		// activate していないので secret はない。未登録の ISU として 404 になる
+		s.keepPosting(posterCtx, targetBaseURL, agent.DefaultTLSConfig.ServerName, isu, "", streamsForPoster)
 	}()
 
 	return isu, cancel, posterStop
@@ -1304,3 +1650,176 @@ func (s *Scenario) prepareCheckPostIsuWithPrevCondition(ctx context.Context, log
 func getRandomIsu(user *model.User) *model.Isu {
 	return user.IsuListOrderByCreatedAt[rand.Intn(len(user.IsuListOrderByCreatedAt))]
 }
+
+func (s *Scenario) prepareCheckGraphResolution(ctx context.Context, loginUser *model.User, noIsuUser *model.User, guestAgent *agent.Agent, step *isucandar.BenchmarkStep) {
+	// コンディションのある ISU の最新のコンディションを含む週と四半期で検証する
+	var isu *model.Isu
+	var lastCond *model.IsuCondition
+	for _, candidate := range loginUser.IsuListOrderByCreatedAt {
+		candidate.CondMutex.RLock()
+		lastCond = candidate.Conditions.Back()
+		candidate.CondMutex.RUnlock()
+		if lastCond != nil {
+			isu = candidate
+			break
+		}
+	}
+	if isu == nil {
+		return
+	}
+
+	for _, resolution := range []model.GraphResolution{model.GraphResolutionDay, model.GraphResolutionWeek} {
+		req := service.GetGraphRequest{Date: lastCond.TimestampUnix, Resolution: resolution.Name, Range: resolution.Range}
+		graph, res, err := getIsuGraphAction(ctx, loginUser.Agent, isu.JIAIsuUUID, req)
+		if err != nil {
+			step.AddError(err)
+			return
+		}
+		if err := verifyPrepareGraphResolution(res, isu, resolution, &req, graph); err != nil {
+			step.AddError(err)
+			return
+		}
+	}
+
+	query := url.Values{}
+	query.Set("datetime", strconv.FormatInt(lastCond.TimestampUnix, 10))
+	query.Set("resolution", model.GraphResolutionWeek.Name)
+
+	// check: 未ログイン状態
+	resBody, res, err := getIsuGraphErrorAction(ctx, guestAgent, isu.JIAIsuUUID, query)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyNotSignedIn(res, resBody); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: 他ユーザの椅子に対するリクエスト
+	resBody, res, err = getIsuGraphErrorAction(ctx, noIsuUser.Agent, isu.JIAIsuUUID, query)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "not found: isu", http.StatusNotFound); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: resolution のフォーマット違反
+	query.Set("resolution", "month")
+	resBody, res, err = getIsuGraphErrorAction(ctx, loginUser.Agent, isu.JIAIsuUUID, query)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "bad format: resolution", http.StatusBadRequest); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: resolution と range の組み合わせ違反
+	query.Set("resolution", model.GraphResolutionDay.Name)
+	query.Set("range", model.GraphResolutionDay.Name)
+	resBody, res, err = getIsuGraphErrorAction(ctx, loginUser.Agent, isu.JIAIsuUUID, query)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "bad format: range", http.StatusBadRequest); err != nil {
+		step.AddError(err)
+		return
+	}
+}
+
+func (s *Scenario) prepareCheckTrendFilter(ctx context.Context, viewerAgent *agent.Agent, step *isucandar.BenchmarkStep) {
+	// 最新のコンディションがある ISU の性格とその時刻で検証する
+	isuList := s.getIsuList()
+	var target *model.Isu
+	var lastCond *model.IsuCondition
+	for _, isu := range isuList {
+		isu.CondMutex.RLock()
+		lastCond = isu.Conditions.Back()
+		isu.CondMutex.RUnlock()
+		if lastCond != nil {
+			target = isu
+			break
+		}
+	}
+	if target == nil {
+		return
+	}
+
+	since := lastCond.TimestampUnix - 60*60
+	for _, query := range []service.GetTrendRequest{
+		{Character: target.Character},
+		{Character: target.Character, ConditionLevel: "warning,critical", Limit: 3},
+		{ConditionLevel: "info", Limit: 1},
+		{Since: &since},
+	} {
+		trend, res, err := getTrendAction(ctx, viewerAgent, query)
+		if err != nil {
+			step.AddError(err)
+			return
+		}
+		if err := verifyPrepareTrendFilter(res, isuList, query, trend); err != nil {
+			step.AddError(err)
+			return
+		}
+	}
+
+	req := service.GetTrendHistoryRequest{
+		Date:       lastCond.TimestampUnix,
+		Resolution: model.GraphResolutionDay.Name,
+		Range:      model.GraphResolutionDay.Range,
+	}
+	history, res, err := getTrendHistoryAction(ctx, viewerAgent, req)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verifyPrepareTrendHistory(res, isuList, model.GraphResolutionDay, &req, history); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: condition_level のフォーマット違反
+	query := url.Values{}
+	query.Set("condition_level", "info,fatal")
+	resBody, res, err := getTrendErrorAction(ctx, viewerAgent, query)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "bad format: condition_level", http.StatusBadRequest); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: limit のフォーマット違反
+	query = url.Values{}
+	query.Set("limit", "0")
+	resBody, res, err = getTrendErrorAction(ctx, viewerAgent, query)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "bad format: limit", http.StatusBadRequest); err != nil {
+		step.AddError(err)
+		return
+	}
+
+	// check: since のフォーマット違反
+	query = url.Values{}
+	query.Set("since", "yesterday")
+	resBody, res, err = getTrendErrorAction(ctx, viewerAgent, query)
+	if err != nil {
+		step.AddError(err)
+		return
+	}
+	if err := verify4xxError(res, resBody, "bad format: since", http.StatusBadRequest); err != nil {
+		step.AddError(err)
+		return
+	}
+}
@@ -18,14 +18,19 @@ import (
 	"github.com/pierrec/xxHash/xxHash64"
 )
 
+// エラーを期待するリクエストで Accept: application/json を送り、JSON のエラーレスポンスを検証する (Scenario.WithJSONError)
+var acceptJSONError = false
+
 var (
-	trendHash = TrendHash{mx: sync.Mutex{}, hash: map[uint64]service.GetTrendResponse{}}
+	trendHash = TrendHash{mx: sync.Mutex{}, hash: map[uint64]service.GetTrendResponse{}, historyHash: map[uint64]service.GetTrendHistoryResponse{}}
 	h64       = xxHash64.New(0)
 )
 
 type TrendHash struct {
 	mx   sync.Mutex
 	hash map[uint64]service.GetTrendResponse
+	// GET /api/trend/history のレスポンス
+	historyHash map[uint64]service.GetTrendHistoryResponse
 }
 
 func (t *TrendHash) getObj(res []byte) (service.GetTrendResponse, error) {
@@ -51,6 +56,28 @@ func (t *TrendHash) getObj(res []byte) (service.GetTrendResponse, error) {
 	return obj, nil
 }
 
+func (t *TrendHash) getHistoryObj(res []byte) (service.GetTrendHistoryResponse, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	h64.Write(res)
+	hash := h64.Sum64()
+	h64.Reset()
+	cache, exist := t.historyHash[hash]
+	if exist {
+		return cache, nil
+	}
+
+	obj := service.GetTrendHistoryResponse{}
+	err := json.Unmarshal(res, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	t.historyHash[hash] = obj
+	return obj, nil
+}
+
 func reqNoContentResNoContent(ctx context.Context, agent *agent.Agent, method string, rpath string, allowedStatusCodes []int) (*http.Response, error) {
 	httpreq, err := agent.NewRequest(method, rpath, nil)
 	if err != nil {
@@ -72,18 +99,21 @@ func reqNoContentResError(ctx context.Context, agent *agent.Agent, method string
 		logger.AdminLogger.Panic(err)
 	}
 
+	if acceptJSONError {
+		httpreq.Header.Set("Accept", "application/json")
+	}
 	httpres, err := doRequest(ctx, agent, httpreq, allowedStatusCodes)
 	if err != nil {
 		return nil, "", err
 	}
 	defer httpres.Body.Close()
 
-	resBody, err := checkContentTypeAndGetBody(httpres, "text/plain")
+	text, err := getErrorMessage(httpres)
 	if err != nil {
 		return httpres, "", err
 	}
 
-	return httpres, string(resBody), nil
+	return httpres, text, nil
 }
 
 func reqNoContentResPng(ctx context.Context, agent *agent.Agent, method string, rpath string, allowedStatusCodes []int) (*http.Response, []byte, error) {
@@ -198,6 +228,34 @@ func reqJSONResTrend(ctx context.Context, agent *agent.Agent, method string, rpa
 	return trend, httpres, nil
 }
 
+func reqJSONResTrendHistory(ctx context.Context, agent *agent.Agent, method string, rpath string, allowedStatusCodes []int) (service.GetTrendHistoryResponse, *http.Response, error) {
+	httpreq, err := agent.NewRequest(method, rpath, nil)
+	if err != nil {
+		logger.AdminLogger.Panic(err)
+	}
+
+	httpres, err := doRequest(ctx, agent, httpreq, allowedStatusCodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpres.Body.Close()
+
+	if !strings.HasPrefix(httpres.Header.Get("Content-Type"), "application/json") {
+		return nil, nil, errorInvalidContentType(httpres, "application/json")
+	}
+
+	bytes, err := io.ReadAll(httpres.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	history, err := trendHash.getHistoryObj(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return history, httpres, nil
+}
+
 func reqJSONResNoContent(ctx context.Context, agent *agent.Agent, method string, rpath string, body io.Reader, allowedStatusCodes []int) (*http.Response, error) {
 	httpreq, err := agent.NewRequest(method, rpath, body)
 	if err != nil {
@@ -221,17 +279,20 @@ func reqJSONResError(ctx context.Context, agent *agent.Agent, method string, rpa
 	}
 	httpreq.Header.Set("Content-Type", "application/json")
 
+	if acceptJSONError {
+		httpreq.Header.Set("Accept", "application/json")
+	}
 	httpres, err := doRequest(ctx, agent, httpreq, allowedStatusCodes)
 	if err != nil {
 		return nil, "", err
 	}
 
-	resBody, err := checkContentTypeAndGetBody(httpres, "text/plain")
+	text, err := getErrorMessage(httpres)
 	if err != nil {
 		return httpres, "", err
 	}
 
-	return httpres, string(resBody), nil
+	return httpres, text, nil
 }
 
 func reqMultipartResJSON(ctx context.Context, agent *agent.Agent, method string, rpath string, body io.Reader, writer *multipart.Writer, res interface{}, allowedStatusCodes []int) (*http.Response, error) {
@@ -266,17 +327,20 @@ func reqMultipartResError(ctx context.Context, agent *agent.Agent, method string
 	}
 	httpreq.Header.Set("Content-Type", writer.FormDataContentType())
 
+	if acceptJSONError {
+		httpreq.Header.Set("Accept", "application/json")
+	}
 	httpres, err := doRequest(ctx, agent, httpreq, allowedStatusCodes)
 	if err != nil {
 		return nil, "", err
 	}
 
-	resBody, err := checkContentTypeAndGetBody(httpres, "text/plain")
+	text, err := getErrorMessage(httpres)
 	if err != nil {
 		return httpres, "", err
 	}
 
-	return httpres, string(resBody), nil
+	return httpres, text, nil
 }
 
 func doRequest(ctx context.Context, agent *agent.Agent, httpreq *http.Request, allowedStatusCodes []int) (*http.Response, error) {
@@ -301,6 +365,43 @@ func doRequest(ctx context.Context, agent *agent.Agent, httpreq *http.Request, a
 	return httpres, nil
 }
 
+// エラーのレスポンスボディからメッセージを取り出す。
+// text/plain ならボディそのもの、application/json なら service.ErrorResponse の message を返す
+func getErrorMessage(httpres *http.Response) (string, error) {
+	if !strings.HasPrefix(httpres.Header.Get("Content-Type"), "application/json") {
+		resBody, err := checkContentTypeAndGetBody(httpres, "text/plain")
+		if err != nil {
+			return "", err
+		}
+		return string(resBody), nil
+	}
+
+	resBody, err := checkContentTypeAndGetBody(httpres, "application/json")
+	if err != nil {
+		return "", err
+	}
+	var errRes service.ErrorResponse
+	if err := json.Unmarshal(resBody, &errRes); err != nil {
+		return "", errorInvalidJSON(httpres)
+	}
+	if errRes.Code == "" {
+		return "", errorInvalid(httpres, "エラーレスポンスの code がありません")
+	}
+	if errRes.RequestID == "" {
+		return "", errorInvalid(httpres, "エラーレスポンスの request_id がありません")
+	}
+	if requestID := httpres.Header.Get("X-Request-Id"); requestID != "" && requestID != errRes.RequestID {
+		return "", errorMismatch(httpres, "エラーレスポンスの request_id が X-Request-Id と一致しません")
+	}
+	// "bad format: field" と "missing: field" は field を持つ
+	for _, prefix := range []string{"bad format: ", "missing: "} {
+		if strings.HasPrefix(errRes.Message, prefix) && errRes.Field != strings.TrimPrefix(errRes.Message, prefix) {
+			return "", errorMismatch(httpres, "エラーレスポンスの field が正しくありません")
+		}
+	}
+	return errRes.Message, nil
+}
+
 func checkContentTypeAndGetBody(httpres *http.Response, contentType string) ([]byte, error) {
 	defer httpres.Body.Close()
 
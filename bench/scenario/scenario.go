@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -37,6 +38,17 @@ type Scenario struct {
 	initializeTimeout time.Duration
 	prepareTimeout    time.Duration // prepareのTimeoutデフォルト設定
 
+	// GET /api/condition/:jia_isu_uuid のスクロールを end_time ではなく next_cursor で行う
+	conditionCursorPaging bool
+	// prepare で PATCH, DELETE /api/isu/:jia_isu_uuid を検証する
+	isuLifecycle bool
+	// prepare で ISU を共有した別のユーザーからの参照を検証する
+	isuSharing bool
+	// prepare で resolution が day, week のグラフを検証する
+	graphResolution bool
+	// GET /api/trend の絞り込みと GET /api/trend/history を検証する
+	trendFilter bool
+
 	// 競技者の実装言語
 	Language string
 
@@ -86,6 +98,43 @@ func (s *Scenario) WithInitializeTimeout(t time.Duration) *Scenario {
 	return s
 }
 
+func (s *Scenario) WithConditionCursorPaging(enabled bool) *Scenario {
+	s.conditionCursorPaging = enabled
+	return s
+}
+
+func (s *Scenario) WithIsuLifecycle(enabled bool) *Scenario {
+	s.isuLifecycle = enabled
+	return s
+}
+
+func (s *Scenario) WithIsuSharing(enabled bool) *Scenario {
+	s.isuSharing = enabled
+	return s
+}
+
+func (s *Scenario) WithGraphResolution(enabled bool) *Scenario {
+	s.graphResolution = enabled
+	return s
+}
+
+func (s *Scenario) WithTrendFilter(enabled bool) *Scenario {
+	s.trendFilter = enabled
+	return s
+}
+
+// エラーを期待するリクエストで JSON のエラーレスポンスを要求する。リクエストの関数が参照するのでパッケージ全体の設定になる
+func (s *Scenario) WithJSONError(enabled bool) *Scenario {
+	acceptJSONError = enabled
+	return s
+}
+
+// agent のリクエストに traceparent を付け、エラーに trace id を添える。リクエストの関数が参照するのでパッケージ全体の設定になる
+func (s *Scenario) WithTrace(enabled bool) *Scenario {
+	sendTraceparent = enabled
+	return s
+}
+
 func (s *Scenario) separatedTransport() agent.AgentOption {
 	return func(a *agent.Agent) error {
 		transport := agent.DefaultTransport.Clone()
@@ -345,6 +394,18 @@ func (s *Scenario) UpdateIsuFromID(isu *model.Isu) {
 	s.isuFromID[isu.ID] = isu
 }
 
+// 登録済みの全ての ISU を ID の昇順で返す
+func (s *Scenario) getIsuList() []*model.Isu {
+	s.isuFromIDMutex.RLock()
+	defer s.isuFromIDMutex.RUnlock()
+	isuList := make([]*model.Isu, 0, len(s.isuFromID))
+	for _, isu := range s.isuFromID {
+		isuList = append(isuList, isu)
+	}
+	sort.Slice(isuList, func(i, j int) bool { return isuList[i].ID < isuList[j].ID })
+	return isuList
+}
+
 func (s *Scenario) GetIsuFromID(id int) (*model.Isu, bool) {
 	s.isuFromIDMutex.RLock()
 	defer s.isuFromIDMutex.RUnlock()
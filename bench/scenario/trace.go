@@ -0,0 +1,65 @@
+package scenario
+
+// リクエストのトレース (Scenario.WithTrace)
+// agent のリクエストに W3C Trace Context の traceparent ヘッダーを付け、エラーのメッセージに trace id を添える。
+// webapp の TRACE_EXPORT_PATH に書き出された span と突き合わせて、エラーになったリクエストを追えるようにする。
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const traceparentHeader = "traceparent"
+
+// リクエストの関数が参照するのでパッケージ全体の設定になる
+var sendTraceparent = false
+
+type tracedError struct {
+	err     error
+	traceID string
+}
+
+func (e *tracedError) Error() string {
+	return e.err.Error() + " [trace_id: " + e.traceID + "]"
+}
+
+func (e *tracedError) Unwrap() error {
+	return e.err
+}
+
+// sampled の traceparent を付ける。既に付いていれば付け直さない
+func setTraceparent(req *http.Request) {
+	if !sendTraceparent || req.Header.Get(traceparentHeader) != "" {
+		return
+	}
+	req.Header.Set(traceparentHeader, "00-"+randomHexID(16)+"-"+randomHexID(8)+"-01")
+}
+
+// traceparent の trace id を返す。付いていなければ空文字列
+func traceIDFromRequest(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	parts := strings.Split(req.Header.Get(traceparentHeader), "-")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[1]
+}
+
+// req に traceparent が付いていれば err に trace id を添える
+func withTraceID(req *http.Request, err error) error {
+	traceID := traceIDFromRequest(req)
+	if err == nil || traceID == "" {
+		return err
+	}
+	return &tracedError{err: err, traceID: traceID}
+}
+
+func randomHexID(byteLen int) string {
+	b := make([]byte, byteLen)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
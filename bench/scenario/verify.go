@@ -14,13 +14,16 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/isucon/isucandar/agent"
 	"github.com/isucon/isucandar/failure"
 	"github.com/isucon/isucon11-qualify/bench/logger"
 
 	"github.com/isucon/isucon11-qualify/bench/model"
+	"github.com/isucon/isucon11-qualify/bench/random"
 	"github.com/isucon/isucon11-qualify/bench/service"
 )
 
@@ -101,9 +104,36 @@ func verifyIsu(res *http.Response, expected *model.Isu, actual *service.Isu) err
 		logger.AdminLogger.Printf("expected: { ID: %v, Character: %v, Name: %v }, actual: { ID: %v, Character: %v, Name: %v }", expected.ID, expected.Character, expected.Name, actual.ID, actual.Character, actual.Name)
 		return errorMismatch(res, "椅子(JIA_ISU_UUID=%s)の情報が異なります", expected.JIAIsuUUID)
 	}
+	if actual.ActivationStatus != "" && actual.ActivationStatus != isuActivationStatusActive {
+		return errorMismatch(res, "椅子(JIA_ISU_UUID=%s)が activate されていません (%s)", expected.JIAIsuUUID, actual.ActivationStatus)
+	}
+	return nil
+}
+
+// 非同期で activate する実装で、JIA に存在しない椅子の activate が理由と共に failed になることのチェック
+func verifyIsuActivationFailed(ctx context.Context, a *agent.Agent, res *http.Response, resBody string) error {
+	isu := &service.Isu{}
+	if err := json.Unmarshal([]byte(resBody), isu); err != nil {
+		return errorInvalidJSON(res)
+	}
+	isu, res, err := pollIsuActivation(ctx, a, isu, res)
+	if err != nil {
+		return err
+	}
+	if isu.ActivationStatus != isuActivationStatusFailed {
+		return errorMismatch(res, "存在しない椅子の activation_status が failed ではありません (%s)", isu.ActivationStatus)
+	}
+	if isu.ActivationError == "" {
+		return errorMismatch(res, "activate に失敗した椅子の activation_error がありません")
+	}
 	return nil
 }
 
+//削除した椅子が取得できないことのチェック
+func verifyIsuDeleted(res *http.Response, text string) error {
+	return verify4xxError(res, text, "not found: isu", http.StatusNotFound)
+}
+
 func verifyIsuIcon(expected *model.Isu, actual []byte, actualStatusCode int) error {
 	if expected.ImageHash != md5.Sum(actual) {
 		return failure.NewError(ErrMismatch, errorFormatWithURI(
@@ -675,6 +705,7 @@ func (s *Scenario) verifyTrend(
 	ctx context.Context, res *http.Response,
 	viewer *model.Viewer,
 	trendResp service.GetTrendResponse,
+	query service.GetTrendRequest,
 	requestTime time.Time,
 ) (int, error) {
 
@@ -695,10 +726,20 @@ func (s *Scenario) verifyTrend(
 			return 0, errorInvalid(res, err.Error())
 		}
 		characterSet = characterSet.Append(character)
+		if query.Character != "" && trendOne.Character != query.Character {
+			return 0, errorMismatch(res, "指定していない性格のトレンドが返されました")
+		}
 
 		for conditionEnum, conditions := range [][]service.TrendCondition{trendOne.Info, trendOne.Warning, trendOne.Critical} {
 			conditionLevel := conditionList[conditionEnum]
 
+			if len(conditions) != 0 && !trendQueryHasConditionLevel(query, conditionLevel) {
+				return 0, errorMismatch(res, "指定していないコンディションレベルのコンディションが返されました")
+			}
+			if query.Limit != 0 && len(conditions) > query.Limit {
+				return 0, errorMismatch(res, "limit を超える数のコンディションが返されました")
+			}
+
 			var lastConditionTimestamp int64
 			for idx, condition := range conditions {
 
@@ -708,6 +749,10 @@ func (s *Scenario) verifyTrend(
 				}
 				lastConditionTimestamp = condition.Timestamp
 
+				if query.Since != nil && condition.Timestamp < *query.Since {
+					return 0, errorMismatch(res, "since より古いコンディションが返されました")
+				}
+
 				// condition.ID から isu を取得する
 				isu, ok := s.GetIsuFromID(condition.IsuID)
 				if !ok {
@@ -765,6 +810,10 @@ func (s *Scenario) verifyTrend(
 			}
 		}
 	}
+	// 絞り込んだときは性格と ISU が欠けるので、全体の検証はしない
+	if query.Filtered() {
+		return newConditionNum, nil
+	}
 	// characterSet の検証
 	if !characterSet.IsFull() {
 		return 0, errorInvalid(res, "全ての性格のトレンドが取得できていません")
@@ -775,6 +824,19 @@ func (s *Scenario) verifyTrend(
 	}
 	return newConditionNum, nil
 }
+
+// condition_level の指定に conditionLevel が含まれるか。指定が無ければ全て含む
+func trendQueryHasConditionLevel(query service.GetTrendRequest, conditionLevel string) bool {
+	if query.ConditionLevel == "" {
+		return true
+	}
+	for _, level := range strings.Split(query.ConditionLevel, ",") {
+		if level == conditionLevel {
+			return true
+		}
+	}
+	return false
+}
 func (s *Scenario) verifyPrepareTrend(
 	res *http.Response,
 	viewer *model.Viewer,
@@ -974,6 +1036,64 @@ func verifyPrepareGraph(res *http.Response, targetUser *model.User, targetIsuUUI
 	return nil
 }
 
+// resolution が day, week のグラフを bench のコンディションから計算した値と比べる
+// verifyPrepareGraph と同じく全てのコンディションが書き込まれている前提で検証する
+func verifyPrepareGraphResolution(res *http.Response, targetIsu *model.Isu, resolution model.GraphResolution,
+	getGraphReq *service.GetGraphRequest,
+	getGraphResp service.GraphResponse) error {
+
+	if len(getGraphResp) != resolution.Points {
+		return errorInvalid(res, "要素数が正しくありません")
+	}
+
+	startAt := resolution.StartAt(getGraphReq.Date)
+	endAt := resolution.EndAt(getGraphReq.Date)
+
+	var conditions []*model.IsuCondition
+	func() {
+		targetIsu.CondMutex.RLock()
+		defer targetIsu.CondMutex.RUnlock()
+
+		filter := model.ConditionLevelInfo | model.ConditionLevelWarning | model.ConditionLevelCritical
+		baseIter := targetIsu.Conditions.LowerBound(filter, endAt)
+		for {
+			expected := baseIter.Prev()
+			if expected == nil || expected.TimestampUnix < startAt {
+				break
+			}
+			conditions = append(conditions, expected)
+		}
+	}()
+	expectedGraphs := model.NewGraphsByResolution(conditions, startAt, resolution)
+
+	step := int64(resolution.Step / time.Second)
+	for i, graphOne := range getGraphResp {
+		// getGraphResp の要素が古い順に連続して並んでいることの検証
+		if graphOne.StartAt != startAt+step*int64(i) || graphOne.EndAt != graphOne.StartAt+step {
+			return errorInvalid(res, "グラフの日付が間違っています")
+		}
+
+		expectedGraph := expectedGraphs[i]
+		if (expectedGraph == nil) != (graphOne.Data == nil) {
+			return errorMismatch(res, "グラフの data が正しくありません")
+		}
+		if expectedGraph == nil {
+			continue
+		}
+		if !expectedGraph.Match(
+			graphOne.Data.Score,
+			graphOne.Data.Percentage.Sitting,
+			graphOne.Data.Percentage.IsBroken,
+			graphOne.Data.Percentage.IsDirty,
+			graphOne.Data.Percentage.IsOverweight,
+		) {
+			return errorMismatch(res, "グラフのデータが正しくありません")
+		}
+	}
+
+	return nil
+}
+
 func verifyPrepareIsuList(res *http.Response, expectedReverse []*model.Isu, isuList []*service.Isu) []error {
 	var errs []error
 	length := len(expectedReverse)
@@ -1035,3 +1155,130 @@ func verifyMe(userID string, hres *http.Response, me *service.GetMeResponse) err
 	}
 	return nil
 }
+
+// isuList の最新のコンディションから期待するトレンドを組み立てて完全一致を検証する
+func verifyPrepareTrendFilter(res *http.Response, isuList []*model.Isu, query service.GetTrendRequest, trendResp service.GetTrendResponse) error {
+	type expectedCondition struct {
+		isuID     int
+		timestamp int64
+	}
+	expected := map[string][][]expectedCondition{}
+	for _, character := range random.CharacterData {
+		if query.Character == "" || query.Character == character {
+			expected[character] = make([][]expectedCondition, len(conditionList))
+		}
+	}
+	for _, isu := range isuList {
+		conditions, ok := expected[isu.Character]
+		if !ok {
+			continue
+		}
+		isu.CondMutex.RLock()
+		lastCond := isu.Conditions.Back()
+		isu.CondMutex.RUnlock()
+		if lastCond == nil || (query.Since != nil && lastCond.TimestampUnix < *query.Since) {
+			continue
+		}
+		for conditionEnum, conditionLevel := range conditionList {
+			if lastCond.ConditionLevel.Equal(conditionLevel) && trendQueryHasConditionLevel(query, conditionLevel) {
+				conditions[conditionEnum] = append(conditions[conditionEnum], expectedCondition{isuID: isu.ID, timestamp: lastCond.TimestampUnix})
+			}
+		}
+	}
+
+	if len(trendResp) != len(expected) {
+		return errorMismatch(res, "トレンドの性格の数が正しくありません")
+	}
+	for _, trendOne := range trendResp {
+		conditions, ok := expected[trendOne.Character]
+		if !ok {
+			return errorMismatch(res, "指定していない性格のトレンドが返されました")
+		}
+		for conditionEnum, actual := range [][]service.TrendCondition{trendOne.Info, trendOne.Warning, trendOne.Critical} {
+			expectedConditions := conditions[conditionEnum]
+			// 新しい順、timestamp が同じなら ID の昇順
+			sort.Slice(expectedConditions, func(i, j int) bool {
+				if expectedConditions[i].timestamp != expectedConditions[j].timestamp {
+					return expectedConditions[i].timestamp > expectedConditions[j].timestamp
+				}
+				return expectedConditions[i].isuID < expectedConditions[j].isuID
+			})
+			if query.Limit != 0 && len(expectedConditions) > query.Limit {
+				expectedConditions = expectedConditions[:query.Limit]
+			}
+			if len(actual) != len(expectedConditions) {
+				return errorMismatch(res, "トレンドのコンディションの数が正しくありません")
+			}
+			for i, condition := range actual {
+				if condition.IsuID != expectedConditions[i].isuID || condition.Timestamp != expectedConditions[i].timestamp {
+					return errorMismatch(res, "トレンドのコンディションが正しくありません")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 性格毎のコンディションレベル毎の件数を isuList のコンディションから数えて検証する
+func verifyPrepareTrendHistory(res *http.Response, isuList []*model.Isu, resolution model.GraphResolution,
+	req *service.GetTrendHistoryRequest,
+	historyResp service.GetTrendHistoryResponse) error {
+
+	startAt := resolution.StartAt(req.Date)
+	endAt := resolution.EndAt(req.Date)
+	step := int64(resolution.Step / time.Second)
+
+	// 性格毎、データ点毎の info, warning, critical の件数
+	expected := map[string][][3]int{}
+	for _, character := range random.CharacterData {
+		expected[character] = make([][3]int, resolution.Points)
+	}
+	for _, isu := range isuList {
+		counts, ok := expected[isu.Character]
+		if !ok {
+			continue
+		}
+		func() {
+			isu.CondMutex.RLock()
+			defer isu.CondMutex.RUnlock()
+
+			filter := model.ConditionLevelInfo | model.ConditionLevelWarning | model.ConditionLevelCritical
+			baseIter := isu.Conditions.LowerBound(filter, endAt)
+			for {
+				cond := baseIter.Prev()
+				if cond == nil || cond.TimestampUnix < startAt {
+					break
+				}
+				i := (cond.TimestampUnix - startAt) / step
+				for conditionEnum, conditionLevel := range conditionList {
+					if cond.ConditionLevel.Equal(conditionLevel) {
+						counts[i][conditionEnum]++
+					}
+				}
+			}
+		}()
+	}
+
+	if len(historyResp) != len(expected) {
+		return errorMismatch(res, "トレンドの性格の数が正しくありません")
+	}
+	for _, historyOne := range historyResp {
+		counts, ok := expected[historyOne.Character]
+		if !ok {
+			return errorInvalid(res, "存在しない性格のトレンドが返されました")
+		}
+		if len(historyOne.History) != resolution.Points {
+			return errorInvalid(res, "要素数が正しくありません")
+		}
+		for i, point := range historyOne.History {
+			// 古い順に連続して並んでいることの検証
+			if point.StartAt != startAt+step*int64(i) || point.EndAt != point.StartAt+step {
+				return errorInvalid(res, "トレンドの日付が間違っています")
+			}
+			if point.Info != counts[i][0] || point.Warning != counts[i][1] || point.Critical != counts[i][2] {
+				return errorMismatch(res, "トレンドの件数が正しくありません")
+			}
+		}
+	}
+	return nil
+}
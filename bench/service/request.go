@@ -16,18 +16,61 @@ type JIAServiceRequest struct {
 	IsuUUID       string `json:"isu_uuid"`
 }
 
+type JIADeactivationRequest struct {
+	IsuUUID string `json:"isu_uuid"`
+}
+
 type PostIsuRequest struct {
 	JIAIsuUUID string `json:"jia_isu_uuid"`
 	IsuName    string `json:"isu_name"`
 	Img        []byte
 }
 
+// nil のフィールドは送らない
+type PatchIsuRequest struct {
+	IsuName *string
+	Img     []byte
+}
+
+type PostIsuInvitationRequest struct {
+	JIAUserID string `json:"jia_user_id"`
+	Role      string `json:"role"`
+}
+
 type GetIsuConditionRequest struct {
 	StartTime      *int64
 	EndTime        int64
 	ConditionLevel string
+
+	// カーソルページング用。Cursor を指定したときは StartTime, EndTime, ConditionLevel は送らない
+	Limit  int
+	Cursor string
+}
+
+// 空の値は送らない
+type GetTrendRequest struct {
+	Character      string
+	ConditionLevel string // カンマ区切り
+	Since          *int64
+	Limit          int
+}
+
+func (r GetTrendRequest) Filtered() bool {
+	return r.Character != "" || r.ConditionLevel != "" || r.Since != nil || r.Limit != 0
+}
+
+type GetTrendHistoryRequest struct {
+	Date int64 // unixtime
+
+	// 空のときは送らない (resolution=hour, range=day)
+	Resolution string
+	Range      string
 }
 
 type GetGraphRequest struct {
 	Date int64 // unixtime
+
+	// 空のときは送らない (resolution=hour, range=day)
+	Resolution string
+	Range      string
 }
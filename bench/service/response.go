@@ -6,6 +6,14 @@ type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
+// Accept で application/json を優先したときのエラーレスポンス
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field"`
+	RequestID string `json:"request_id"`
+}
+
 type AuthResponse struct {
 }
 type SignoutResponse struct {
@@ -21,11 +29,30 @@ type Isu struct {
 	Name               string                   `json:"name"`
 	Character          string                   `json:"character"`
 	LatestIsuCondition *GetIsuConditionResponse `json:"latest_isu_condition"`
+	// 非同期で activate するときの状態 (pending, active, failed)。同期で activate する実装では空でもよい
+	ActivationStatus string `json:"activation_status"`
+	ActivationError  string `json:"activation_error"`
 
 	Icon           []byte `json:"-"`
 	IconStatusCode int    //icon取得時のstatus code(200 or 304想定)
 }
 
+type IsuInvitation struct {
+	ID         int64  `json:"id"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	JIAUserID  string `json:"jia_user_id"`
+	Role       string `json:"role"`
+	InvitedBy  string `json:"invited_by"`
+	// GET /api/invitation のみ
+	IsuName string `json:"isu_name"`
+}
+
+type IsuMember struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	JIAUserID  string `json:"jia_user_id"`
+	Role       string `json:"role"`
+}
+
 type GetIsuConditionResponseArray []GetIsuConditionResponse
 
 type GetIsuConditionResponse struct {
@@ -70,6 +97,11 @@ func (c *GetIsuConditionResponseArray) UnmarshalJSONArray(dec *gojay.Decoder) er
 	return nil
 }
 
+type GetIsuConditionPageResponse struct {
+	Conditions GetIsuConditionResponseArray `json:"conditions"`
+	NextCursor *string                      `json:"next_cursor"`
+}
+
 type GraphResponse []*GraphResponseOne
 
 type GraphResponseOne struct {
@@ -102,6 +134,21 @@ type GetTrendResponseOne struct {
 
 type TrendConditions []TrendCondition
 
+type GetTrendHistoryResponse []GetTrendHistoryResponseOne
+
+type GetTrendHistoryResponseOne struct {
+	Character string              `json:"character"`
+	History   []TrendHistoryPoint `json:"history"`
+}
+
+type TrendHistoryPoint struct {
+	StartAt  int64 `json:"start_at"`
+	EndAt    int64 `json:"end_at"`
+	Info     int   `json:"info"`
+	Warning  int   `json:"warning"`
+	Critical int   `json:"critical"`
+}
+
 type TrendCondition struct {
 	IsuID     int   `json:"isu_id"`
 	Timestamp int64 `json:"timestamp"`
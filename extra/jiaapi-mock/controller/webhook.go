@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/// Const Values ///
+
+const (
+	// 保持しておく webhook の件数
+	webhookHistorySize = 100
+)
+
+/// Struct for Req/Resp ///
+
+type ReceivedWebhook struct {
+	ReceivedAt     int64           `json:"received_at"`
+	Delivery       string          `json:"delivery"`
+	Event          string          `json:"event"`
+	Timestamp      string          `json:"timestamp"`
+	Signature      string          `json:"signature"`
+	SignatureValid *bool           `json:"signature_valid"`
+	Body           json.RawMessage `json:"body"`
+}
+
+/// Controller ///
+
+// isucondition のアラートの webhook を受け取って溜めておくシンク
+// ?status=500 のように指定するとそのステータスコードを返すので、再送の確認に使える。
+// ?secret= を指定すると X-Isucondition-Signature を検証し、一致しなければ 401 を返す。
+type WebhookController struct {
+	mu       sync.Mutex
+	received []ReceivedWebhook
+}
+
+func NewWebhookController() *WebhookController {
+	return &WebhookController{received: []ReceivedWebhook{}}
+}
+
+func (c *WebhookController) PostWebhook(ctx echo.Context) error {
+	body, err := ioutil.ReadAll(ctx.Request().Body)
+	if err != nil {
+		ctx.Logger().Errorf("failed to read body: %v", err)
+		return ctx.String(http.StatusBadRequest, "Bad Request")
+	}
+	if !json.Valid(body) {
+		return ctx.String(http.StatusBadRequest, "Bad Request")
+	}
+
+	header := ctx.Request().Header
+	webhook := ReceivedWebhook{
+		ReceivedAt: time.Now().Unix(),
+		Delivery:   header.Get("X-Isucondition-Delivery"),
+		Event:      header.Get("X-Isucondition-Event"),
+		Timestamp:  header.Get("X-Isucondition-Timestamp"),
+		Signature:  header.Get("X-Isucondition-Signature"),
+		Body:       body,
+	}
+	if secret := ctx.QueryParam("secret"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(webhook.Timestamp))
+		mac.Write([]byte("."))
+		mac.Write(body)
+		valid := hmac.Equal([]byte(webhook.Signature), []byte("sha256="+hex.EncodeToString(mac.Sum(nil))))
+		webhook.SignatureValid = &valid
+	}
+
+	c.mu.Lock()
+	c.received = append(c.received, webhook)
+	if len(c.received) > webhookHistorySize {
+		c.received = c.received[len(c.received)-webhookHistorySize:]
+	}
+	c.mu.Unlock()
+
+	if webhook.SignatureValid != nil && !*webhook.SignatureValid {
+		return ctx.String(http.StatusUnauthorized, "Bad Signature")
+	}
+	if statusStr := ctx.QueryParam("status"); statusStr != "" {
+		status, err := strconv.Atoi(statusStr)
+		if err != nil || status < 100 || 600 <= status {
+			return ctx.String(http.StatusBadRequest, "Bad status")
+		}
+		return ctx.NoContent(status)
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+func (c *WebhookController) GetWebhooks(ctx echo.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ctx.JSON(http.StatusOK, c.received)
+}
+
+func (c *WebhookController) DeleteWebhooks(ctx echo.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received = []ReceivedWebhook{}
+	return ctx.NoContent(http.StatusNoContent)
+}
@@ -24,21 +24,33 @@ func main() {
 		panic(err)
 	}
 	activationController := controller.NewActivationController()
+	webhookController := controller.NewWebhookController()
 
 	// Echo instance
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(log.DEBUG)
 
+	traceExporter, err := newTracer(getEnv("TRACE_EXPORT_PATH", ""))
+	if err != nil {
+		panic(err)
+	}
+
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(traceExporter.middleware)
 
 	// 動作確認用のログインページ
 	e.GET("/", func(ctx echo.Context) error { return ctx.Blob(200, "text/html; charset=utf-8", htmlTopPage) })
 	// APIs
 	e.POST("/api/auth", authController.PostAuth)
 	e.POST("/api/activate", activationController.PostActivate)
+	e.POST("/api/deactivate", activationController.PostDeactivate)
+	// isucondition のアラートの webhook の受け口
+	e.POST("/api/webhook", webhookController.PostWebhook)
+	e.GET("/api/webhook", webhookController.GetWebhooks)
+	e.DELETE("/api/webhook", webhookController.DeleteWebhooks)
 
 	// Start server
 	serverPort := fmt.Sprintf(":%v", getEnv("JIAAPI_SERVER_PORT", "5000"))
@@ -3,12 +3,17 @@ package model
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"time"
 
 	"github.com/labstack/gommon/log"
@@ -20,6 +25,9 @@ type IsuConditionPoster struct {
 	TargetURL url.URL
 	IsuUUID   string
 
+	// POST /api/condition の署名に使う
+	secret string
+
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 }
@@ -31,9 +39,27 @@ type IsuConditionRequest struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
-func NewIsuConditionPoster(targetURL *url.URL, isuUUID string) IsuConditionPoster {
+func NewIsuConditionPoster(targetURL *url.URL, isuUUID string, secret string) IsuConditionPoster {
 	ctx, cancel := context.WithCancel(context.Background())
-	return IsuConditionPoster{*targetURL, isuUUID, ctx, cancel}
+	return IsuConditionPoster{*targetURL, isuUUID, secret, ctx, cancel}
+}
+
+func generateConditionSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := crand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// "<X-Isucondition-Timestamp>.<body>" の HMAC-SHA256
+func signConditions(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func (m *IsuConditionPoster) KeepPosting() {
@@ -87,6 +113,9 @@ func (m *IsuConditionPoster) KeepPosting() {
 			}
 			httpReq.Header.Set("Content-Type", "application/json")
 			httpReq.Header.Set("User-Agent", "JIA-Members-Client-MOCK/1.0")
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			httpReq.Header.Set("X-Isucondition-Timestamp", timestamp)
+			httpReq.Header.Set("X-Isucondition-Signature", "sha256="+signConditions(m.secret, timestamp, conditionsJSON))
 			resp, err := http.DefaultClient.Do(httpReq)
 			if err != nil {
 				log.Error(err)
@@ -15,19 +15,29 @@ func NewIsuConditionPosterManager() *IsuConditionPosterManager {
 	return &IsuConditionPosterManager{activatedIsu, sync.Mutex{}}
 }
 
-func (m *IsuConditionPosterManager) StartPosting(targetURL *url.URL, isuUUID string) error {
-	conflict := func() bool {
-		m.activatedIsuMtx.Lock()
-		defer m.activatedIsuMtx.Unlock()
-		if _, ok := m.activatedIsu[isuUUID]; ok {
-			return true
-		}
-		m.activatedIsu[isuUUID] = NewIsuConditionPoster(targetURL, isuUUID)
-		return false
-	}()
-	if !conflict {
-		isu := m.activatedIsu[isuUUID]
-		go isu.KeepPosting()
+// コンディションの署名に使う secret を返す。activate 済みの場合は既存の secret を返す
+func (m *IsuConditionPosterManager) StartPosting(targetURL *url.URL, isuUUID string) (string, error) {
+	m.activatedIsuMtx.Lock()
+	defer m.activatedIsuMtx.Unlock()
+	if isu, ok := m.activatedIsu[isuUUID]; ok {
+		return isu.secret, nil
+	}
+
+	secret, err := generateConditionSecret()
+	if err != nil {
+		return "", err
+	}
+	isu := NewIsuConditionPoster(targetURL, isuUUID, secret)
+	m.activatedIsu[isuUUID] = isu
+	go isu.KeepPosting()
+	return secret, nil
+}
+
+func (m *IsuConditionPosterManager) StopPosting(isuUUID string) {
+	m.activatedIsuMtx.Lock()
+	defer m.activatedIsuMtx.Unlock()
+	if isu, ok := m.activatedIsu[isuUUID]; ok {
+		isu.cancelFunc()
+		delete(m.activatedIsu, isuUUID)
 	}
-	return nil
 }
@@ -0,0 +1,125 @@
+package main
+
+// リクエストのトレース
+// isucondition から traceparent ヘッダーで引き継いだトレースに server の span を加え、
+// TRACE_EXPORT_PATH のファイルに一行一つの JSON で書き出す。TRACE_EXPORT_PATH が空ならトレースしない。
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const traceServiceName = "jiaapi-mock"
+
+type span struct {
+	TraceID        string                 `json:"trace_id"`
+	SpanID         string                 `json:"span_id"`
+	ParentSpanID   string                 `json:"parent_span_id,omitempty"`
+	Service        string                 `json:"service"`
+	Name           string                 `json:"name"`
+	Kind           string                 `json:"kind"`
+	StartTime      time.Time              `json:"start_time"`
+	EndTime        time.Time              `json:"end_time"`
+	DurationMicros int64                  `json:"duration_us"`
+	Attributes     map[string]interface{} `json:"attributes,omitempty"`
+	Status         string                 `json:"status"`
+}
+
+type tracer struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newTracer(path string) (*tracer, error) {
+	if path == "" {
+		return &tracer{}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tracer{file: file}, nil
+}
+
+func (t *tracer) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if t.file == nil {
+			return next(c)
+		}
+		req := c.Request()
+		traceID, parentSpanID, sampled, ok := parseTraceparent(req.Header.Get("traceparent"))
+		if !ok {
+			traceID, parentSpanID = randomHexID(16), ""
+		} else if !sampled {
+			return next(c)
+		}
+
+		s := &span{
+			TraceID:      traceID,
+			SpanID:       randomHexID(8),
+			ParentSpanID: parentSpanID,
+			Service:      traceServiceName,
+			Name:         req.Method + " " + c.Path(),
+			Kind:         "server",
+			StartTime:    time.Now(),
+			Attributes: map[string]interface{}{
+				"http.method": req.Method,
+				"http.route":  c.Path(),
+			},
+			Status: "ok",
+		}
+		err := next(c)
+		if err != nil {
+			// レスポンスを書いてからステータスコードを記録する
+			c.Error(err)
+		}
+		s.EndTime = time.Now()
+		s.DurationMicros = s.EndTime.Sub(s.StartTime).Microseconds()
+		s.Attributes["http.status_code"] = c.Response().Status
+		if c.Response().Status >= http.StatusInternalServerError {
+			s.Status = "error"
+		}
+		t.export(s)
+		return nil
+	}
+}
+
+func (t *tracer) export(s *span) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file.Write(append(b, '\n'))
+}
+
+// "00-<trace-id>-<parent-id>-<trace-flags>"
+func parseTraceparent(traceparent string) (string, string, bool, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return "", "", false, false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false, false
+	}
+	return strings.ToLower(parts[1]), strings.ToLower(parts[2]), flags[0]&0x01 != 0, true
+}
+
+func randomHexID(byteLen int) string {
+	b := make([]byte, byteLen)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,220 @@
+package main
+
+// ISU の非同期の activate
+// ISU_ACTIVATION_MODE=async のとき、POST /api/isu は ISU を pending として登録して 202 を返し、
+// JIA のサービスでの activate はワーカーが行う。状態は isu_activation に持ち、activate できたら行を消す。
+// JIA が 4xx を返したら再試行せずに failed とし、それ以外の失敗は間隔を空けて isuActivationMaxAttempts 回まで試す。
+// クライアントは GET /api/isu/:jia_isu_uuid の activation_status (pending, active, failed) で結果を知る。
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	isuActivationModeSync  = "sync"
+	isuActivationModeAsync = "async"
+
+	isuActivationStatusPending = "pending"
+	isuActivationStatusActive  = "active"
+	isuActivationStatusFailed  = "failed"
+
+	isuActivationQueueSize         = 1000
+	isuActivationWorkerNum         = 4
+	isuActivationMaxAttempts       = 5
+	isuActivationRetryBaseInterval = 1 * time.Second
+	isuActivationRetryMaxInterval  = 30 * time.Second
+	isuActivationReasonLimit       = 255
+)
+
+type IsuActivation struct {
+	JIAIsuUUID string `db:"jia_isu_uuid"`
+	JIAUserID  string `db:"jia_user_id"`
+	Status     string `db:"status"`
+	Reason     string `db:"reason"`
+	Attempts   int    `db:"attempts"`
+}
+
+type isuActivationJob struct {
+	activation IsuActivation
+	generation uint64
+	// 登録したリクエストのトレースを引き継ぐ
+	traceparent string
+}
+
+type IsuActivator struct {
+	async      bool
+	jobs       chan *isuActivationJob
+	generation uint64
+}
+
+func NewIsuActivator(async bool) *IsuActivator {
+	return &IsuActivator{
+		async: async,
+		jobs:  make(chan *isuActivationJob, isuActivationQueueSize),
+	}
+}
+
+func NewIsuActivatorFromEnv() (*IsuActivator, error) {
+	var async bool
+	switch mode := getEnv("ISU_ACTIVATION_MODE", isuActivationModeSync); mode {
+	case isuActivationModeSync:
+	case isuActivationModeAsync:
+		async = true
+	default:
+		return nil, fmt.Errorf("bad format: ISU_ACTIVATION_MODE: %v", mode)
+	}
+	return NewIsuActivator(async), nil
+}
+
+// POST /api/isu が activate を待たずに返すなら true
+func (a *IsuActivator) Async() bool {
+	return a.async
+}
+
+// ワーカーを起動し、再起動前に pending のまま残った ISU の activate をやり直す
+func (a *IsuActivator) Start() error {
+	for i := 0; i < isuActivationWorkerNum; i++ {
+		go a.runWorker()
+	}
+
+	activations, err := repo.GetPendingIsuActivations()
+	if err != nil {
+		return err
+	}
+	for _, activation := range activations {
+		err = a.Enqueue(context.Background(), activation.JIAUserID, activation.JIAIsuUUID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 処理待ちと再試行待ちの activate を全て破棄する
+func (a *IsuActivator) Reset() {
+	atomic.AddUint64(&a.generation, 1)
+}
+
+// pending として登録した ISU の activate をキューに積む。キューが一杯のときは failed として記録する
+func (a *IsuActivator) Enqueue(ctx context.Context, jiaUserID string, jiaIsuUUID string) error {
+	job := &isuActivationJob{
+		activation: IsuActivation{
+			JIAIsuUUID: jiaIsuUUID,
+			JIAUserID:  jiaUserID,
+			Status:     isuActivationStatusPending,
+		},
+		generation:  atomic.LoadUint64(&a.generation),
+		traceparent: traceparentFromContext(ctx),
+	}
+
+	select {
+	case a.jobs <- job:
+		return nil
+	default:
+	}
+
+	job.activation.Status = isuActivationStatusFailed
+	job.activation.Reason = "activation queue is full"
+	return repo.WithContext(ctx).UpdateIsuActivation(job.activation)
+}
+
+func (a *IsuActivator) runWorker() {
+	for job := range a.jobs {
+		if job.generation != atomic.LoadUint64(&a.generation) {
+			continue
+		}
+		a.activate(job)
+	}
+}
+
+// JIA のサービスで activate し、性格と secret を記録する。失敗したら間隔を空けて再試行する
+func (a *IsuActivator) activate(job *isuActivationJob) {
+	job.activation.Attempts++
+	jiaIsuUUID := job.activation.JIAIsuUUID
+
+	ctx := context.Background()
+	if job.traceparent != "" {
+		ctx, _ = tracer.contextWithTraceparent(ctx, job.traceparent)
+	}
+	jiaServiceURL := getJIAServiceURL(ctx)
+	ctx, span := startSpan(ctx, "isu.activate", spanKindInternal)
+	span.SetAttribute("isu.jia_isu_uuid", jiaIsuUUID)
+	span.SetAttribute("isu.activation_attempt", job.activation.Attempts)
+	defer func() {
+		span.SetAttribute("isu.activation_status", job.activation.Status)
+		span.End(nil)
+	}()
+	tracedRepo := repo.WithContext(ctx)
+
+	isuFromJIA, err := jiaClient.Activate(ctx, jiaServiceURL, postIsuConditionTargetBaseURL, jiaIsuUUID)
+	if err == nil {
+		_, err = tracedRepo.ActivateIsu(job.activation.JIAUserID, jiaIsuUUID, isuFromJIA)
+		if err == nil {
+			job.activation.Status = isuActivationStatusActive
+			return
+		}
+		// activate を待つ間に削除された ISU や記録できなかった ISU は、コンディションが送られてこないよう deactivate する
+		if deactivateErr := jiaClient.Deactivate(ctx, jiaServiceURL, jiaIsuUUID); deactivateErr != nil {
+			log.Errorf("failed to deactivate isu %v: %v", jiaIsuUUID, deactivateErr)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		log.Errorf("failed to activate isu %v: %v", jiaIsuUUID, err)
+		job.activation.Status = isuActivationStatusFailed
+		job.activation.Reason = "failed to save activation"
+	} else {
+		job.activation.Reason = truncateString(err.Error(), isuActivationReasonLimit)
+		var jiaErr *JIAServiceError
+		if (errors.As(err, &jiaErr) && jiaErr.StatusCode < http.StatusInternalServerError) ||
+			job.activation.Attempts >= isuActivationMaxAttempts {
+			job.activation.Status = isuActivationStatusFailed
+		} else {
+			interval := isuActivationRetryInterval(job.activation.Attempts)
+			if retryAfter := time.Duration(jiaClient.retryAfterSeconds()) * time.Second; retryAfter > interval {
+				interval = retryAfter
+			}
+			time.AfterFunc(interval, func() { a.retry(job) })
+		}
+	}
+
+	err = tracedRepo.UpdateIsuActivation(job.activation)
+	if err != nil {
+		log.Errorf("failed to update isu activation: %v", err)
+	}
+}
+
+// 再試行の activate をキューに積む。キューが一杯のときは failed として記録する
+func (a *IsuActivator) retry(job *isuActivationJob) {
+	if job.generation != atomic.LoadUint64(&a.generation) {
+		return
+	}
+	select {
+	case a.jobs <- job:
+		return
+	default:
+	}
+
+	job.activation.Status = isuActivationStatusFailed
+	job.activation.Reason = "activation queue is full"
+	err := repo.UpdateIsuActivation(job.activation)
+	if err != nil {
+		log.Errorf("failed to update isu activation: %v", err)
+	}
+}
+
+func isuActivationRetryInterval(attempts int) time.Duration {
+	interval := isuActivationRetryBaseInterval << uint(attempts-1)
+	if interval <= 0 || interval > isuActivationRetryMaxInterval {
+		return isuActivationRetryMaxInterval
+	}
+	return interval
+}
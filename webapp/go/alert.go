@@ -0,0 +1,582 @@
+package main
+
+// アラートルールの評価と webhook の配信
+// POST /api/condition/:jia_isu_uuid で受け付けたコンディションを書き込みキューが書き込んだ後にバックグラウンドでルールに照らし、
+// コンディションレベルが閾値以上の状態が sustained_seconds 続いたら alert.triggered を、
+// その後閾値を下回ったら alert.resolved を webhook_url に送る。
+// 評価の途中状態はメモリ上にだけ持つので、再起動すると継続時間の計測はやり直しになる。
+// webhook_url にはループバック、リンクローカル、プライベートのアドレスを指定できない。ルールの保存時と配信時の接続先の両方で確かめる。
+// ALERT_WEBHOOK_ALLOWED_HOSTS (カンマ区切りのホスト名) に含まれるホストは確かめない。
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	alertEventTriggered = "alert.triggered"
+	alertEventResolved  = "alert.resolved"
+
+	alertDeliveryStatusPending   = "pending"
+	alertDeliveryStatusSucceeded = "succeeded"
+	alertDeliveryStatusFailed    = "failed"
+
+	alertEvaluationQueueSize    = 10000
+	alertDeliveryQueueSize      = 1000
+	alertDeliveryWorkerNum      = 4
+	alertDeliveryTimeout        = 5 * time.Second
+	alertDeliveryMaxAttempts    = 6
+	alertRetryBaseInterval      = 1 * time.Second
+	alertRetryMaxInterval       = 60 * time.Second
+	alertDeliveryLastErrorLimit = 255
+	alertDeliveryListLimit      = 100
+	alertSecretBytes            = 32
+)
+
+var errAlertWebhookHostNotAllowed = errors.New("webhook host is not allowed")
+
+// webhook を送らないアドレス
+var alertBlockedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// 閾値の比較に使うコンディションレベルの順序
+var conditionLevelRank = map[string]int{
+	conditionLevelInfo:     0,
+	conditionLevelWarning:  1,
+	conditionLevelCritical: 2,
+}
+
+type AlertRule struct {
+	ID               int64     `db:"id" json:"id"`
+	JIAUserID        string    `db:"jia_user_id" json:"-"`
+	JIAIsuUUID       *string   `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Character        *string   `db:"character" json:"character"`
+	ConditionLevel   string    `db:"condition_level" json:"condition_level"`
+	SustainedSeconds int64     `db:"sustained_seconds" json:"sustained_seconds"`
+	WebhookURL       string    `db:"webhook_url" json:"webhook_url"`
+	Secret           string    `db:"secret" json:"secret"`
+	CreatedAt        time.Time `db:"created_at" json:"-"`
+	UpdatedAt        time.Time `db:"updated_at" json:"-"`
+}
+
+type AlertDelivery struct {
+	ID             int64     `db:"id"`
+	AlertRuleID    int64     `db:"alert_rule_id"`
+	JIAIsuUUID     string    `db:"jia_isu_uuid"`
+	Event          string    `db:"event"`
+	Payload        string    `db:"payload"`
+	Status         string    `db:"status"`
+	Attempts       int       `db:"attempts"`
+	ResponseStatus int       `db:"response_status"`
+	LastError      string    `db:"last_error"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+type AlertWebhookPayload struct {
+	Event          string `json:"event"`
+	AlertID        int64  `json:"alert_id"`
+	JIAIsuUUID     string `json:"jia_isu_uuid"`
+	ConditionLevel string `json:"condition_level"`
+	// 閾値以上になったコンディションの timestamp
+	Since     int64  `json:"since"`
+	Timestamp int64  `json:"timestamp"`
+	IsSitting bool   `json:"is_sitting"`
+	Condition string `json:"condition"`
+	Message   string `json:"message"`
+}
+
+type alertStateKey struct {
+	alertID    int64
+	jiaIsuUUID string
+}
+
+type alertState struct {
+	lastTimestamp int64
+	breaching     bool
+	since         int64
+	fired         bool
+}
+
+type alertEvaluation struct {
+	jiaIsuUUID string
+	conditions []PostIsuConditionRequest
+	generation uint64
+	// コンディションを受け付けたリクエストのトレースを引き継ぐ
+	traceparent string
+}
+
+type alertDeliveryJob struct {
+	delivery   AlertDelivery
+	webhookURL string
+	secret     string
+	generation uint64
+	// 評価したときのトレースを引き継ぐ
+	traceparent string
+}
+
+type AlertManager struct {
+	client       *http.Client
+	allowedHosts map[string]struct{}
+	evaluations  chan *alertEvaluation
+	jobs         chan *alertDeliveryJob
+	generation   uint64
+	ruleCount    int64
+
+	mu     sync.Mutex
+	states map[alertStateKey]*alertState
+}
+
+func NewAlertManager(allowedWebhookHosts []string) *AlertManager {
+	m := &AlertManager{
+		allowedHosts: map[string]struct{}{},
+		evaluations:  make(chan *alertEvaluation, alertEvaluationQueueSize),
+		jobs:         make(chan *alertDeliveryJob, alertDeliveryQueueSize),
+		states:       map[alertStateKey]*alertState{},
+	}
+	for _, host := range allowedWebhookHosts {
+		if host = strings.TrimSpace(host); host != "" {
+			m.allowedHosts[strings.ToLower(host)] = struct{}{}
+		}
+	}
+
+	// 名前解決の後の接続先を確かめるので、リダイレクト先や DNS の応答が変わった場合も送らない
+	dialer := &net.Dialer{Timeout: alertDeliveryTimeout}
+	guardedDialer := &net.Dialer{
+		Timeout: alertDeliveryTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlockedWebhookIP(ip) {
+				return errAlertWebhookHostNotAllowed
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil && m.webhookHostAllowed(host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guardedDialer.DialContext(ctx, network, address)
+	}
+	m.client = &http.Client{Timeout: alertDeliveryTimeout, Transport: transport}
+	return m
+}
+
+func NewAlertManagerFromEnv() *AlertManager {
+	return NewAlertManager(strings.Split(getEnv("ALERT_WEBHOOK_ALLOWED_HOSTS", ""), ","))
+}
+
+// webhook_url のホストが送り先として許されるか確かめる。ホスト名は名前解決した全てのアドレスを確かめる
+func (m *AlertManager) ValidateWebhookHost(ctx context.Context, host string) error {
+	if m.webhookHostAllowed(host) {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if isBlockedWebhookIP(ip) {
+			return errAlertWebhookHostNotAllowed
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, alertDeliveryTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isBlockedWebhookIP(addr.IP) {
+			return errAlertWebhookHostNotAllowed
+		}
+	}
+	return nil
+}
+
+func (m *AlertManager) webhookHostAllowed(host string) bool {
+	_, ok := m.allowedHosts[strings.ToLower(host)]
+	return ok
+}
+
+func isBlockedWebhookIP(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, network := range alertBlockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// ルールの評価と webhook の配信を開始する。評価は ISU 毎の順序を保つため一つの goroutine で行う
+func (m *AlertManager) Start() {
+	go m.runEvaluator()
+	for i := 0; i < alertDeliveryWorkerNum; i++ {
+		go m.runWorker()
+	}
+}
+
+// 書き込みキューが書き込んだコンディションの評価を積む。評価待ちが一杯のときは評価せずに捨てる
+func (m *AlertManager) Submit(jiaIsuUUID string, conditions []PostIsuConditionRequest, traceparent string) {
+	if atomic.LoadInt64(&m.ruleCount) == 0 {
+		return
+	}
+	evaluation := &alertEvaluation{
+		jiaIsuUUID:  jiaIsuUUID,
+		conditions:  conditions,
+		generation:  atomic.LoadUint64(&m.generation),
+		traceparent: traceparent,
+	}
+	select {
+	case m.evaluations <- evaluation:
+	default:
+		log.Errorf("drop alert evaluation: jia_isu_uuid=%v, count=%v: alert evaluation queue is full", jiaIsuUUID, len(conditions))
+	}
+}
+
+func (m *AlertManager) runEvaluator() {
+	for evaluation := range m.evaluations {
+		if evaluation.generation != atomic.LoadUint64(&m.generation) {
+			continue
+		}
+		ctx, span := startSpan(contextFromTraceparent(evaluation.traceparent), "alert.evaluate", spanKindInternal)
+		span.SetAttribute("isu.jia_isu_uuid", evaluation.jiaIsuUUID)
+		err := m.evaluate(ctx, evaluation.jiaIsuUUID, evaluation.conditions)
+		if err != nil {
+			log.Errorf("failed to evaluate alert rules: %v", err)
+		}
+		span.End(err)
+	}
+}
+
+// ルールが一件もなければ書き込んだコンディションの評価を省くため、件数を読み直す
+func (m *AlertManager) RefreshRuleCount(ctx context.Context) error {
+	count, err := repo.WithContext(ctx).CountAlertRules()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&m.ruleCount, int64(count))
+	return nil
+}
+
+// ルールの変更後に評価の途中状態を捨てる
+func (m *AlertManager) Forget(alertID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.states {
+		if key.alertID == alertID {
+			delete(m.states, key)
+		}
+	}
+}
+
+// ISU の削除後に評価の途中状態を捨てる
+func (m *AlertManager) ForgetIsu(jiaIsuUUID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.states {
+		if key.jiaIsuUUID == jiaIsuUUID {
+			delete(m.states, key)
+		}
+	}
+}
+
+// 評価の途中状態と評価待ちのコンディションと配信待ちの webhook を全て破棄する
+func (m *AlertManager) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	atomic.AddUint64(&m.generation, 1)
+	atomic.StoreInt64(&m.ruleCount, 0)
+	m.states = map[alertStateKey]*alertState{}
+}
+
+// ISU のコンディションをルールに照らし、発火したものを配信キューに積む
+func (m *AlertManager) evaluate(ctx context.Context, jiaIsuUUID string, conditions []PostIsuConditionRequest) error {
+	if atomic.LoadInt64(&m.ruleCount) == 0 {
+		return nil
+	}
+	rules, err := repo.WithContext(ctx).GetAlertRulesByIsu(jiaIsuUUID)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	sorted := make([]PostIsuConditionRequest, len(conditions))
+	copy(sorted, conditions)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp < sorted[j].Timestamp })
+
+	jobs := []*alertDeliveryJob{}
+	m.mu.Lock()
+	for _, rule := range rules {
+		key := alertStateKey{alertID: rule.ID, jiaIsuUUID: jiaIsuUUID}
+		state, ok := m.states[key]
+		if !ok {
+			state = &alertState{}
+			m.states[key] = state
+		}
+
+		for _, cond := range sorted {
+			// 既に評価した時刻より古いコンディションは状態を巻き戻せないので無視する
+			if cond.Timestamp < state.lastTimestamp {
+				continue
+			}
+			state.lastTimestamp = cond.Timestamp
+
+			level, err := conditionSchema.Level(cond.Condition)
+			if err != nil {
+				continue
+			}
+
+			if conditionLevelRank[level] >= conditionLevelRank[rule.ConditionLevel] {
+				if !state.breaching {
+					state.breaching = true
+					state.since = cond.Timestamp
+				}
+				if !state.fired && cond.Timestamp-state.since >= rule.SustainedSeconds {
+					state.fired = true
+					jobs = append(jobs, newAlertDeliveryJob(rule, jiaIsuUUID, alertEventTriggered, level, state.since, cond))
+				}
+				continue
+			}
+
+			if state.fired {
+				jobs = append(jobs, newAlertDeliveryJob(rule, jiaIsuUUID, alertEventResolved, level, state.since, cond))
+			}
+			*state = alertState{lastTimestamp: cond.Timestamp}
+		}
+	}
+	m.mu.Unlock()
+
+	generation := atomic.LoadUint64(&m.generation)
+	traceparent := traceparentFromContext(ctx)
+	for _, job := range jobs {
+		job.generation = generation
+		job.traceparent = traceparent
+		err := m.dispatch(ctx, job)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAlertDeliveryJob(rule AlertRule, jiaIsuUUID string, event string, level string, since int64, cond PostIsuConditionRequest) *alertDeliveryJob {
+	payload, _ := json.Marshal(AlertWebhookPayload{
+		Event:          event,
+		AlertID:        rule.ID,
+		JIAIsuUUID:     jiaIsuUUID,
+		ConditionLevel: level,
+		Since:          since,
+		Timestamp:      cond.Timestamp,
+		IsSitting:      cond.IsSitting,
+		Condition:      cond.Condition,
+		Message:        cond.Message,
+	})
+	return &alertDeliveryJob{
+		delivery: AlertDelivery{
+			AlertRuleID: rule.ID,
+			JIAIsuUUID:  jiaIsuUUID,
+			Event:       event,
+			Payload:     string(payload),
+			Status:      alertDeliveryStatusPending,
+		},
+		webhookURL: rule.WebhookURL,
+		secret:     rule.Secret,
+	}
+}
+
+// 配信ログを作ってキューに積む。キューが一杯のときは配信せずに failed として記録する
+func (m *AlertManager) dispatch(ctx context.Context, job *alertDeliveryJob) error {
+	tracedRepo := repo.WithContext(ctx)
+	id, err := tracedRepo.CreateAlertDelivery(job.delivery)
+	if err != nil {
+		return err
+	}
+	job.delivery.ID = id
+
+	select {
+	case m.jobs <- job:
+		return nil
+	default:
+	}
+
+	job.delivery.Status = alertDeliveryStatusFailed
+	job.delivery.LastError = "delivery queue is full"
+	return tracedRepo.UpdateAlertDelivery(job.delivery)
+}
+
+func (m *AlertManager) runWorker() {
+	for job := range m.jobs {
+		if job.generation != atomic.LoadUint64(&m.generation) {
+			continue
+		}
+		m.deliver(job)
+	}
+}
+
+// webhook を一度送り、失敗したら指数的に間隔を空けて再送する
+func (m *AlertManager) deliver(job *alertDeliveryJob) {
+	job.delivery.Attempts++
+	ctx, span := startSpan(contextFromTraceparent(job.traceparent), "alert.deliver", spanKindInternal)
+	span.SetAttribute("alert.delivery_id", job.delivery.ID)
+	span.SetAttribute("alert.delivery_attempt", job.delivery.Attempts)
+	defer func() {
+		span.SetAttribute("alert.delivery_status", job.delivery.Status)
+		span.End(nil)
+	}()
+
+	statusCode, err := m.post(job)
+	job.delivery.ResponseStatus = statusCode
+	switch {
+	case err == nil:
+		job.delivery.Status = alertDeliveryStatusSucceeded
+		job.delivery.LastError = ""
+	case job.delivery.Attempts >= alertDeliveryMaxAttempts:
+		job.delivery.Status = alertDeliveryStatusFailed
+		job.delivery.LastError = truncateString(err.Error(), alertDeliveryLastErrorLimit)
+	default:
+		job.delivery.LastError = truncateString(err.Error(), alertDeliveryLastErrorLimit)
+		time.AfterFunc(alertRetryInterval(job.delivery.Attempts), func() { m.retry(job) })
+	}
+
+	err = repo.WithContext(ctx).UpdateAlertDelivery(job.delivery)
+	if err != nil {
+		log.Errorf("failed to update alert delivery: %v", err)
+	}
+}
+
+// 再送をキューに積む。キューが一杯のときは再送せずに failed として記録する
+func (m *AlertManager) retry(job *alertDeliveryJob) {
+	if job.generation != atomic.LoadUint64(&m.generation) {
+		return
+	}
+	select {
+	case m.jobs <- job:
+		return
+	default:
+	}
+
+	job.delivery.Status = alertDeliveryStatusFailed
+	job.delivery.LastError = "delivery queue is full"
+	err := repo.WithContext(contextFromTraceparent(job.traceparent)).UpdateAlertDelivery(job.delivery)
+	if err != nil {
+		log.Errorf("failed to update alert delivery: %v", err)
+	}
+}
+
+func (m *AlertManager) post(job *alertDeliveryJob) (int, error) {
+	body := []byte(job.delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, job.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isucondition-Delivery", strconv.FormatInt(job.delivery.ID, 10))
+	req.Header.Set("X-Isucondition-Event", job.delivery.Event)
+	req.Header.Set("X-Isucondition-Timestamp", timestamp)
+	req.Header.Set("X-Isucondition-Signature", "sha256="+signTimestampedBody(job.secret, timestamp, body))
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || 300 <= res.StatusCode {
+		return res.StatusCode, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// "<X-Isucondition-Timestamp>.<body>" の HMAC-SHA256
+func signTimestampedBody(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func alertRetryInterval(attempts int) time.Duration {
+	interval := alertRetryBaseInterval << uint(attempts-1)
+	if interval <= 0 || interval > alertRetryMaxInterval {
+		return alertRetryMaxInterval
+	}
+	return interval
+}
+
+func generateAlertSecret() (string, error) {
+	b := make([]byte, alertSecretBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// s を limit バイト以下に切り詰める。UTF-8 の文字の途中では切らない
+func truncateString(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
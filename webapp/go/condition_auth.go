@@ -0,0 +1,48 @@
+package main
+
+// POST /api/condition/:jia_isu_uuid の署名の検証
+// ISU は activate 時に JIA から払い出された secret で、アラートの webhook と同じく
+// "<X-Isucondition-Timestamp>.<body>" の HMAC-SHA256 を X-Isucondition-Signature に付けて送る。
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	conditionSignaturePrefix = "sha256="
+	// X-Isucondition-Timestamp と受信時刻のずれの許容範囲
+	conditionSignatureTolerance = 5 * time.Minute
+)
+
+var errBadConditionSignature = errors.New("bad signature")
+
+func verifyConditionSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	if secret == "" {
+		return errBadConditionSignature
+	}
+
+	timestampStr := header.Get("X-Isucondition-Timestamp")
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return errBadConditionSignature
+	}
+	diff := now.Sub(time.Unix(timestamp, 0))
+	if diff < -conditionSignatureTolerance || conditionSignatureTolerance < diff {
+		return errBadConditionSignature
+	}
+
+	signature := header.Get("X-Isucondition-Signature")
+	if !strings.HasPrefix(signature, conditionSignaturePrefix) {
+		return errBadConditionSignature
+	}
+	expected := signTimestampedBody(secret, timestampStr, body)
+	if !hmac.Equal([]byte(signature[len(conditionSignaturePrefix):]), []byte(expected)) {
+		return errBadConditionSignature
+	}
+	return nil
+}
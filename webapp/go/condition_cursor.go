@@ -0,0 +1,52 @@
+package main
+
+// GET /api/condition/:jia_isu_uuid のページング用カーソル
+// クライアントには base64 でエンコードした不透明な文字列として渡す。
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	conditionMaxLimit = 100
+)
+
+type ConditionCursor struct {
+	// この (timestamp, id) より古いコンディションを返す。EndID が 0 のときは timestamp のみで比較する
+	EndTime        int64    `json:"end_time"`
+	EndID          int      `json:"end_id,omitempty"`
+	ConditionLevel []string `json:"condition_level"`
+	StartTime      int64    `json:"start_time,omitempty"`
+	Limit          int      `json:"limit"`
+}
+
+type GetIsuConditionPageResponse struct {
+	Conditions []*GetIsuConditionResponse `json:"conditions"`
+	NextCursor *string                    `json:"next_cursor"`
+}
+
+func (cur ConditionCursor) Encode() (string, error) {
+	b, err := json.Marshal(cur)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeConditionCursor(str string) (ConditionCursor, error) {
+	var cur ConditionCursor
+	b, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(b, &cur)
+	if err != nil {
+		return cur, err
+	}
+	if len(cur.ConditionLevel) == 0 || cur.Limit < 1 || conditionMaxLimit < cur.Limit {
+		return cur, fmt.Errorf("invalid cursor")
+	}
+	return cur, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+// 新しく受け付けたコンディションのプロセス内 pub/sub
+// POST /api/condition/:jia_isu_uuid が Publish し、GET /api/condition/:jia_isu_uuid/stream が Subscribe する。
+
+import (
+	"sync"
+)
+
+const conditionSubscriberBufferSize = 100
+
+type ConditionHub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*ConditionSubscriber]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type ConditionSubscriber struct {
+	C <-chan PostIsuConditionRequest
+	// 受信が追いつかずにコンディションを取りこぼしたときに close される
+	Overflow <-chan struct{}
+
+	ch           chan PostIsuConditionRequest
+	overflow     chan struct{}
+	overflowOnce sync.Once
+}
+
+func NewConditionHub() *ConditionHub {
+	return &ConditionHub{
+		subscribers: map[string]map[*ConditionSubscriber]struct{}{},
+		done:        make(chan struct{}),
+	}
+}
+
+func (h *ConditionHub) Subscribe(jiaIsuUUID string) *ConditionSubscriber {
+	ch := make(chan PostIsuConditionRequest, conditionSubscriberBufferSize)
+	overflow := make(chan struct{})
+	sub := &ConditionSubscriber{C: ch, Overflow: overflow, ch: ch, overflow: overflow}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[jiaIsuUUID]; !ok {
+		h.subscribers[jiaIsuUUID] = map[*ConditionSubscriber]struct{}{}
+	}
+	h.subscribers[jiaIsuUUID][sub] = struct{}{}
+	return sub
+}
+
+func (h *ConditionHub) Unsubscribe(jiaIsuUUID string, sub *ConditionSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[jiaIsuUUID], sub)
+	if len(h.subscribers[jiaIsuUUID]) == 0 {
+		delete(h.subscribers, jiaIsuUUID)
+	}
+}
+
+// 購読者に配信する。バッファが一杯の購読者には Overflow で知らせて以降は配信しない
+func (h *ConditionHub) Publish(jiaIsuUUID string, conditions []PostIsuConditionRequest) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers[jiaIsuUUID] {
+	send:
+		for _, cond := range conditions {
+			select {
+			case <-sub.overflow:
+				break send
+			case sub.ch <- cond:
+			default:
+				sub.overflowOnce.Do(func() { close(sub.overflow) })
+				break send
+			}
+		}
+	}
+}
+
+// サーバーの停止時に購読者に終了を知らせる。クライアントは別のプロセスに Last-Event-ID で再接続する
+func (h *ConditionHub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+func (h *ConditionHub) Done() <-chan struct{} {
+	return h.done
+}
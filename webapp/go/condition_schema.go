@@ -0,0 +1,216 @@
+package main
+
+// ISUのコンディションの文字列 (is_dirty=true,is_overweight=false,is_broken=false) のスキーマ
+// キーとその重み、warning と critical の閾値を CONDITION_SCHEMA_PATH の JSON から読み込む。
+// 値が true のキーの重みの合計が閾値以上になるとコンディションレベルが上がり、グラフのスコアはレベルから決まる。
+// 指定しなければ従来通り is_dirty, is_overweight, is_broken の3つで、1つ以上 true なら warning、3つとも true なら critical。
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	conditionValueTrue  = "true"
+	conditionValueFalse = "false"
+	// グラフの割合で is_sitting に使うキー
+	conditionPercentageSitting = "sitting"
+)
+
+var (
+	conditionKeyNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+	// 既定のスキーマのグラフの割合のキーの順。struct だった頃のレスポンスと同じにする
+	defaultConditionPercentageKeys = []string{"is_broken", "is_dirty", "is_overweight"}
+
+	defaultConditionSchema = ConditionSchema{
+		Keys: []ConditionKey{
+			{Name: "is_dirty", Weight: 1},
+			{Name: "is_overweight", Weight: 1},
+			{Name: "is_broken", Weight: 1},
+		},
+		WarningThreshold:  1,
+		CriticalThreshold: 3,
+	}
+)
+
+type ConditionKey struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+type ConditionSchema struct {
+	// コンディションの文字列にはこの順で並ぶ
+	Keys              []ConditionKey `json:"keys"`
+	WarningThreshold  int            `json:"warning_threshold"`
+	CriticalThreshold int            `json:"critical_threshold"`
+}
+
+func NewConditionSchemaFromEnv() (*ConditionSchema, error) {
+	path := getEnv("CONDITION_SCHEMA_PATH", "")
+	if path == "" {
+		schema := defaultConditionSchema
+		return &schema, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema := &ConditionSchema{}
+	err = json.Unmarshal(data, schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+	err = schema.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition schema: %v", err)
+	}
+	return schema, nil
+}
+
+func (s *ConditionSchema) validate() error {
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+	names := map[string]struct{}{}
+	for _, key := range s.Keys {
+		// キー名は生成列の式に埋め込むので、記号を含むものは受け付けない
+		if !conditionKeyNamePattern.MatchString(key.Name) {
+			return fmt.Errorf("bad format: key name: %q", key.Name)
+		}
+		if key.Name == conditionPercentageSitting {
+			return fmt.Errorf("reserved key name: %q", key.Name)
+		}
+		if _, ok := names[key.Name]; ok {
+			return fmt.Errorf("duplicate key name: %q", key.Name)
+		}
+		names[key.Name] = struct{}{}
+		if key.Weight < 0 {
+			return fmt.Errorf("negative weight: %q", key.Name)
+		}
+	}
+	if s.WarningThreshold < 1 || s.CriticalThreshold < s.WarningThreshold {
+		return fmt.Errorf("thresholds must satisfy 1 <= warning_threshold <= critical_threshold")
+	}
+	return nil
+}
+
+// 既定のスキーマと同じなら true。このときは 0_Schema.sql の生成列をそのまま使う
+func (s *ConditionSchema) isDefault() bool {
+	return reflect.DeepEqual(*s, defaultConditionSchema)
+}
+
+// グラフの割合 (ConditionsPercentage) に sitting に続けて並べるキー。
+// 既定のスキーマと同じキーなら従来の順、そうでなければスキーマの順にする
+func (s *ConditionSchema) percentageKeys() []string {
+	keys := make([]string, 0, len(s.Keys))
+	isDefaultKeys := len(s.Keys) == len(defaultConditionSchema.Keys)
+	for i, key := range s.Keys {
+		keys = append(keys, key.Name)
+		if isDefaultKeys && key.Name != defaultConditionSchema.Keys[i].Name {
+			isDefaultKeys = false
+		}
+	}
+	if isDefaultKeys {
+		return defaultConditionPercentageKeys
+	}
+	return keys
+}
+
+// コンディションの文字列を解析し、キーの順に値を返す
+func (s *ConditionSchema) Parse(condition string) ([]bool, error) {
+	values := make([]bool, len(s.Keys))
+	rest := condition
+	for i, key := range s.Keys {
+		if i > 0 {
+			if !strings.HasPrefix(rest, ",") {
+				return nil, fmt.Errorf("invalid condition format")
+			}
+			rest = rest[1:]
+		}
+		if !strings.HasPrefix(rest, key.Name) || !strings.HasPrefix(rest[len(key.Name):], "=") {
+			return nil, fmt.Errorf("invalid condition format")
+		}
+		rest = rest[len(key.Name)+1:]
+
+		if strings.HasPrefix(rest, conditionValueTrue) {
+			values[i] = true
+			rest = rest[len(conditionValueTrue):]
+		} else if strings.HasPrefix(rest, conditionValueFalse) {
+			rest = rest[len(conditionValueFalse):]
+		} else {
+			return nil, fmt.Errorf("invalid condition format")
+		}
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid condition format")
+	}
+	return values, nil
+}
+
+// ISUのコンディションの文字列がスキーマ通りの csv 形式になっているか検証
+func (s *ConditionSchema) Validate(condition string) bool {
+	_, err := s.Parse(condition)
+	return err == nil
+}
+
+// ISUのコンディションの文字列からコンディションレベルを計算
+// isu_condition.condition_level (生成列) と同じ規則
+func (s *ConditionSchema) Level(condition string) (string, error) {
+	values, err := s.Parse(condition)
+	if err != nil {
+		return "", err
+	}
+	return s.level(values), nil
+}
+
+func (s *ConditionSchema) level(values []bool) string {
+	weight := 0
+	for i, value := range values {
+		if value {
+			weight += s.Keys[i].Weight
+		}
+	}
+	switch {
+	case weight >= s.CriticalThreshold:
+		return conditionLevelCritical
+	case weight >= s.WarningThreshold:
+		return conditionLevelWarning
+	default:
+		return conditionLevelInfo
+	}
+}
+
+// グラフのスコアに加算する値
+func (s *ConditionSchema) score(values []bool) int {
+	switch s.level(values) {
+	case conditionLevelCritical:
+		return scoreConditionLevelCritical
+	case conditionLevelWarning:
+		return scoreConditionLevelWarning
+	default:
+		return scoreConditionLevelInfo
+	}
+}
+
+// isu_condition.condition_level の生成列の式
+// `condition` の前後にカンマを付けて ,key=true, を探すので、名前が前方一致するキーを取り違えない
+func (s *ConditionSchema) levelExpr(dialect sqlDialect) string {
+	wrapped := dialect.concat("','", "`condition`", "','")
+	terms := make([]string, 0, len(s.Keys))
+	for _, key := range s.Keys {
+		terms = append(terms, "CASE WHEN INSTR("+wrapped+", ',"+key.Name+"="+conditionValueTrue+",') > 0"+
+			" THEN "+strconv.Itoa(key.Weight)+" ELSE 0 END")
+	}
+	weight := "(" + strings.Join(terms, " + ") + ")"
+	return "CASE" +
+		" WHEN " + weight + " >= " + strconv.Itoa(s.CriticalThreshold) + " THEN '" + conditionLevelCritical + "'" +
+		" WHEN " + weight + " >= " + strconv.Itoa(s.WarningThreshold) + " THEN '" + conditionLevelWarning + "'" +
+		" ELSE '" + conditionLevelInfo + "' END"
+}
@@ -0,0 +1,174 @@
+package main
+
+// エラーレスポンス
+// ハンドラは newAPIError を返し、e.HTTPErrorHandler (httpErrorHandler) がレスポンスを書く。
+// Accept で text/plain より application/json を優先するクライアントには ErrorResponse の JSON を返し、
+// それ以外 (Accept が無い、*/*、同じ優先度を含む) には従来通りメッセージだけの text/plain を返す。
+// code と field はメッセージの "bad format: field" のような形から決める。
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type apiError struct {
+	status  int
+	code    string
+	message string
+	field   string
+	// 0 でなければ Retry-After に入れる秒数
+	retryAfter int
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%d: %s", e.status, e.message)
+}
+
+// message が空のときは text/plain ではボディを返さない
+func newAPIError(status int, message string) *apiError {
+	err := &apiError{status: status, code: statusErrorCode(status), message: message}
+	for _, prefix := range []struct {
+		prefix    string
+		code      string
+		withField bool
+	}{
+		{prefix: "bad format: ", code: "bad_format", withField: true},
+		{prefix: "missing: ", code: "missing", withField: true},
+		{prefix: "not found: ", code: "not_found"},
+		{prefix: "duplicated: ", code: "duplicated"},
+	} {
+		if strings.HasPrefix(message, prefix.prefix) {
+			err.code = prefix.code
+			if prefix.withField {
+				err.field = strings.TrimPrefix(message, prefix.prefix)
+			}
+			break
+		}
+	}
+	return err
+}
+
+// "Service Unavailable" -> "service_unavailable"
+func statusErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.ReplaceAll(text, " ", "_"))
+}
+
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		c.Logger().Error(err)
+		return
+	}
+	if apiErr, ok := err.(*apiError); ok && apiErr.retryAfter > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(apiErr.retryAfter))
+	}
+
+	if !acceptsJSONError(c.Request().Header.Get(echo.HeaderAccept)) {
+		if apiErr, ok := err.(*apiError); ok {
+			if apiErr.message == "" || c.Request().Method == http.MethodHead {
+				err = c.NoContent(apiErr.status)
+			} else {
+				err = c.String(apiErr.status, apiErr.message)
+			}
+			if err != nil {
+				c.Logger().Error(err)
+			}
+			return
+		}
+		c.Echo().DefaultHTTPErrorHandler(err, c)
+		return
+	}
+
+	var status int
+	res := ErrorResponse{RequestID: c.Response().Header().Get(echo.HeaderXRequestID)}
+	switch e := err.(type) {
+	case *apiError:
+		status = e.status
+		res.Code = e.code
+		res.Message = e.message
+		res.Field = e.field
+	case *echo.HTTPError:
+		status = e.Code
+		res.Code = statusErrorCode(e.Code)
+		res.Message = fmt.Sprint(e.Message)
+	default:
+		c.Logger().Error(err)
+		status = http.StatusInternalServerError
+		res.Code = statusErrorCode(status)
+	}
+	if res.Message == "" {
+		res.Message = http.StatusText(status)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, res)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// httpErrorHandler が返すステータスコード
+func errorStatusCode(err error) int {
+	switch e := err.(type) {
+	case *apiError:
+		return e.status
+	case *echo.HTTPError:
+		return e.Code
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Accept で application/json の q が text/plain より大きければ true
+func acceptsJSONError(accept string) bool {
+	return acceptQuality(accept, echo.MIMEApplicationJSON) > acceptQuality(accept, echo.MIMETextPlain)
+}
+
+// mediaType に一致する最も具体的なメディアレンジの q を返す。一致しなければ 0
+func acceptQuality(accept string, mediaType string) float64 {
+	mainType := strings.SplitN(mediaType, "/", 2)[0]
+	quality := 0.0
+	specificity := -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+
+		var s int
+		switch name {
+		case mediaType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		specificity = s
+		quality = q
+	}
+	return quality
+}
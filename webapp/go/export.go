@@ -0,0 +1,132 @@
+package main
+
+// コンディションのエクスポート (GET /api/isu/:jia_isu_uuid/export, GET /api/export)
+// 全件をメモリに載せないよう、(timestamp, id) の昇順に exportChunkSize 件ずつ読んでは書き出す。
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+	exportChunkSize    = 1000
+)
+
+var (
+	// to を指定しなかったときの上限。MySQL の DATETIME の範囲に収める
+	exportMaxTime = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	exportCSVHeader = []string{"jia_isu_uuid", "isu_name", "timestamp", "is_sitting", "condition", "condition_level", "message"}
+)
+
+type conditionExportWriter interface {
+	contentType() string
+	writeHeader() error
+	write(condition *GetIsuConditionResponse) error
+	flush() error
+}
+
+func newConditionExportWriter(format string, w io.Writer) (conditionExportWriter, bool) {
+	switch format {
+	case exportFormatCSV:
+		return &csvExportWriter{w: csv.NewWriter(w)}, true
+	case exportFormatNDJSON:
+		return &ndjsonExportWriter{enc: json.NewEncoder(w)}, true
+	}
+	return nil, false
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (*csvExportWriter) contentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (e *csvExportWriter) writeHeader() error {
+	return e.w.Write(exportCSVHeader)
+}
+
+func (e *csvExportWriter) write(condition *GetIsuConditionResponse) error {
+	return e.w.Write([]string{
+		condition.JIAIsuUUID,
+		condition.IsuName,
+		strconv.FormatInt(condition.Timestamp, 10),
+		strconv.FormatBool(condition.IsSitting),
+		condition.Condition,
+		condition.ConditionLevel,
+		condition.Message,
+	})
+}
+
+func (e *csvExportWriter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (*ndjsonExportWriter) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (*ndjsonExportWriter) writeHeader() error {
+	return nil
+}
+
+func (e *ndjsonExportWriter) write(condition *GetIsuConditionResponse) error {
+	return e.enc.Encode(condition)
+}
+
+func (*ndjsonExportWriter) flush() error {
+	return nil
+}
+
+// ISU の [startAt, endAt) のコンディションを古い順に書き出す。flush は各チャンクの後に呼ぶ。
+// クライアントが切断して ctx が終わったら、次のチャンクを読まずに ctx.Err() を返す
+func exportIsuConditions(ctx context.Context, w conditionExportWriter, isu Isu, startAt time.Time, endAt time.Time, flush func()) error {
+	tracedRepo := repo.WithContext(ctx)
+	after := ConditionPosition{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		conditions, err := tracedRepo.GetConditionsInRange(isu.JIAIsuUUID, startAt, endAt, after, exportChunkSize)
+		if err != nil {
+			return err
+		}
+		for _, cond := range conditions {
+			err = w.write(&GetIsuConditionResponse{
+				JIAIsuUUID:     cond.JIAIsuUUID,
+				IsuName:        isu.Name,
+				Timestamp:      cond.Timestamp.Unix(),
+				IsSitting:      cond.IsSitting,
+				Condition:      cond.Condition,
+				ConditionLevel: cond.ConditionLevel,
+				Message:        cond.Message,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := w.flush(); err != nil {
+			return err
+		}
+		flush()
+
+		if len(conditions) < exportChunkSize {
+			return nil
+		}
+		last := conditions[len(conditions)-1]
+		after = ConditionPosition{Timestamp: last.Timestamp, ID: last.ID}
+	}
+}
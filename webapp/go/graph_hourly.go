@@ -0,0 +1,163 @@
+package main
+
+// ISUのコンディションの1時間毎の集計 (isu_graph_hourly)
+// isu_condition への書き込みと同じトランザクションで加算し、
+// GET /api/isu/:jia_isu_uuid/graph はこのテーブルの24行だけを参照する。
+// コンディションのキー毎の件数はスキーマで変わるので isu_graph_hourly_condition に分けて持つ。
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const graphHourlyInsertChunkSize = 500
+
+type IsuGraphHourly struct {
+	JIAIsuUUID     string    `db:"jia_isu_uuid"`
+	StartAt        time.Time `db:"start_at"`
+	ConditionCount int       `db:"condition_count"`
+	SittingCount   int       `db:"sitting_count"`
+	RawScoreSum    int       `db:"raw_score_sum"`
+	// コンディションレベル毎の件数 (GET /api/trend/history)
+	InfoCount     int `db:"info_count"`
+	WarningCount  int `db:"warning_count"`
+	CriticalCount int `db:"critical_count"`
+	// カンマ区切りの unixtime。加算の都合で昇順とは限らない
+	ConditionTimestamps string `db:"condition_timestamps"`
+	// キー毎の true の件数 (isu_graph_hourly_condition)
+	ConditionCounts map[string]int `db:"-"`
+}
+
+type IsuGraphHourlyCondition struct {
+	JIAIsuUUID   string    `db:"jia_isu_uuid"`
+	StartAt      time.Time `db:"start_at"`
+	ConditionKey string    `db:"condition_key"`
+	Count        int       `db:"count"`
+}
+
+type graphHourlyKey struct {
+	JIAIsuUUID string
+	StartAt    int64
+}
+
+// コンディションを一件集計に加える
+func (g *IsuGraphHourly) add(timestamp int64, isSitting bool, condition string) error {
+	values, err := conditionSchema.Parse(condition)
+	if err != nil {
+		return err
+	}
+
+	if g.ConditionCounts == nil {
+		g.ConditionCounts = map[string]int{}
+	}
+	for i, value := range values {
+		if value {
+			g.ConditionCounts[conditionSchema.Keys[i].Name]++
+		}
+	}
+	g.RawScoreSum += conditionSchema.score(values)
+	switch conditionSchema.level(values) {
+	case conditionLevelCritical:
+		g.CriticalCount++
+	case conditionLevelWarning:
+		g.WarningCount++
+	default:
+		g.InfoCount++
+	}
+
+	if isSitting {
+		g.SittingCount++
+	}
+	g.ConditionCount++
+
+	if g.ConditionTimestamps != "" {
+		g.ConditionTimestamps += ","
+	}
+	g.ConditionTimestamps += strconv.FormatInt(timestamp, 10)
+
+	return nil
+}
+
+// 別の集計の件数を加える。condition_timestamps はまとめない
+func (g *IsuGraphHourly) merge(other *IsuGraphHourly) {
+	if g.ConditionCounts == nil {
+		g.ConditionCounts = map[string]int{}
+	}
+	for key, count := range other.ConditionCounts {
+		g.ConditionCounts[key] += count
+	}
+	g.RawScoreSum += other.RawScoreSum
+	g.InfoCount += other.InfoCount
+	g.WarningCount += other.WarningCount
+	g.CriticalCount += other.CriticalCount
+	g.SittingCount += other.SittingCount
+	g.ConditionCount += other.ConditionCount
+}
+
+func (g *IsuGraphHourly) dataPoint() GraphDataPoint {
+	percentage := ConditionsPercentage{
+		conditionPercentageSitting: g.SittingCount * 100 / g.ConditionCount,
+	}
+	for _, key := range conditionSchema.Keys {
+		percentage[key.Name] = g.ConditionCounts[key.Name] * 100 / g.ConditionCount
+	}
+	return GraphDataPoint{
+		Score:      g.RawScoreSum * 100 / 3 / g.ConditionCount,
+		Percentage: percentage,
+	}
+}
+
+// map のままだとキーの辞書順になるので、sitting を先頭にスキーマのキーの順で書き出す
+func (p ConditionsPercentage) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	keys := append([]string{conditionPercentageSitting}, conditionSchema.percentageKeys()...)
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.WriteString(strconv.Itoa(p[key]))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// 集計に含まれるコンディションの timestamp を昇順で返す
+func (g *IsuGraphHourly) timestamps() ([]int64, error) {
+	timestamps := []int64{}
+	if g.ConditionTimestamps == "" {
+		return timestamps, nil
+	}
+	for _, str := range strings.Split(g.ConditionTimestamps, ",") {
+		timestamp, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition_timestamps: %v", err)
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps, nil
+}
+
+// 集計を (jia_isu_uuid, start_at) 毎に加算する
+func addGraphHourly(aggregates map[graphHourlyKey]*IsuGraphHourly, jiaIsuUUID string, timestamp int64, isSitting bool, condition string) error {
+	startAt := time.Unix(timestamp, 0).Truncate(time.Hour)
+	key := graphHourlyKey{JIAIsuUUID: jiaIsuUUID, StartAt: startAt.Unix()}
+	aggregate, ok := aggregates[key]
+	if !ok {
+		aggregate = &IsuGraphHourly{JIAIsuUUID: jiaIsuUUID, StartAt: startAt}
+		aggregates[key] = aggregate
+	}
+	return aggregate.add(timestamp, isSitting, condition)
+}
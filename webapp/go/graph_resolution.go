@@ -0,0 +1,120 @@
+package main
+
+// グラフの解像度 (GET /api/isu/:jia_isu_uuid/graph の resolution と range) とタイムゾーン (tz)
+// 日と週のデータ点は生のコンディションではなく isu_graph_hourly の集計をまとめて計算する。
+// tz もユーザーのタイムゾーンも無いときは、hour は datetime を含む時間から 24 時間、day と week は UTC の暦で区切る。
+// タイムゾーンがあるときはその暦の 0 時で区切るので、夏時間の切り替わる日の hour は 23 か 25 個のデータ点になる。
+// isu_graph_hourly は UTC の1時間毎なので、境界が1時間の区切りに揃わないタイムゾーンは扱えない。
+// tz に指定されたときは 400 を返す。ユーザーのタイムゾーンには設定させず (checkGraphLocationAligned)、
+// 以前に設定されたものはタイムゾーンが無いものとして扱う。
+
+import (
+	"errors"
+	"sync"
+	"time"
+	// tzdata の無い環境でもタイムゾーンを読めるようにする
+	_ "time/tzdata"
+)
+
+const (
+	graphResolutionHour = "hour"
+	graphResolutionDay  = "day"
+	graphResolutionWeek = "week"
+)
+
+var errGraphBoundaryNotAligned = errors.New("graph boundary is not aligned to an hour")
+
+var (
+	// checkGraphLocationAligned で UTC との時差を確かめる期間
+	graphLocationCheckStart = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	graphLocationCheckEnd   = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// タイムゾーン名毎の checkGraphLocationAligned の結果 (bool)。読み込めるタイムゾーンの数しか増えない
+	graphLocationAligned sync.Map
+)
+
+type graphResolution struct {
+	name string
+	// resolution に対応する range
+	rangeName string
+}
+
+var graphResolutions = map[string]graphResolution{
+	graphResolutionHour: {name: graphResolutionHour, rangeName: "day"},
+	graphResolutionDay:  {name: graphResolutionDay, rangeName: "week"},
+	graphResolutionWeek: {name: graphResolutionWeek, rangeName: "quarter"},
+}
+
+// IANA のタイムゾーン名を読む。サーバーの設定に依存する "Local" は受け付けない
+func loadGraphLocation(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, errors.New("unknown time zone Local")
+	}
+	return time.LoadLocation(name)
+}
+
+// loc の UTC との時差が graphLocationCheckStart から graphLocationCheckEnd まで常に1時間単位か確かめる。
+// 時差の切り替わりは1日より短い間隔では起きないので、1日毎に確かめれば足りる。結果はタイムゾーン名毎に覚えておく
+func checkGraphLocationAligned(loc *time.Location) error {
+	aligned, ok := graphLocationAligned.Load(loc.String())
+	if !ok {
+		aligned = true
+		for t := graphLocationCheckStart; t.Before(graphLocationCheckEnd); t = t.AddDate(0, 0, 1) {
+			_, offset := t.In(loc).Zone()
+			if offset%3600 != 0 {
+				aligned = false
+				break
+			}
+		}
+		graphLocationAligned.Store(loc.String(), aligned)
+	}
+	if !aligned.(bool) {
+		return errGraphBoundaryNotAligned
+	}
+	return nil
+}
+
+// datetime を含む range のデータ点の境界を古い順に返す。データ点の数より一つ多い。
+// loc が nil のときはタイムゾーンの無いときの区切り方になる
+func (r graphResolution) boundaries(datetime time.Time, loc *time.Location) ([]time.Time, error) {
+	boundaries := []time.Time{}
+	if r.name == graphResolutionHour && loc == nil {
+		startAt := datetime.Truncate(time.Hour)
+		for i := 0; i <= 24; i++ {
+			boundaries = append(boundaries, startAt.Add(time.Duration(i)*time.Hour))
+		}
+		return boundaries, nil
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := datetime.In(loc)
+	year, month, day := t.Date()
+
+	switch r.name {
+	case graphResolutionHour:
+		endAt := time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+		for b := time.Date(year, month, day, 0, 0, 0, 0, loc); b.Before(endAt); b = b.Add(time.Hour) {
+			boundaries = append(boundaries, b)
+		}
+		boundaries = append(boundaries, endAt)
+	case graphResolutionDay:
+		for i := 0; i <= 7; i++ {
+			boundaries = append(boundaries, time.Date(year, month, day+i, 0, 0, 0, 0, loc))
+		}
+	case graphResolutionWeek:
+		// 月曜始まり
+		monday := day - (int(t.Weekday())+6)%7
+		for i := 0; i <= 13; i++ {
+			boundaries = append(boundaries, time.Date(year, month, monday+7*i, 0, 0, 0, 0, loc))
+		}
+	}
+
+	for _, b := range boundaries {
+		if b.Unix()%3600 != 0 {
+			return nil, errGraphBoundaryNotAligned
+		}
+	}
+	return boundaries, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+// ヘルスチェック
+// GET /healthz はプロセスが動いていれば 200 を返す。
+// GET /readyz は DB に繋がり、JWT の公開鍵を読み込み済みで、POST /initialize の処理中でも停止中でもなければ 200 を返し、
+// そうでなければ 503 を返す。どちらの場合も確認した項目毎の結果を返す。
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	readinessCheckTimeout = 1 * time.Second
+
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+)
+
+var (
+	// 処理中の POST /initialize の数
+	initializingCount int32
+	// SIGTERM を受けて停止中なら 1
+	shuttingDown int32
+)
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// GET /healthz
+// プロセスが動いているか
+func getHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthResponse{Status: healthStatusOK})
+}
+
+// GET /readyz
+// リクエストを受け付けられるか
+func getReadyz(c echo.Context) error {
+	res := ReadinessResponse{
+		Status: healthStatusOK,
+		Checks: map[string]string{
+			"db":         healthStatusOK,
+			"jwt_key":    healthStatusOK,
+			"initialize": healthStatusOK,
+			"shutdown":   healthStatusOK,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessCheckTimeout)
+	defer cancel()
+	err := repo.Ping(ctx)
+	if err != nil {
+		c.Logger().Warnf("db is unreachable: %v", err)
+		res.Checks["db"] = "unreachable"
+	}
+	if jiaJWTSigningKey == nil {
+		res.Checks["jwt_key"] = "not loaded"
+	}
+	if atomic.LoadInt32(&initializingCount) > 0 {
+		res.Checks["initialize"] = "in progress"
+	}
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		res.Checks["shutdown"] = "in progress"
+	}
+
+	for _, result := range res.Checks {
+		if result != healthStatusOK {
+			res.Status = healthStatusUnavailable
+			return c.JSON(http.StatusServiceUnavailable, res)
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,211 @@
+package main
+
+// 条件付き GET のための ETag の計算と ISU アイコンのキャッシュ
+// アイコンは一度読み込んだらメモリ上に持ち、GET /api/isu/:jia_isu_uuid/icon では isu テーブルを参照しない。
+// 登録・変更・削除時に書き換え、/initialize で破棄する。
+// 他のアプリケーションサーバーでの変更は ISU_ICON_CACHE_TTL_MS のうちに反映し、合計 ISU_ICON_CACHE_MAX_BYTES までしか持たない。
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIconContentType       = "application/octet-stream"
+	defaultIsuIconCacheMaxBytes  = 64 * 1024 * 1024
+	defaultIsuIconCacheTTLMillis = 60000
+)
+
+type IsuIcon struct {
+	JIAUserID string    `db:"jia_user_id"`
+	Image     []byte    `db:"image"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type cachedIsuIcon struct {
+	jiaUserID   string
+	image       []byte
+	etag        string
+	contentType string
+	modTime     time.Time
+
+	jiaIsuUUID string
+	cachedAt   time.Time
+}
+
+// 合計 maxBytes までのアイコンを最近使った順に持ち、ttl を過ぎたものは DB から読み直す
+type IsuIconCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	bytes    int64
+	icons    map[string]*list.Element
+	// 先頭が最近使ったもの
+	lru *list.List
+}
+
+func NewIsuIconCache(maxBytes int64, ttl time.Duration) *IsuIconCache {
+	return &IsuIconCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		icons:    map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+func NewIsuIconCacheFromEnv() (*IsuIconCache, error) {
+	maxBytes, err := strconv.ParseInt(getEnv("ISU_ICON_CACHE_MAX_BYTES", strconv.Itoa(defaultIsuIconCacheMaxBytes)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: ISU_ICON_CACHE_MAX_BYTES: %v", err)
+	}
+	ttlMillis, err := strconv.Atoi(getEnv("ISU_ICON_CACHE_TTL_MS", strconv.Itoa(defaultIsuIconCacheTTLMillis)))
+	if err != nil {
+		return nil, fmt.Errorf("bad format: ISU_ICON_CACHE_TTL_MS: %v", err)
+	}
+	return NewIsuIconCache(maxBytes, time.Duration(ttlMillis)*time.Millisecond), nil
+}
+
+func (c *IsuIconCache) Get(jiaIsuUUID string) (*cachedIsuIcon, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(jiaIsuUUID)
+}
+
+// アイコンを登録・変更したときに呼ぶ
+func (c *IsuIconCache) Set(jiaIsuUUID string, jiaUserID string, image []byte, modTime time.Time) *cachedIsuIcon {
+	icon := newCachedIsuIcon(jiaIsuUUID, jiaUserID, image, modTime)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(icon)
+	return icon
+}
+
+// DB から読み込んだアイコンを載せる。読み込みの間に Set されていたらそちらを優先する
+func (c *IsuIconCache) Load(jiaIsuUUID string, jiaUserID string, image []byte, modTime time.Time) *cachedIsuIcon {
+	icon := newCachedIsuIcon(jiaIsuUUID, jiaUserID, image, modTime)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.get(jiaIsuUUID); ok {
+		return cached
+	}
+	c.put(icon)
+	return icon
+}
+
+func (c *IsuIconCache) Delete(jiaIsuUUID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.icons[jiaIsuUUID]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *IsuIconCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytes = 0
+	c.icons = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+func (c *IsuIconCache) get(jiaIsuUUID string) (*cachedIsuIcon, bool) {
+	elem, ok := c.icons[jiaIsuUUID]
+	if !ok {
+		return nil, false
+	}
+	icon := elem.Value.(*cachedIsuIcon)
+	// 他のアプリケーションサーバーでの変更を ttl のうちに反映する
+	if time.Since(icon.cachedAt) > c.ttl {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return icon, true
+}
+
+// maxBytes を超えた分は使われていない順に捨てる。一つで maxBytes を超えるアイコンは持たない
+func (c *IsuIconCache) put(icon *cachedIsuIcon) {
+	if elem, ok := c.icons[icon.jiaIsuUUID]; ok {
+		c.remove(elem)
+	}
+	size := int64(len(icon.image))
+	if size > c.maxBytes {
+		return
+	}
+	c.icons[icon.jiaIsuUUID] = c.lru.PushFront(icon)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *IsuIconCache) remove(elem *list.Element) {
+	icon := c.lru.Remove(elem).(*cachedIsuIcon)
+	delete(c.icons, icon.jiaIsuUUID)
+	c.bytes -= int64(len(icon.image))
+}
+
+func newCachedIsuIcon(jiaIsuUUID string, jiaUserID string, image []byte, modTime time.Time) *cachedIsuIcon {
+	contentType := http.DetectContentType(image)
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = defaultIconContentType
+	}
+	return &cachedIsuIcon{
+		jiaUserID:   jiaUserID,
+		image:       image,
+		etag:        contentETag(image),
+		contentType: contentType,
+		modTime:     modTime,
+		jiaIsuUUID:  jiaIsuUUID,
+		cachedAt:    time.Now(),
+	}
+}
+
+func contentETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+}
+
+type staticFileETagEntry struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+var (
+	staticFileETagsMu sync.Mutex
+	staticFileETags   = map[string]staticFileETagEntry{}
+)
+
+// ファイルの内容の ETag。更新日時とサイズが変わるまでは計算し直さない
+func staticFileETag(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	staticFileETagsMu.Lock()
+	entry, ok := staticFileETags[path]
+	staticFileETagsMu.Unlock()
+	if ok && entry.modTime.Equal(fi.ModTime()) && entry.size == fi.Size() {
+		return entry.etag, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	entry = staticFileETagEntry{modTime: fi.ModTime(), size: fi.Size(), etag: contentETag(data)}
+
+	staticFileETagsMu.Lock()
+	staticFileETags[path] = entry
+	staticFileETagsMu.Unlock()
+	return entry.etag, nil
+}
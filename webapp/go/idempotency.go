@@ -0,0 +1,121 @@
+package main
+
+// POST /api/condition/:jia_isu_uuid の Idempotency-Key
+// 同じキーで再送されたバッチは書き込まずに最初のレスポンスを返す。
+// 同じキーのリクエストが並行したときは先のものの完了を待つ。
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyMaxLength = 255
+	// 完了したレスポンスを保持する期間
+	idempotencyTTL = 10 * time.Minute
+)
+
+var errIdempotencyKeyReused = errors.New("idempotency key is reused with a different request")
+
+type idempotencyEntry struct {
+	requestHash string
+	done        chan struct{}
+
+	// done が閉じた後に参照する
+	completed bool
+	res       PostIsuConditionResponse
+}
+
+type idempotencyExpiry struct {
+	key       string
+	entry     *idempotencyEntry
+	expiresAt time.Time
+}
+
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	// 完了した順 (= 期限の順)
+	expiries []idempotencyExpiry
+}
+
+func NewIdempotencyCache() *IdempotencyCache {
+	return &IdempotencyCache{entries: map[string]*idempotencyEntry{}}
+}
+
+// 完了済みのレスポンスがあればそれを返す。なければキーを予約し、owner として true を返すので、
+// 呼び出し側は Complete か Abort を必ず呼ぶ
+func (c *IdempotencyCache) Begin(key string, requestHash string) (*idempotencyEntry, bool, error) {
+	for {
+		c.mu.Lock()
+		c.pruneLocked(time.Now())
+		entry, ok := c.entries[key]
+		if !ok {
+			entry = &idempotencyEntry{requestHash: requestHash, done: make(chan struct{})}
+			c.entries[key] = entry
+			c.mu.Unlock()
+			return entry, true, nil
+		}
+		c.mu.Unlock()
+
+		if entry.requestHash != requestHash {
+			return nil, false, errIdempotencyKeyReused
+		}
+		<-entry.done
+		if entry.completed {
+			return entry, false, nil
+		}
+		// 先のリクエストが失敗したので予約し直す
+	}
+}
+
+func (c *IdempotencyCache) Complete(key string, entry *idempotencyEntry, res PostIsuConditionResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.res = res
+	entry.completed = true
+	close(entry.done)
+	if c.entries[key] == entry {
+		c.expiries = append(c.expiries, idempotencyExpiry{key: key, entry: entry, expiresAt: time.Now().Add(idempotencyTTL)})
+	}
+}
+
+func (c *IdempotencyCache) Abort(key string, entry *idempotencyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+}
+
+func (c *IdempotencyCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*idempotencyEntry{}
+	c.expiries = nil
+}
+
+func (c *IdempotencyCache) pruneLocked(now time.Time) {
+	n := 0
+	for ; n < len(c.expiries) && c.expiries[n].expiresAt.Before(now); n++ {
+		expiry := c.expiries[n]
+		if c.entries[expiry.key] == expiry.entry {
+			delete(c.entries, expiry.key)
+		}
+	}
+	c.expiries = c.expiries[n:]
+}
+
+func hashConditionRequest(req []PostIsuConditionRequest) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,489 @@
+package main
+
+// コンディションの一括インポート (POST /api/isu/:jia_isu_uuid/import)
+// オフラインだった ISU が溜めていた履歴や旧システムからの移行データを取り込む。
+// アップロードは一時ファイルに書き出してから別の goroutine で importChunkSize 件ずつ書き込み、
+// 進捗は GET /api/isu/:jia_isu_uuid/import/:import_id で参照する。
+// 既に同じ timestamp のコンディションがあるものは重複として読み飛ばす。
+// 検証を通っても書き込めなかった行は、その行だけを rejects に記録して残りを取り込む。
+// 過去のデータなので SSE の配信とアラートの評価は行わない。
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	importFormatCSV       = "csv"
+	importFormatNDJSON    = "ndjson"
+	defaultImportMaxBytes = 256 * 1024 * 1024
+	importChunkSize       = 500
+	importMaxLineBytes    = 1024 * 1024
+	// 保持する不正な行の件数。件数自体は rejected で全て数える
+	importRejectLimit = 1000
+	// 終了したインポートの状態を保持する期間
+	importRetention = 1 * time.Hour
+	importIDBytes   = 16
+
+	importStatusRunning   = "running"
+	importStatusCompleted = "completed"
+	importStatusFailed    = "failed"
+	importStatusCanceled  = "canceled"
+)
+
+var (
+	errImportTooLarge = errors.New("import is too large")
+	errImportCanceled = errors.New("import is canceled")
+)
+
+type ImportReject struct {
+	// NDJSON は行番号、CSV はヘッダを1とするレコード番号
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type ImportStatus struct {
+	ID         string `json:"id"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Format     string `json:"format"`
+	Status     string `json:"status"`
+	TotalBytes int64  `json:"total_bytes"`
+	ReadBytes  int64  `json:"read_bytes"`
+	// 読み込んだ行数 (空行と CSV のヘッダを除く)
+	Processed  int            `json:"processed"`
+	Inserted   int            `json:"inserted"`
+	Duplicated int            `json:"duplicated"`
+	Rejected   int            `json:"rejected"`
+	Rejects    []ImportReject `json:"rejects"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  int64          `json:"created_at"`
+	FinishedAt *int64         `json:"finished_at"`
+}
+
+type importJob struct {
+	jiaUserID  string
+	path       string
+	generation uint64
+	// アップロードしたリクエストのトレースを引き継ぐ
+	traceparent string
+
+	// status は ImportManager.mu で保護する
+	status   ImportStatus
+	finished time.Time
+}
+
+type ImportManager struct {
+	tmpDir     string
+	maxBytes   int64
+	generation uint64
+
+	// チャンクの書き込み中は RLock、Reset 中は Lock
+	writeMu sync.RWMutex
+
+	mu   sync.Mutex
+	jobs map[string]*importJob
+}
+
+func NewImportManagerFromEnv() (*ImportManager, error) {
+	maxBytes, err := strconv.ParseInt(getEnv("IMPORT_MAX_BYTES", strconv.Itoa(defaultImportMaxBytes)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: IMPORT_MAX_BYTES: %v", err)
+	}
+	return &ImportManager{
+		tmpDir:   getEnv("IMPORT_TMP_DIR", os.TempDir()),
+		maxBytes: maxBytes,
+		jobs:     map[string]*importJob{},
+	}, nil
+}
+
+// アップロードを一時ファイルに書き出し、書き込みを開始する。maxBytes を超えたら errImportTooLarge を返す
+func (m *ImportManager) Start(ctx context.Context, jiaUserID string, jiaIsuUUID string, format string, body io.Reader) (ImportStatus, error) {
+	file, err := ioutil.TempFile(m.tmpDir, "isucondition-import-*")
+	if err != nil {
+		return ImportStatus{}, err
+	}
+	size, err := io.Copy(file, io.LimitReader(body, m.maxBytes+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > m.maxBytes {
+		err = errImportTooLarge
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return ImportStatus{}, err
+	}
+
+	id, err := generateImportID()
+	if err != nil {
+		os.Remove(file.Name())
+		return ImportStatus{}, err
+	}
+
+	job := &importJob{
+		jiaUserID:   jiaUserID,
+		path:        file.Name(),
+		generation:  atomic.LoadUint64(&m.generation),
+		traceparent: traceparentFromContext(ctx),
+		status: ImportStatus{
+			ID:         id,
+			JIAIsuUUID: jiaIsuUUID,
+			Format:     format,
+			Status:     importStatusRunning,
+			TotalBytes: size,
+			Rejects:    []ImportReject{},
+			CreatedAt:  time.Now().Unix(),
+		},
+	}
+
+	m.mu.Lock()
+	m.pruneLocked()
+	m.jobs[id] = job
+	status := job.snapshotLocked()
+	m.mu.Unlock()
+
+	go m.run(job)
+	return status, nil
+}
+
+// インポートの状態を取得。他のユーザーや ISU のものは見つからない扱いにする
+func (m *ImportManager) Get(jiaUserID string, jiaIsuUUID string, id string) (ImportStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok || job.jiaUserID != jiaUserID || job.status.JIAIsuUUID != jiaIsuUUID {
+		return ImportStatus{}, false
+	}
+	return job.snapshotLocked(), true
+}
+
+// 実行中のインポートを打ち切り、状態を全て破棄する
+func (m *ImportManager) Reset() {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	atomic.AddUint64(&m.generation, 1)
+	m.jobs = map[string]*importJob{}
+}
+
+func (m *ImportManager) pruneLocked() {
+	for id, job := range m.jobs {
+		if !job.finished.IsZero() && time.Since(job.finished) > importRetention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (job *importJob) snapshotLocked() ImportStatus {
+	status := job.status
+	status.Rejects = append([]ImportReject{}, job.status.Rejects...)
+	return status
+}
+
+func (m *ImportManager) update(job *importJob, fn func(status *ImportStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&job.status)
+}
+
+func (m *ImportManager) finish(job *importJob, status string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.finished = time.Now()
+	finishedAt := job.finished.Unix()
+	job.status.Status = status
+	job.status.FinishedAt = &finishedAt
+	if err != nil {
+		job.status.Error = err.Error()
+	}
+}
+
+func (m *ImportManager) run(job *importJob) {
+	defer os.Remove(job.path)
+
+	ctx, span := startSpan(contextFromTraceparent(job.traceparent), "isu.import", spanKindInternal)
+	span.SetAttribute("isu.jia_isu_uuid", job.status.JIAIsuUUID)
+	span.SetAttribute("isu.import_id", job.status.ID)
+	defer span.End(nil)
+
+	file, err := os.Open(job.path)
+	if err != nil {
+		log.Errorf("failed to open import: %v", err)
+		m.finish(job, importStatusFailed, err)
+		return
+	}
+	defer file.Close()
+
+	reader := &countingReader{r: file}
+	chunk := make([]PostIsuConditionRequest, 0, importChunkSize)
+	chunkLines := make([]int, 0, importChunkSize)
+	write := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		inserted, duplicated, rejects, err := m.writeChunk(ctx, job, chunk, chunkLines)
+		chunk = chunk[:0]
+		chunkLines = chunkLines[:0]
+		if err != nil {
+			return err
+		}
+		m.update(job, func(status *ImportStatus) {
+			status.Inserted += inserted
+			status.Duplicated += duplicated
+			status.Rejected += len(rejects)
+			for _, reject := range rejects {
+				if len(status.Rejects) < importRejectLimit {
+					status.Rejects = append(status.Rejects, reject)
+				}
+			}
+			status.ReadBytes = atomic.LoadInt64(&reader.n)
+		})
+		return nil
+	}
+
+	parse := parseImportNDJSON
+	if job.status.Format == importFormatCSV {
+		parse = parseImportCSV
+	}
+	err = parse(reader, func(line int, cond PostIsuConditionRequest, parseErr error) error {
+		if parseErr == nil {
+			parseErr = validatePostIsuCondition(cond)
+		}
+		m.update(job, func(status *ImportStatus) {
+			status.Processed++
+			if parseErr != nil {
+				status.Rejected++
+				if len(status.Rejects) < importRejectLimit {
+					status.Rejects = append(status.Rejects, ImportReject{Line: line, Reason: parseErr.Error()})
+				}
+			}
+		})
+		if parseErr != nil {
+			return nil
+		}
+
+		chunk = append(chunk, cond)
+		chunkLines = append(chunkLines, line)
+		if len(chunk) >= importChunkSize {
+			return write()
+		}
+		return nil
+	})
+	if err == nil {
+		err = write()
+	}
+
+	switch {
+	case errors.Is(err, errImportCanceled):
+		span.SetAttribute("isu.import_status", importStatusCanceled)
+		m.finish(job, importStatusCanceled, nil)
+	case err != nil:
+		log.Errorf("failed to import isu condition: jia_isu_uuid=%v: %v", job.status.JIAIsuUUID, err)
+		span.SetAttribute("isu.import_status", importStatusFailed)
+		m.finish(job, importStatusFailed, err)
+	default:
+		span.SetAttribute("isu.import_status", importStatusCompleted)
+		m.update(job, func(status *ImportStatus) {
+			status.ReadBytes = status.TotalBytes
+		})
+		m.finish(job, importStatusCompleted, nil)
+	}
+}
+
+// チャンクを書き込み、書き込んだ件数と重複していた件数を返す。
+// まとめて書き込めなかったときは一行ずつ書き込み直し、書き込めなかった行を lines の行番号で返す
+func (m *ImportManager) writeChunk(ctx context.Context, job *importJob, chunk []PostIsuConditionRequest, lines []int) (int, int, []ImportReject, error) {
+	m.writeMu.RLock()
+	defer m.writeMu.RUnlock()
+	if atomic.LoadUint64(&m.generation) != job.generation {
+		return 0, 0, nil, errImportCanceled
+	}
+
+	tracedRepo := repo.WithContext(ctx)
+	inserted, err := insertImportConditions(tracedRepo, job.status.JIAIsuUUID, chunk)
+	if err == nil {
+		return inserted, len(chunk) - inserted, nil, nil
+	}
+	log.Errorf("db error: %v", err)
+
+	// DB に繋がらないときはインポートを失敗にする
+	pingCtx, cancel := context.WithTimeout(ctx, conditionPingTimeout)
+	defer cancel()
+	if pingErr := tracedRepo.Ping(pingCtx); pingErr != nil {
+		return 0, 0, nil, err
+	}
+
+	inserted = 0
+	duplicated := 0
+	rejects := []ImportReject{}
+	for i, cond := range chunk {
+		n, err := insertImportConditions(tracedRepo, job.status.JIAIsuUUID, []PostIsuConditionRequest{cond})
+		if err != nil {
+			log.Errorf("db error: %v", err)
+			rejects = append(rejects, ImportReject{Line: lines[i], Reason: "failed to insert condition"})
+			continue
+		}
+		inserted += n
+		duplicated += 1 - n
+	}
+	return inserted, duplicated, rejects, nil
+}
+
+func insertImportConditions(tracedRepo Repository, jiaIsuUUID string, conditions []PostIsuConditionRequest) (int, error) {
+	batches, err := tracedRepo.InsertConditions([]ConditionBatch{{JIAIsuUUID: jiaIsuUUID, Conditions: conditions}})
+	if err != nil {
+		return 0, err
+	}
+	inserted := 0
+	for _, batch := range batches {
+		inserted += len(batch.Conditions)
+	}
+	return inserted, nil
+}
+
+type importLine struct {
+	IsSitting *bool   `json:"is_sitting"`
+	Condition *string `json:"condition"`
+	Message   string  `json:"message"`
+	Timestamp *int64  `json:"timestamp"`
+}
+
+// NDJSON を一行ずつ fn に渡す。POST /api/condition/:jia_isu_uuid の要素と同じ形式で、
+// GET /api/isu/:jia_isu_uuid/export?format=ndjson の出力もそのまま読める
+func parseImportNDJSON(r io.Reader, fn func(line int, cond PostIsuConditionRequest, err error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), importMaxLineBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var req importLine
+		var err error
+		if jsonErr := json.Unmarshal([]byte(text), &req); jsonErr != nil {
+			err = fmt.Errorf("bad format: json")
+		} else if req.Timestamp == nil {
+			err = fmt.Errorf("missing: timestamp")
+		} else if req.IsSitting == nil {
+			err = fmt.Errorf("missing: is_sitting")
+		} else if req.Condition == nil {
+			err = fmt.Errorf("missing: condition")
+		}
+		cond := PostIsuConditionRequest{Message: req.Message}
+		if err == nil {
+			cond.Timestamp = *req.Timestamp
+			cond.IsSitting = *req.IsSitting
+			cond.Condition = *req.Condition
+		}
+		if err := fn(line, cond, err); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("line %d is too long", line+1)
+		}
+		return err
+	}
+	return nil
+}
+
+// CSV をレコード毎に fn に渡す。一行目はヘッダで、timestamp, is_sitting, condition は必須、message は任意。
+// それ以外の列は無視するので GET /api/isu/:jia_isu_uuid/export?format=csv の出力もそのまま読める
+func parseImportCSV(r io.Reader, fn func(line int, cond PostIsuConditionRequest, err error) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fmt.Errorf("bad format: csv header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"timestamp", "is_sitting", "condition"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("missing: csv column %v", name)
+		}
+	}
+	messageIndex, hasMessage := columns["message"]
+
+	line := 1
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		line++
+
+		var cond PostIsuConditionRequest
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return err
+			}
+			err = fmt.Errorf("bad format: csv")
+		} else if len(record) < len(header) {
+			err = fmt.Errorf("bad format: column count")
+		} else {
+			cond.Condition = record[columns["condition"]]
+			if hasMessage {
+				cond.Message = record[messageIndex]
+			}
+			cond.Timestamp, err = strconv.ParseInt(record[columns["timestamp"]], 10, 64)
+			if err != nil {
+				err = fmt.Errorf("bad format: timestamp")
+			} else if cond.IsSitting, err = strconv.ParseBool(record[columns["is_sitting"]]); err != nil {
+				err = fmt.Errorf("bad format: is_sitting")
+			}
+		}
+		if err := fn(line, cond, err); err != nil {
+			return err
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func generateImportID() (string, error) {
+	b := make([]byte, importIDBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,630 @@
+package main
+
+// コンディションの書き込みキュー
+// POST /api/condition/:jia_isu_uuid で受け付けたコンディションをメモリ上の有界キューに積み、
+// 複数の writer goroutine がまとめて isu_condition に multi-row INSERT する。
+// キューが溢れた分はディスク上の spill ファイル (WAL) に追記し、キューに空きができ次第戻す。
+// 書き込めなかったバッチは spill に戻して再試行し、DB に繋がるのに conditionMaxAttempts 回失敗したものは dead letter のファイルに移す。
+// 書き込み待ち (キュー、spill、INSERT 中) のコンディションの timestamp を ISU 毎に覚えておき、
+// 書き込みを待っている間に再送されたものを重複として読み飛ばせるようにする。
+// 停止時 (Shutdown) はキューに残った分を書き込み、間に合わなかった分と停止後に積まれた分は spill に書き出して次のプロセスに引き継ぐ。
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	defaultConditionQueueSize      = 10000
+	defaultConditionWriterNum      = 4
+	defaultConditionSpillPath      = "./condition_spill.wal"
+	defaultConditionSpillMaxBytes  = 64 * 1024 * 1024
+	defaultConditionDeadLetterPath = "./condition_dead_letter.jsonl"
+	conditionInsertChunkSize       = 500
+	conditionFlushInterval         = 100 * time.Millisecond
+	conditionRetryAfterSeconds     = 1
+	conditionMaxAttempts           = 5
+	conditionPingTimeout           = 1 * time.Second
+	// isu_condition の VARCHAR(255)
+	conditionColumnMaxLength = 255
+)
+
+var (
+	// DATETIME に入る範囲。DB のタイムゾーンでずれても収まるよう一日ずつ狭める
+	conditionTimestampMin = time.Date(1000, 1, 2, 0, 0, 0, 0, time.UTC).Unix()
+	conditionTimestampMax = time.Date(9999, 12, 30, 23, 59, 59, 0, time.UTC).Unix()
+)
+
+var errConditionQueueFull = errors.New("condition queue is full")
+
+type ConditionBatch struct {
+	JIAIsuUUID string                    `json:"jia_isu_uuid"`
+	Conditions []PostIsuConditionRequest `json:"conditions"`
+	// 書き込みに失敗した回数
+	Attempts int `json:"attempts,omitempty"`
+
+	// キューに積まれた時点の世代。/initialize 以前に積まれたものは書き込まない
+	generation uint64
+	// 受け付けたリクエストのトレースをアラートの評価に引き継ぐ。spill には書き出さない
+	traceparent string
+}
+
+// POST /api/condition/:jia_isu_uuid と POST /api/isu/:jia_isu_uuid/import に共通のコンディションの検証
+func validatePostIsuCondition(cond PostIsuConditionRequest) error {
+	if !conditionSchema.Validate(cond.Condition) || utf8.RuneCountInString(cond.Condition) > conditionColumnMaxLength {
+		return fmt.Errorf("bad format: condition")
+	}
+	if utf8.RuneCountInString(cond.Message) > conditionColumnMaxLength {
+		return fmt.Errorf("bad format: message")
+	}
+	if cond.Timestamp < conditionTimestampMin || conditionTimestampMax < cond.Timestamp {
+		return fmt.Errorf("bad format: timestamp")
+	}
+	return nil
+}
+
+// 書き込みを諦めたバッチ。dead letter のファイルに一行ずつ書き出す
+type conditionDeadLetter struct {
+	ConditionBatch
+	Error          string    `json:"error"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+}
+
+type ConditionQueueStats struct {
+	Queued         int   `json:"queued"`
+	Capacity       int   `json:"capacity"`
+	SpilledBatches int   `json:"spilled_batches"`
+	SpillBytes     int64 `json:"spill_bytes"`
+	SpillMaxBytes  int64 `json:"spill_max_bytes"`
+	Writers        int   `json:"writers"`
+	// 起動してから dead letter に移したバッチの数
+	DeadLetteredBatches int64 `json:"dead_lettered_batches"`
+}
+
+type ConditionQueue struct {
+	ch         chan ConditionBatch
+	writerNum  int
+	generation uint64
+
+	// writer の INSERT 中は RLock、Reset 中は Lock
+	flushMu sync.RWMutex
+
+	spillMu          sync.Mutex
+	spillFile        *os.File
+	spillMaxBytes    int64
+	spillReadOffset  int64
+	spillWriteOffset int64
+	spilledBatches   int
+	spillNotify      chan struct{}
+
+	deadLetterMu        sync.Mutex
+	deadLetterFile      *os.File
+	deadLetteredBatches int64
+
+	// ISU 毎の書き込み待ちの timestamp
+	pendingMu sync.Mutex
+	pending   map[string]map[int64]struct{}
+
+	// Enqueue 中は RLock、Shutdown で closed にするときは Lock
+	closeMu      sync.RWMutex
+	closed       bool
+	stopReplayer chan struct{}
+	replayerDone chan struct{}
+	stopWriters  chan struct{}
+	// Shutdown が間に合わなかったとき、writer に書き込みをやめさせる
+	abortWriters chan struct{}
+	writers      sync.WaitGroup
+}
+
+func NewConditionQueue(queueSize int, writerNum int, spillPath string, spillMaxBytes int64, deadLetterPath string) (*ConditionQueue, error) {
+	file, err := os.OpenFile(spillPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spill file: %v", err)
+	}
+	deadLetterFile, err := os.OpenFile(deadLetterPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead letter file: %v", err)
+	}
+
+	q := &ConditionQueue{
+		ch:             make(chan ConditionBatch, queueSize),
+		writerNum:      writerNum,
+		spillFile:      file,
+		spillMaxBytes:  spillMaxBytes,
+		spillNotify:    make(chan struct{}, 1),
+		deadLetterFile: deadLetterFile,
+		pending:        map[string]map[int64]struct{}{},
+		stopReplayer:   make(chan struct{}),
+		replayerDone:   make(chan struct{}),
+		stopWriters:    make(chan struct{}),
+		abortWriters:   make(chan struct{}),
+	}
+
+	// 前回のプロセスが書き込みきれなかった spill を引き継ぐ
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), int(spillMaxBytes)+1)
+	for scanner.Scan() {
+		q.spillWriteOffset += int64(len(scanner.Bytes())) + 1
+		q.spilledBatches++
+		var batch ConditionBatch
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err == nil {
+			q.Reserve(batch.JIAIsuUUID, batch.Conditions)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spill file: %v", err)
+	}
+
+	return q, nil
+}
+
+func NewConditionQueueFromEnv() (*ConditionQueue, error) {
+	queueSize, err := strconv.Atoi(getEnv("CONDITION_QUEUE_SIZE", strconv.Itoa(defaultConditionQueueSize)))
+	if err != nil {
+		return nil, fmt.Errorf("bad format: CONDITION_QUEUE_SIZE: %v", err)
+	}
+	writerNum, err := strconv.Atoi(getEnv("CONDITION_WRITER_NUM", strconv.Itoa(defaultConditionWriterNum)))
+	if err != nil {
+		return nil, fmt.Errorf("bad format: CONDITION_WRITER_NUM: %v", err)
+	}
+	spillMaxBytes, err := strconv.ParseInt(getEnv("CONDITION_SPILL_MAX_BYTES", strconv.Itoa(defaultConditionSpillMaxBytes)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: CONDITION_SPILL_MAX_BYTES: %v", err)
+	}
+	spillPath := getEnv("CONDITION_SPILL_PATH", defaultConditionSpillPath)
+	deadLetterPath := getEnv("CONDITION_DEAD_LETTER_PATH", defaultConditionDeadLetterPath)
+
+	return NewConditionQueue(queueSize, writerNum, spillPath, spillMaxBytes, deadLetterPath)
+}
+
+// writer と spill の読み戻しを開始する
+func (q *ConditionQueue) Start() {
+	q.writers.Add(q.writerNum)
+	for i := 0; i < q.writerNum; i++ {
+		go q.runWriter()
+	}
+	go q.runSpillReplayer()
+}
+
+// conditions のうち書き込み待ちでないものを書き込み待ちにして返す。
+// 返したものは Enqueue で積むか、積まない場合は Release で戻す
+func (q *ConditionQueue) Reserve(jiaIsuUUID string, conditions []PostIsuConditionRequest) []PostIsuConditionRequest {
+	q.pendingMu.Lock()
+	defer q.pendingMu.Unlock()
+
+	timestamps, ok := q.pending[jiaIsuUUID]
+	if !ok {
+		timestamps = map[int64]struct{}{}
+		q.pending[jiaIsuUUID] = timestamps
+	}
+	reserved := make([]PostIsuConditionRequest, 0, len(conditions))
+	for _, cond := range conditions {
+		if _, ok := timestamps[cond.Timestamp]; ok {
+			continue
+		}
+		timestamps[cond.Timestamp] = struct{}{}
+		reserved = append(reserved, cond)
+	}
+	if len(timestamps) == 0 {
+		delete(q.pending, jiaIsuUUID)
+	}
+	return reserved
+}
+
+// Reserve で書き込み待ちにしたコンディションを戻す
+func (q *ConditionQueue) Release(jiaIsuUUID string, conditions []PostIsuConditionRequest) {
+	q.pendingMu.Lock()
+	defer q.pendingMu.Unlock()
+
+	timestamps, ok := q.pending[jiaIsuUUID]
+	if !ok {
+		return
+	}
+	for _, cond := range conditions {
+		delete(timestamps, cond.Timestamp)
+	}
+	if len(timestamps) == 0 {
+		delete(q.pending, jiaIsuUUID)
+	}
+}
+
+// Reserve したコンディションをキューに積む。キューも spill ファイルも一杯のときは書き込み待ちから戻して errConditionQueueFull を返す
+func (q *ConditionQueue) Enqueue(batch ConditionBatch) error {
+	err := q.enqueue(batch)
+	if err != nil {
+		q.Release(batch.JIAIsuUUID, batch.Conditions)
+	}
+	return err
+}
+
+func (q *ConditionQueue) enqueue(batch ConditionBatch) error {
+	batch.generation = atomic.LoadUint64(&q.generation)
+
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+	if q.closed {
+		return q.spill(batch)
+	}
+
+	select {
+	case q.ch <- batch:
+		return nil
+	default:
+	}
+
+	return q.spill(batch)
+}
+
+func (q *ConditionQueue) Stats() ConditionQueueStats {
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+
+	return ConditionQueueStats{
+		Queued:              len(q.ch),
+		Capacity:            cap(q.ch),
+		SpilledBatches:      q.spilledBatches,
+		SpillBytes:          q.spillWriteOffset - q.spillReadOffset,
+		SpillMaxBytes:       q.spillMaxBytes,
+		Writers:             q.writerNum,
+		DeadLetteredBatches: atomic.LoadInt64(&q.deadLetteredBatches),
+	}
+}
+
+// 書き込み待ちのコンディションを全て破棄する
+func (q *ConditionQueue) Reset() error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+
+	atomic.AddUint64(&q.generation, 1)
+	q.pendingMu.Lock()
+	q.pending = map[string]map[int64]struct{}{}
+	q.pendingMu.Unlock()
+
+drain:
+	for {
+		select {
+		case <-q.ch:
+		default:
+			break drain
+		}
+	}
+
+	return q.truncateSpill()
+}
+
+// 新しいコンディションをキューに積むのをやめ、キューに残ったコンディションを書き込んで writer を止める。
+// ctx が終わるまでに書き込みきれなければ、writer を止めてからキューに残った分を spill に書き出して ctx.Err() を返す
+func (q *ConditionQueue) Shutdown(ctx context.Context) error {
+	q.closeMu.Lock()
+	q.closed = true
+	q.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.writers.Wait()
+		close(done)
+	}()
+
+	// spill から読み戻している途中の分をキューに入れきってから writer を止める
+	close(q.stopReplayer)
+	select {
+	case <-q.replayerDone:
+	case <-ctx.Done():
+		q.abort(done)
+		return ctx.Err()
+	}
+
+	close(q.stopWriters)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.abort(done)
+		return ctx.Err()
+	}
+}
+
+// writer に書き込みをやめさせ、キューに残った分を spill に書き出す。
+// writer と spill の読み戻しが止まるのを待ってから読むので、同じバッチを書き込みと spill の両方に回すことはない。
+// INSERT の途中の writer はその INSERT が終わるまで待つ
+func (q *ConditionQueue) abort(writersDone <-chan struct{}) {
+	close(q.abortWriters)
+	<-writersDone
+	<-q.replayerDone
+	q.spillQueued()
+}
+
+// キューに残っている分を spill に書き出す
+func (q *ConditionQueue) spillQueued() {
+	for {
+		select {
+		case batch := <-q.ch:
+			q.respill(batch)
+		default:
+			return
+		}
+	}
+}
+
+func (q *ConditionQueue) spill(batch ConditionBatch) error {
+	line, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+
+	if q.spillWriteOffset+int64(len(line)) > q.spillMaxBytes {
+		return errConditionQueueFull
+	}
+
+	_, err = q.spillFile.WriteAt(line, q.spillWriteOffset)
+	if err != nil {
+		return fmt.Errorf("failed to write spill file: %v", err)
+	}
+	err = q.spillFile.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync spill file: %v", err)
+	}
+	q.spillWriteOffset += int64(len(line))
+	q.spilledBatches++
+
+	select {
+	case q.spillNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// spill ファイルの先頭から一件取り出す
+func (q *ConditionQueue) popSpill() (ConditionBatch, bool, error) {
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+
+	if q.spilledBatches == 0 {
+		return ConditionBatch{}, false, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(q.spillFile, q.spillReadOffset, q.spillWriteOffset-q.spillReadOffset))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		// 途中で壊れた spill は読み進められないので捨てる
+		if truncErr := q.truncateSpill(); truncErr != nil {
+			log.Error(truncErr)
+		}
+		return ConditionBatch{}, false, fmt.Errorf("failed to read spill file: %v", err)
+	}
+	q.spillReadOffset += int64(len(line))
+	q.spilledBatches--
+
+	var batch ConditionBatch
+	err = json.Unmarshal(line, &batch)
+	if q.spilledBatches == 0 {
+		if truncErr := q.truncateSpill(); truncErr != nil {
+			log.Error(truncErr)
+		}
+	}
+	if err != nil {
+		return ConditionBatch{}, false, fmt.Errorf("broken spill record: %v", err)
+	}
+	batch.generation = atomic.LoadUint64(&q.generation)
+
+	return batch, true, nil
+}
+
+func (q *ConditionQueue) truncateSpill() error {
+	err := q.spillFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("failed to truncate spill file: %v", err)
+	}
+	q.spillReadOffset = 0
+	q.spillWriteOffset = 0
+	q.spilledBatches = 0
+	return nil
+}
+
+func (q *ConditionQueue) runSpillReplayer() {
+	defer close(q.replayerDone)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stopReplayer:
+			return
+		case <-q.spillNotify:
+		case <-ticker.C:
+		}
+
+		for {
+			batch, ok, err := q.popSpill()
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if !ok {
+				break
+			}
+			select {
+			case q.ch <- batch:
+			case <-q.stopReplayer:
+				// 取り出した分は spill に戻し、次のプロセスに引き継ぐ
+				q.respill(batch)
+				return
+			}
+		}
+	}
+}
+
+func (q *ConditionQueue) runWriter() {
+	defer q.writers.Done()
+	ticker := time.NewTicker(conditionFlushInterval)
+	defer ticker.Stop()
+
+	pending := []ConditionBatch{}
+	pendingRows := 0
+	// 書き込まずに止まるときは、手元のバッチを spill に書き出す
+	abort := func() {
+		generation := atomic.LoadUint64(&q.generation)
+		for _, batch := range pending {
+			if batch.generation == generation {
+				q.respill(batch)
+			}
+		}
+	}
+	for {
+		select {
+		case <-q.abortWriters:
+			abort()
+			return
+		case <-q.stopWriters:
+			// キューが空になるまで書き込んでから止まる
+			for {
+				select {
+				case <-q.abortWriters:
+					abort()
+					return
+				default:
+				}
+				select {
+				case batch := <-q.ch:
+					pending = append(pending, batch)
+					pendingRows += len(batch.Conditions)
+					if pendingRows < conditionInsertChunkSize {
+						continue
+					}
+					q.flush(pending)
+					pending = []ConditionBatch{}
+					pendingRows = 0
+				default:
+					if len(pending) != 0 {
+						q.flush(pending)
+					}
+					return
+				}
+			}
+		case batch := <-q.ch:
+			pending = append(pending, batch)
+			pendingRows += len(batch.Conditions)
+			if pendingRows < conditionInsertChunkSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+		}
+
+		q.flush(pending)
+		pending = []ConditionBatch{}
+		pendingRows = 0
+	}
+}
+
+func (q *ConditionQueue) flush(batches []ConditionBatch) {
+	q.flushMu.RLock()
+	defer q.flushMu.RUnlock()
+
+	generation := atomic.LoadUint64(&q.generation)
+	current := make([]ConditionBatch, 0, len(batches))
+	for _, batch := range batches {
+		if batch.generation == generation {
+			current = append(current, batch)
+		}
+	}
+	if len(current) == 0 {
+		return
+	}
+
+	inserted, err := repo.InsertConditions(current)
+	if err == nil {
+		q.committed(current, inserted)
+		return
+	}
+	log.Errorf("db error: %v", err)
+
+	// DB に繋がらないときは全て spill に戻し、失敗の回数に数えない
+	ctx, cancel := context.WithTimeout(context.Background(), conditionPingTimeout)
+	defer cancel()
+	if pingErr := repo.Ping(ctx); pingErr != nil {
+		for _, batch := range current {
+			q.respill(batch)
+		}
+		return
+	}
+
+	// 一つの不正な行でまとめた INSERT 全体が失敗するので、バッチ毎に書き込み直して失敗したバッチだけを再試行する
+	for _, batch := range current {
+		if len(current) > 1 {
+			inserted, err = repo.InsertConditions([]ConditionBatch{batch})
+			if err == nil {
+				q.committed([]ConditionBatch{batch}, inserted)
+				continue
+			}
+			log.Errorf("db error: %v", err)
+		}
+		batch.Attempts++
+		if batch.Attempts >= conditionMaxAttempts {
+			q.deadLetter(batch, err)
+			continue
+		}
+		q.respill(batch)
+	}
+}
+
+// batches の書き込みをコミットしたので書き込み待ちから外し、実際に書き込んだ inserted を数えて
+// GET /api/condition/:jia_isu_uuid/stream の購読者に配信し、アラートの評価に渡す。
+// コミットしてから配信するので、Last-Event-ID で再接続したクライアントは DB からの再送で取りこぼさない
+func (q *ConditionQueue) committed(batches []ConditionBatch, inserted []ConditionBatch) {
+	for _, batch := range batches {
+		q.Release(batch.JIAIsuUUID, batch.Conditions)
+	}
+	for _, batch := range inserted {
+		metrics.AddConditionInserts(batch.Conditions)
+		conditionHub.Publish(batch.JIAIsuUUID, batch.Conditions)
+		alertManager.Submit(batch.JIAIsuUUID, batch.Conditions, batch.traceparent)
+	}
+}
+
+// 書き込めなかったバッチを spill に戻して再試行する。spill にも書けなければ破棄して書き込み待ちから外す
+func (q *ConditionQueue) respill(batch ConditionBatch) {
+	if err := q.spill(batch); err != nil {
+		log.Errorf("drop isu condition: jia_isu_uuid=%v, count=%v: %v", batch.JIAIsuUUID, len(batch.Conditions), err)
+		q.Release(batch.JIAIsuUUID, batch.Conditions)
+	}
+}
+
+// 書き込みを諦めたバッチを dead letter のファイルに書き出す
+func (q *ConditionQueue) deadLetter(batch ConditionBatch, cause error) {
+	log.Errorf("dead letter isu condition: jia_isu_uuid=%v, count=%v, attempts=%v: %v", batch.JIAIsuUUID, len(batch.Conditions), batch.Attempts, cause)
+	atomic.AddInt64(&q.deadLetteredBatches, 1)
+	q.Release(batch.JIAIsuUUID, batch.Conditions)
+
+	line, err := json.Marshal(conditionDeadLetter{ConditionBatch: batch, Error: cause.Error(), DeadLetteredAt: time.Now()})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	q.deadLetterMu.Lock()
+	defer q.deadLetterMu.Unlock()
+	_, err = q.deadLetterFile.Write(append(line, '\n'))
+	if err != nil {
+		log.Errorf("failed to write dead letter file: %v", err)
+	}
+}
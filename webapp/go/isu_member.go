@@ -0,0 +1,74 @@
+package main
+
+// ISU の共有
+// 所有者 (isu.jia_user_id) が他のユーザーを招待し、招待されたユーザーが受け入れると isu_member に追加される。
+// viewer は ISU の情報、アイコン、グラフ、コンディションを参照でき、manager はさらにメンバーの招待と削除ができる。
+// 名前とアイコンの変更、ISU の削除は所有者だけができる。
+
+import (
+	"time"
+)
+
+const (
+	isuRoleOwner   = "owner"
+	isuRoleManager = "manager"
+	isuRoleViewer  = "viewer"
+)
+
+type IsuMember struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	JIAUserID  string    `db:"jia_user_id" json:"jia_user_id"`
+	Role       string    `db:"role" json:"role"`
+	CreatedAt  time.Time `db:"created_at" json:"-"`
+}
+
+type IsuInvitation struct {
+	ID         int64  `db:"id" json:"id"`
+	JIAIsuUUID string `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	// 招待されたユーザー
+	JIAUserID string    `db:"jia_user_id" json:"jia_user_id"`
+	Role      string    `db:"role" json:"role"`
+	InvitedBy string    `db:"invited_by" json:"invited_by"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+}
+
+type IsuInvitationWithIsu struct {
+	IsuInvitation
+	IsuName string `db:"isu_name" json:"isu_name"`
+}
+
+func isValidMemberRole(role string) bool {
+	return role == isuRoleManager || role == isuRoleViewer
+}
+
+// role のユーザーが ISU のメンバー一覧を参照できるか
+func canManageMembers(role string) bool {
+	return role == isuRoleOwner || role == isuRoleManager
+}
+
+// manager は viewer だけを招待でき、manager を招待できるのは所有者だけ
+func canInviteAs(role string, invitedRole string) bool {
+	switch role {
+	case isuRoleOwner:
+		return true
+	case isuRoleManager:
+		return invitedRole == isuRoleViewer
+	default:
+		return false
+	}
+}
+
+// メンバーを外せるか。自分自身はいつでも外れられ、manager は viewer だけを外せる
+func canRemoveMember(jiaUserID string, role string, target IsuMember) bool {
+	if target.JIAUserID == jiaUserID {
+		return true
+	}
+	switch role {
+	case isuRoleOwner:
+		return true
+	case isuRoleManager:
+		return target.Role == isuRoleViewer
+	default:
+		return false
+	}
+}
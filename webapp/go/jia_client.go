@@ -0,0 +1,209 @@
+package main
+
+// JIA のサービスのクライアント
+// 呼び出し毎にタイムアウトを設け、接続エラー、タイムアウト、502, 503, 504 は間隔を空けて数回まで再試行する。
+// activate と deactivate は JIA 側で冪等なので、再試行で二重に activate されることはない。
+// 再試行しても失敗する呼び出しが続いたらサーキットブレーカーを開き、しばらくは JIA を呼ばずに
+// errJIAServiceUnavailable を返す (ハンドラは 503 を返す)。開いてから jiaCircuitOpenDuration 経つと一件だけ試し、成功すれば閉じる。
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJIAServiceTimeoutMillis = 5000
+	defaultJIAServiceMaxRetries    = 2
+	jiaRetryBaseInterval           = 100 * time.Millisecond
+	// 連続してこの回数失敗したらサーキットブレーカーを開く
+	jiaCircuitFailureThreshold = 5
+	jiaCircuitOpenDuration     = 10 * time.Second
+)
+
+var errJIAServiceUnavailable = errors.New("JIAService is unavailable")
+
+type JIAClient struct {
+	client     *http.Client
+	maxRetries int
+
+	mu sync.Mutex
+	// 連続して失敗した呼び出しの数
+	failures int
+	// ゼロ値でなければサーキットブレーカーが開いている
+	openedAt time.Time
+	// 開いている間に試している呼び出しがあれば true
+	probing bool
+}
+
+func NewJIAClient(timeout time.Duration, maxRetries int) *JIAClient {
+	return &JIAClient{
+		client:     &http.Client{Timeout: timeout},
+		maxRetries: maxRetries,
+	}
+}
+
+func NewJIAClientFromEnv() (*JIAClient, error) {
+	timeoutMillis, err := strconv.Atoi(getEnv("JIA_SERVICE_TIMEOUT_MS", strconv.Itoa(defaultJIAServiceTimeoutMillis)))
+	if err != nil {
+		return nil, fmt.Errorf("bad format: JIA_SERVICE_TIMEOUT_MS: %v", err)
+	}
+	maxRetries, err := strconv.Atoi(getEnv("JIA_SERVICE_MAX_RETRIES", strconv.Itoa(defaultJIAServiceMaxRetries)))
+	if err != nil {
+		return nil, fmt.Errorf("bad format: JIA_SERVICE_MAX_RETRIES: %v", err)
+	}
+	return NewJIAClient(time.Duration(timeoutMillis)*time.Millisecond, maxRetries), nil
+}
+
+// JIAのサービスにISUをactivateし、ISUの性格とコンディションの署名に使う secret を取得
+func (c *JIAClient) Activate(ctx context.Context, jiaServiceURL string, targetBaseURL string, jiaIsuUUID string) (IsuFromJIA, error) {
+	start := time.Now()
+	resBody, err := c.post(ctx, jiaServiceURL+"/api/activate", JIAServiceRequest{targetBaseURL, jiaIsuUUID}, http.StatusAccepted)
+	metrics.ObserveJIARequest("activate", start, err)
+	if err != nil {
+		return IsuFromJIA{}, err
+	}
+
+	var isuFromJIA IsuFromJIA
+	err = json.Unmarshal(resBody, &isuFromJIA)
+	if err != nil {
+		return IsuFromJIA{}, err
+	}
+	if isuFromJIA.ConditionSecret == "" {
+		return IsuFromJIA{}, fmt.Errorf("JIAService returned no condition secret")
+	}
+	return isuFromJIA, nil
+}
+
+// JIAのサービスにISUをdeactivateし、コンディションの送信を止める
+func (c *JIAClient) Deactivate(ctx context.Context, jiaServiceURL string, jiaIsuUUID string) error {
+	start := time.Now()
+	_, err := c.post(ctx, jiaServiceURL+"/api/deactivate", JIADeactivationRequest{jiaIsuUUID}, 0)
+	metrics.ObserveJIARequest("deactivate", start, err)
+	return err
+}
+
+// サーキットブレーカーを閉じて失敗の数を数え直す
+func (c *JIAClient) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = 0
+	c.openedAt = time.Time{}
+	c.probing = false
+}
+
+// body を JSON で POST し、レスポンスボディを返す。expectedStatus が 0 なら 2xx を成功とする。
+// ctx はトレースにだけ使い、リクエストのキャンセルには使わない
+func (c *JIAClient) post(ctx context.Context, targetURL string, body interface{}, expectedStatus int) ([]byte, error) {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.allow() {
+		return nil, errJIAServiceUnavailable
+	}
+
+	for attempt := 0; ; attempt++ {
+		resBody, retryable, err := c.do(ctx, targetURL, bodyJSON, expectedStatus, attempt)
+		if err == nil || !retryable {
+			// JIA がエラーを返したときも JIA には届いているので成功として数える
+			c.record(true)
+			return resBody, err
+		}
+		if attempt >= c.maxRetries {
+			c.record(false)
+			return nil, err
+		}
+		time.Sleep(jiaRetryBaseInterval << uint(attempt))
+	}
+}
+
+// 一回だけリクエストする。再試行してよい失敗なら retryable を true にする
+func (c *JIAClient) do(ctx context.Context, targetURL string, bodyJSON []byte, expectedStatus int, attempt int) (resBody []byte, retryable bool, err error) {
+	reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		return nil, false, err
+	}
+	reqJIA.Header.Set("Content-Type", "application/json")
+
+	ctx, span := startSpan(ctx, "JIAService POST "+reqJIA.URL.Path, spanKindClient)
+	span.SetAttribute("http.method", http.MethodPost)
+	span.SetAttribute("http.url", targetURL)
+	span.SetAttribute("jia.attempt", attempt)
+	defer func() { span.End(err) }()
+	if traceparent := traceparentFromContext(ctx); traceparent != "" {
+		reqJIA.Header.Set(traceparentHeader, traceparent)
+	}
+
+	res, err := c.client.Do(reqJIA)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to request to JIAService: %v", err)
+	}
+	defer res.Body.Close()
+	span.SetAttribute("http.status_code", res.StatusCode)
+
+	resBody, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read response from JIAService: %v", err)
+	}
+
+	if (expectedStatus != 0 && res.StatusCode != expectedStatus) ||
+		(expectedStatus == 0 && (res.StatusCode < 200 || 300 <= res.StatusCode)) {
+		retryable := res.StatusCode == http.StatusBadGateway ||
+			res.StatusCode == http.StatusServiceUnavailable ||
+			res.StatusCode == http.StatusGatewayTimeout
+		return nil, retryable, &JIAServiceError{StatusCode: res.StatusCode, Message: string(resBody)}
+	}
+	return resBody, false, nil
+}
+
+// サーキットブレーカーが開いていれば false を返す。開いてから時間が経っていれば一件だけ通す
+func (c *JIAClient) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openedAt.IsZero() {
+		return true
+	}
+	if c.probing || time.Since(c.openedAt) < jiaCircuitOpenDuration {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+func (c *JIAClient) record(succeeded bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+	if succeeded {
+		c.failures = 0
+		c.openedAt = time.Time{}
+		return
+	}
+	c.failures++
+	if !c.openedAt.IsZero() || c.failures >= jiaCircuitFailureThreshold {
+		c.openedAt = time.Now()
+	}
+}
+
+// サーキットブレーカーが開いているときに次に試すまでの秒数
+func (c *JIAClient) retryAfterSeconds() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openedAt.IsZero() {
+		return 0
+	}
+	remaining := jiaCircuitOpenDuration - time.Since(c.openedAt)
+	if remaining <= 0 {
+		return 1
+	}
+	return int((remaining + time.Second - 1) / time.Second)
+}
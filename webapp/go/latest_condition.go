@@ -0,0 +1,32 @@
+package main
+
+// ISU毎の最新のコンディション (isu_latest_condition)
+// isu_condition への書き込みと同じトランザクションで更新し、
+// GET /api/isu と GET /api/trend はこのテーブルだけを参照する。
+
+import (
+	"time"
+)
+
+type IsuLatestCondition struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	Timestamp  time.Time `db:"timestamp"`
+	IsSitting  bool      `db:"is_sitting"`
+	Condition  string    `db:"condition"`
+	Message    string    `db:"message"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+// 書き込むコンディションのうち ISU 毎に最新のものを取り出す
+func latestConditions(batches []ConditionBatch) map[string]PostIsuConditionRequest {
+	latest := map[string]PostIsuConditionRequest{}
+	for _, batch := range batches {
+		for _, cond := range batch.Conditions {
+			current, ok := latest[batch.JIAIsuUUID]
+			if !ok || current.Timestamp <= cond.Timestamp {
+				latest[batch.JIAIsuUUID] = cond
+			}
+		}
+	}
+	return latest
+}
@@ -2,25 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
-	"sort"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
-	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
@@ -33,22 +35,38 @@ const (
 	jiaJWTSigningKeyPath        = "../ec256-public.pem"
 	defaultIconFilePath         = "../NoImage.jpg"
 	defaultJIAServiceURL        = "http://localhost:5000"
-	mysqlErrNumDuplicateEntry   = 1062
 	conditionLevelInfo          = "info"
 	conditionLevelWarning       = "warning"
 	conditionLevelCritical      = "critical"
 	scoreConditionLevelInfo     = 3
 	scoreConditionLevelWarning  = 2
 	scoreConditionLevelCritical = 1
+
+	conditionStreamKeepAliveInterval = 15 * time.Second
+	conditionStreamResumeLimit       = 1000
+
+	defaultShutdownTimeoutMillis = 10000
 )
 
 var (
-	db                  *sqlx.DB
-	sessionStore        sessions.Store
-	mySQLConnectionData *MySQLConnectionEnv
+	repo         Repository
+	sessionStore sessions.Store
 
 	jiaJWTSigningKey *ecdsa.PublicKey
 
+	conditionSchema *ConditionSchema
+	conditionQueue  *ConditionQueue
+	conditionHub    *ConditionHub
+	alertManager    *AlertManager
+	importManager   *ImportManager
+	isuIconCache    *IsuIconCache
+	jiaClient       *JIAClient
+	isuActivator    *IsuActivator
+	metrics         *Metrics
+	tracer          *Tracer
+
+	conditionIdempotency *IdempotencyCache
+
 	postIsuConditionTargetBaseURL string // JIAへのactivate時に登録する，ISUがconditionを送る先のURL
 )
 
@@ -66,10 +84,15 @@ type Isu struct {
 	JIAUserID  string    `db:"jia_user_id" json:"-"`
 	CreatedAt  time.Time `db:"created_at" json:"-"`
 	UpdatedAt  time.Time `db:"updated_at" json:"-"`
+	// pending, active, failed のいずれか
+	ActivationStatus string `db:"activation_status" json:"activation_status"`
+	// activation_status が failed のときの理由
+	ActivationError string `db:"activation_error" json:"activation_error,omitempty"`
 }
 
 type IsuFromJIA struct {
-	Character string `json:"character"`
+	Character       string `json:"character"`
+	ConditionSecret string `json:"condition_secret"`
 }
 
 type GetIsuListResponse struct {
@@ -88,26 +111,35 @@ type IsuCondition struct {
 	Condition  string    `db:"condition"`
 	Message    string    `db:"message"`
 	CreatedAt  time.Time `db:"created_at"`
-}
-
-type MySQLConnectionEnv struct {
-	Host     string
-	Port     string
-	User     string
-	DBName   string
-	Password string
+	// INVISIBLE な生成列のため明示的に SELECT したときだけ埋まる
+	ConditionLevel string `db:"condition_level"`
 }
 
 type InitializeRequest struct {
 	JIAServiceURL string `json:"jia_service_url"`
 }
 
+// エラーレスポンス (Accept で application/json を優先したとき)
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// bad_format と missing のときの対象のパラメータ
+	Field     string `json:"field,omitempty"`
+	RequestID string `json:"request_id"`
+}
+
 type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
 type GetMeResponse struct {
 	JIAUserID string `json:"jia_user_id"`
+	// グラフの区切りに使うタイムゾーン。設定していなければ null
+	Timezone *string `json:"timezone"`
+}
+
+type PutTimezoneRequest struct {
+	Timezone string `json:"timezone"`
 }
 
 type GraphResponse struct {
@@ -122,12 +154,8 @@ type GraphDataPoint struct {
 	Percentage ConditionsPercentage `json:"percentage"`
 }
 
-type ConditionsPercentage struct {
-	Sitting      int `json:"sitting"`
-	IsBroken     int `json:"is_broken"`
-	IsDirty      int `json:"is_dirty"`
-	IsOverweight int `json:"is_overweight"`
-}
+// sitting とコンディションのスキーマの各キーの割合
+type ConditionsPercentage map[string]int
 
 type GraphDataPointWithInfo struct {
 	JIAIsuUUID          string
@@ -158,6 +186,20 @@ type TrendCondition struct {
 	Timestamp int64 `json:"timestamp"`
 }
 
+type TrendHistoryResponse struct {
+	Character string              `json:"character"`
+	History   []TrendHistoryPoint `json:"history"`
+}
+
+// 区間内に送られたコンディションのコンディションレベル毎の件数
+type TrendHistoryPoint struct {
+	StartAt  int64 `json:"start_at"`
+	EndAt    int64 `json:"end_at"`
+	Info     int   `json:"info"`
+	Warning  int   `json:"warning"`
+	Critical int   `json:"critical"`
+}
+
 type PostIsuConditionRequest struct {
 	IsSitting bool   `json:"is_sitting"`
 	Condition string `json:"condition"`
@@ -165,11 +207,102 @@ type PostIsuConditionRequest struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+type PostIsuConditionResponse struct {
+	Inserted int `json:"inserted"`
+	// (jia_isu_uuid, timestamp) が既にあるか、バッチ内で重複していたもの
+	Skipped int `json:"skipped"`
+}
+
+type PostAlertRequest struct {
+	JIAIsuUUID       *string `json:"jia_isu_uuid"`
+	Character        *string `json:"character"`
+	ConditionLevel   string  `json:"condition_level"`
+	SustainedSeconds int64   `json:"sustained_seconds"`
+	WebhookURL       string  `json:"webhook_url"`
+}
+
+type PostIsuInvitationRequest struct {
+	JIAUserID string `json:"jia_user_id"`
+	Role      string `json:"role"`
+}
+
+type PostOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+type PostOrganizationMemberRequest struct {
+	JIAUserID string `json:"jia_user_id"`
+	Role      string `json:"role"`
+}
+
+type PostOrganizationIsuRequest struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+}
+
+type GetOrganizationResponse struct {
+	Organization
+	Members []OrganizationMember `json:"members"`
+	Isus    []OrganizationIsu    `json:"isus"`
+}
+
+type GetOrganizationSummaryResponse struct {
+	OrganizationID int64  `json:"organization_id"`
+	Name           string `json:"name"`
+	IsuCount       int    `json:"isu_count"`
+	// 最新のコンディションのコンディションレベル毎の ISU の数
+	ConditionLevelCounts map[string]int              `json:"condition_level_counts"`
+	Graph                []OrganizationGraphResponse `json:"graph"`
+	// その日のスコアが低い順の ISU
+	WorstIsus []OrganizationWorstIsu `json:"worst_isus"`
+}
+
+type OrganizationGraphResponse struct {
+	StartAt int64           `json:"start_at"`
+	EndAt   int64           `json:"end_at"`
+	Data    *GraphDataPoint `json:"data"`
+	// その時間にコンディションがあった ISU の数
+	IsuCount int `json:"isu_count"`
+}
+
+type OrganizationWorstIsu struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Name       string `json:"name"`
+	Score      int    `json:"score"`
+	id         int
+}
+
+type GetAlertDeliveryResponse struct {
+	ID             int64           `json:"id"`
+	AlertID        int64           `json:"alert_id"`
+	JIAIsuUUID     string          `json:"jia_isu_uuid"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"response_status"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      int64           `json:"created_at"`
+	UpdatedAt      int64           `json:"updated_at"`
+}
+
 type JIAServiceRequest struct {
 	TargetBaseURL string `json:"target_base_url"`
 	IsuUUID       string `json:"isu_uuid"`
 }
 
+type JIADeactivationRequest struct {
+	IsuUUID string `json:"isu_uuid"`
+}
+
+type JIAServiceError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *JIAServiceError) Error() string {
+	return fmt.Sprintf("JIAService returned error: status code %v, message: %v", e.StatusCode, e.Message)
+}
+
 func getEnv(key string, defaultValue string) string {
 	val := os.Getenv(key)
 	if val != "" {
@@ -178,21 +311,6 @@ func getEnv(key string, defaultValue string) string {
 	return defaultValue
 }
 
-func NewMySQLConnectionEnv() *MySQLConnectionEnv {
-	return &MySQLConnectionEnv{
-		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
-		Port:     getEnv("MYSQL_PORT", "3306"),
-		User:     getEnv("MYSQL_USER", "isucon"),
-		DBName:   getEnv("MYSQL_DBNAME", "isucondition"),
-		Password: getEnv("MYSQL_PASS", "isucon"),
-	}
-}
-
-func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true&loc=Asia%%2FTokyo", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
-	return sqlx.Open("mysql", dsn)
-}
-
 func init() {
 	sessionStore = sessions.NewCookieStore([]byte(getEnv("SESSION_KEY", "isucondition")))
 
@@ -210,24 +328,69 @@ func main() {
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(log.DEBUG)
+	e.HTTPErrorHandler = httpErrorHandler
+
+	metrics = NewMetrics()
+	var err error
+	tracer, err = NewTracerFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to create tracer: %v", err)
+		return
+	}
 
+	e.Use(middleware.RequestID())
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(metrics.Middleware)
+	e.Use(tracer.Middleware)
+
+	e.GET("/healthz", getHealthz)
+	e.GET("/readyz", getReadyz)
 
 	e.POST("/initialize", postInitialize)
 
 	e.POST("/api/auth", postAuthentication)
 	e.POST("/api/signout", postSignout)
 	e.GET("/api/user/me", getMe)
+	e.PUT("/api/user/me/timezone", putTimezone)
 	e.GET("/api/isu", getIsuList)
 	e.POST("/api/isu", postIsu)
 	e.GET("/api/isu/:jia_isu_uuid", getIsuID)
+	e.PATCH("/api/isu/:jia_isu_uuid", patchIsu)
+	e.DELETE("/api/isu/:jia_isu_uuid", deleteIsu)
 	e.GET("/api/isu/:jia_isu_uuid/icon", getIsuIcon)
 	e.GET("/api/isu/:jia_isu_uuid/graph", getIsuGraph)
+	e.GET("/api/isu/:jia_isu_uuid/export", getIsuExport)
+	e.GET("/api/export", getExport)
+	e.POST("/api/isu/:jia_isu_uuid/import", postIsuImport)
+	e.GET("/api/isu/:jia_isu_uuid/import/:import_id", getIsuImport)
+	e.GET("/api/isu/:jia_isu_uuid/member", getIsuMembers)
+	e.DELETE("/api/isu/:jia_isu_uuid/member/:jia_user_id", deleteIsuMember)
+	e.POST("/api/isu/:jia_isu_uuid/invitation", postIsuInvitation)
+	e.GET("/api/invitation", getInvitationList)
+	e.POST("/api/invitation/:invitation_id/accept", postInvitationAccept)
+	e.DELETE("/api/invitation/:invitation_id", deleteInvitation)
+	e.GET("/api/org", getOrganizationList)
+	e.POST("/api/org", postOrganization)
+	e.GET("/api/org/:organization_id", getOrganization)
+	e.POST("/api/org/:organization_id/member", postOrganizationMember)
+	e.DELETE("/api/org/:organization_id/member/:jia_user_id", deleteOrganizationMember)
+	e.POST("/api/org/:organization_id/isu", postOrganizationIsu)
+	e.DELETE("/api/org/:organization_id/isu/:jia_isu_uuid", deleteOrganizationIsu)
+	e.GET("/api/org/:organization_id/summary", getOrganizationSummary)
 	e.GET("/api/condition/:jia_isu_uuid", getIsuConditions)
+	e.GET("/api/condition/:jia_isu_uuid/stream", getIsuConditionStream)
 	e.GET("/api/trend", getTrend)
+	e.GET("/api/trend/history", getTrendHistory)
+	e.GET("/api/alert", getAlertList)
+	e.POST("/api/alert", postAlert)
+	e.GET("/api/alert/:alert_id", getAlert)
+	e.PUT("/api/alert/:alert_id", putAlert)
+	e.DELETE("/api/alert/:alert_id", deleteAlert)
+	e.GET("/api/alert/:alert_id/delivery", getAlertDeliveries)
 
 	e.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
+	e.GET("/api/condition_queue", getConditionQueue)
 
 	e.GET("/", getIndex)
 	e.GET("/isu/:jia_isu_uuid", getIndex)
@@ -236,16 +399,62 @@ func main() {
 	e.GET("/register", getIndex)
 	e.Static("/assets", frontendContentsPath+"/assets")
 
-	mySQLConnectionData = NewMySQLConnectionEnv()
+	conditionSchema, err = NewConditionSchemaFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to load condition schema: %v", err)
+		return
+	}
 
-	var err error
-	db, err = mySQLConnectionData.ConnectDB()
+	repo, err = NewRepositoryFromEnv()
 	if err != nil {
 		e.Logger.Fatalf("failed to connect db: %v", err)
 		return
 	}
-	db.SetMaxOpenConns(10)
-	defer db.Close()
+	defer repo.Close()
+
+	conditionQueue, err = NewConditionQueueFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to create condition queue: %v", err)
+		return
+	}
+	conditionHub = NewConditionHub()
+	isuIconCache, err = NewIsuIconCacheFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to create isu icon cache: %v", err)
+		return
+	}
+	conditionIdempotency = NewIdempotencyCache()
+
+	jiaClient, err = NewJIAClientFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to create JIA client: %v", err)
+		return
+	}
+
+	isuActivator, err = NewIsuActivatorFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to create isu activator: %v", err)
+		return
+	}
+	err = isuActivator.Start()
+	if err != nil {
+		e.Logger.Warnf("failed to restart isu activations: %v", err)
+	}
+
+	alertManager = NewAlertManagerFromEnv()
+	err = alertManager.RefreshRuleCount(context.Background())
+	if err != nil {
+		e.Logger.Warnf("failed to count alert rules: %v", err)
+	}
+	alertManager.Start()
+	// 書き込んだコンディションを conditionHub と alertManager に渡すので、それらの後に始める
+	conditionQueue.Start()
+
+	importManager, err = NewImportManagerFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to create import manager: %v", err)
+		return
+	}
 
 	postIsuConditionTargetBaseURL = os.Getenv("POST_ISUCONDITION_TARGET_BASE_URL")
 	if postIsuConditionTargetBaseURL == "" {
@@ -253,8 +462,75 @@ func main() {
 		return
 	}
 
+	shutdownTimeoutMillis, err := strconv.Atoi(getEnv("SHUTDOWN_TIMEOUT_MS", strconv.Itoa(defaultShutdownTimeoutMillis)))
+	if err != nil {
+		e.Logger.Fatalf("bad format: SHUTDOWN_TIMEOUT_MS: %v", err)
+		return
+	}
+
+	// METRICS_PORT を指定したときは内部向けのポートでだけ /metrics を返す
+	var metricsServer *http.Server
+	if metricsPort := getEnv("METRICS_PORT", ""); metricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		metricsServer = &http.Server{Addr: fmt.Sprintf(":%v", metricsPort), Handler: mux}
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				e.Logger.Fatal(err)
+			}
+		}()
+	} else {
+		e.GET("/metrics", echo.WrapHandler(metrics))
+	}
+
+	// 停止時は SSE の購読を終わらせないと処理中のリクエストが終わらない
+	e.Server.RegisterOnShutdown(conditionHub.Close)
+
 	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
-	e.Logger.Fatal(e.Start(serverPort))
+	go func() {
+		err := e.Start(serverPort)
+		if err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
+	sig := <-quit
+	shutdown(e, metricsServer, sig, time.Duration(shutdownTimeoutMillis)*time.Millisecond)
+}
+
+// 新しいリクエストを断り、処理中のリクエストの終了と書き込み待ちのコンディションの書き込みを timeout まで待つ
+func shutdown(e *echo.Echo, metricsServer *http.Server, sig os.Signal, timeout time.Duration) {
+	e.Logger.Infof("received %v, shutting down", sig)
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := e.Shutdown(ctx)
+	if err != nil {
+		e.Logger.Errorf("failed to drain requests: %v", err)
+	}
+	if metricsServer != nil {
+		err = metricsServer.Shutdown(ctx)
+		if err != nil {
+			e.Logger.Errorf("failed to shutdown metrics server: %v", err)
+		}
+	}
+
+	err = conditionQueue.Shutdown(ctx)
+	if err != nil {
+		e.Logger.Errorf("failed to flush condition queue: %v", err)
+		return
+	}
+	e.Logger.Infof("shutdown completed")
+}
+
+// DB の呼び出しをリクエストのトレースに含める Repository
+func repoFor(c echo.Context) Repository {
+	return repo.WithContext(c.Request().Context())
 }
 
 func getSession(r *http.Request) (*sessions.Session, error) {
@@ -276,31 +552,28 @@ func getUserIDFromSession(c echo.Context) (string, int, error) {
 	}
 
 	jiaUserID := _jiaUserID.(string)
-	var count int
 
-	err = db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?",
-		jiaUserID)
+	exists, err := repoFor(c).UserExists(jiaUserID)
 	if err != nil {
 		return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
 	}
 
-	if count == 0 {
+	if !exists {
 		return "", http.StatusUnauthorized, fmt.Errorf("not found: user")
 	}
 
 	return jiaUserID, 0, nil
 }
 
-func getJIAServiceURL(tx *sqlx.Tx) string {
-	var config Config
-	err := tx.Get(&config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
+func getJIAServiceURL(ctx context.Context) string {
+	url, err := repo.WithContext(ctx).GetJIAServiceURL()
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			log.Print(err)
 		}
 		return defaultJIAServiceURL
 	}
-	return config.URL
+	return url
 }
 
 // POST /initialize
@@ -309,26 +582,30 @@ func postInitialize(c echo.Context) error {
 	var request InitializeRequest
 	err := c.Bind(&request)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request body")
+		return newAPIError(http.StatusBadRequest, "bad request body")
 	}
 
-	cmd := exec.Command("../sql/init.sh")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stderr
-	err = cmd.Run()
+	// 処理中は GET /readyz で 503 を返す
+	atomic.AddInt32(&initializingCount, 1)
+	defer atomic.AddInt32(&initializingCount, -1)
+
+	err = conditionQueue.Reset()
 	if err != nil {
-		c.Logger().Errorf("exec init.sh error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Errorf("failed to reset condition queue: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	_, err = db.Exec(
-		"INSERT INTO `isu_association_config` (`name`, `url`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `url` = VALUES(`url`)",
-		"jia_service_url",
-		request.JIAServiceURL,
-	)
+	alertManager.Reset()
+	importManager.Reset()
+	isuIconCache.Reset()
+	conditionIdempotency.Reset()
+	jiaClient.Reset()
+	isuActivator.Reset()
+
+	err = repoFor(c).Initialize(request.JIAServiceURL)
 	if err != nil {
-		c.Logger().Errorf("db error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Errorf("failed to initialize db: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -350,44 +627,44 @@ func postAuthentication(c echo.Context) error {
 	if err != nil {
 		switch err.(type) {
 		case *jwt.ValidationError:
-			return c.String(http.StatusForbidden, "forbidden")
+			return newAPIError(http.StatusForbidden, "forbidden")
 		default:
 			c.Logger().Error(err)
-			return c.NoContent(http.StatusInternalServerError)
+			return newAPIError(http.StatusInternalServerError, "")
 		}
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
 		c.Logger().Errorf("invalid JWT payload")
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 	jiaUserIDVar, ok := claims["jia_user_id"]
 	if !ok {
-		return c.String(http.StatusBadRequest, "invalid JWT payload")
+		return newAPIError(http.StatusBadRequest, "invalid JWT payload")
 	}
 	jiaUserID, ok := jiaUserIDVar.(string)
 	if !ok {
-		return c.String(http.StatusBadRequest, "invalid JWT payload")
+		return newAPIError(http.StatusBadRequest, "invalid JWT payload")
 	}
 
-	_, err = db.Exec("INSERT IGNORE INTO user (`jia_user_id`) VALUES (?)", jiaUserID)
+	err = repoFor(c).CreateUser(jiaUserID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	session, err := getSession(c.Request())
 	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	session.Values["jia_user_id"] = jiaUserID
 	err = session.Save(c.Request(), c.Response())
 	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	return c.NoContent(http.StatusOK)
@@ -399,24 +676,24 @@ func postSignout(c echo.Context) error {
 	_, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	session, err := getSession(c.Request())
 	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	session.Options = &sessions.Options{MaxAge: -1, Path: "/"}
 	err = session.Save(c.Request(), c.Response())
 	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	return c.NoContent(http.StatusOK)
@@ -428,14 +705,66 @@ func getMe(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	timezone, err := repoFor(c).GetUserTimezone(jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	res := GetMeResponse{JIAUserID: jiaUserID}
+	if timezone != "" {
+		res.Timezone = &timezone
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// PUT /api/user/me/timezone
+// グラフの区切りに使うタイムゾーン (IANA の名前) を設定する。空文字列なら設定を消す
+func putTimezone(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	var req PutTimezoneRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+	if req.Timezone != "" {
+		// グラフを1時間の区切りで集計できないタイムゾーンは設定させない
+		loc, err := loadGraphLocation(req.Timezone)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "bad format: timezone")
+		}
+		err = checkGraphLocationAligned(loc)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "bad format: timezone")
 		}
+	}
 
+	err = repoFor(c).SetUserTimezone(jiaUserID, req.Timezone)
+	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	res := GetMeResponse{JIAUserID: jiaUserID}
+	if req.Timezone != "" {
+		res.Timezone = &req.Timezone
+	}
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -445,51 +774,33 @@ func getIsuList(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	tx, err := db.Beginx()
+	isuList, err := repoFor(c).GetIsuListByUser(jiaUserID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
-	defer tx.Rollback()
 
-	isuList := []Isu{}
-	err = tx.Select(
-		&isuList,
-		"SELECT * FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC",
-		jiaUserID)
+	latestConditions, err := repoFor(c).GetLatestConditionsByUser(jiaUserID)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	responseList := []GetIsuListResponse{}
 	for _, isu := range isuList {
-		var lastCondition IsuCondition
-		foundLastCondition := true
-		err = tx.Get(&lastCondition, "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` DESC LIMIT 1",
-			isu.JIAIsuUUID)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				foundLastCondition = false
-			} else {
-				c.Logger().Errorf("db error: %v", err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-		}
-
 		var formattedCondition *GetIsuConditionResponse
-		if foundLastCondition {
-			conditionLevel, err := calculateConditionLevel(lastCondition.Condition)
+		if lastCondition, ok := latestConditions[isu.JIAIsuUUID]; ok {
+			conditionLevel, err := conditionSchema.Level(lastCondition.Condition)
 			if err != nil {
 				c.Logger().Error(err)
-				return c.NoContent(http.StatusInternalServerError)
+				return newAPIError(http.StatusInternalServerError, "")
 			}
 
 			formattedCondition = &GetIsuConditionResponse{
@@ -512,12 +823,6 @@ func getIsuList(c echo.Context) error {
 		responseList = append(responseList, res)
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
 	return c.JSON(http.StatusOK, responseList)
 }
 
@@ -527,11 +832,11 @@ func postIsu(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	useDefaultImage := false
@@ -541,7 +846,7 @@ func postIsu(c echo.Context) error {
 	fh, err := c.FormFile("image")
 	if err != nil {
 		if !errors.Is(err, http.ErrMissingFile) {
-			return c.String(http.StatusBadRequest, "bad format: icon")
+			return newAPIError(http.StatusBadRequest, "bad format: icon")
 		}
 		useDefaultImage = true
 	}
@@ -552,107 +857,101 @@ func postIsu(c echo.Context) error {
 		image, err = ioutil.ReadFile(defaultIconFilePath)
 		if err != nil {
 			c.Logger().Error(err)
-			return c.NoContent(http.StatusInternalServerError)
+			return newAPIError(http.StatusInternalServerError, "")
 		}
 	} else {
 		file, err := fh.Open()
 		if err != nil {
 			c.Logger().Error(err)
-			return c.NoContent(http.StatusInternalServerError)
+			return newAPIError(http.StatusInternalServerError, "")
 		}
 		defer file.Close()
 
 		image, err = ioutil.ReadAll(file)
 		if err != nil {
 			c.Logger().Error(err)
-			return c.NoContent(http.StatusInternalServerError)
+			return newAPIError(http.StatusInternalServerError, "")
 		}
 	}
 
-	tx, err := db.Beginx()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer tx.Rollback()
-
-	_, err = tx.Exec("INSERT INTO `isu`"+
-		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`) VALUES (?, ?, ?, ?)",
-		jiaIsuUUID, isuName, image, jiaUserID)
+	// JIA の呼び出しを待つ間に接続とロックを持たないよう、activate はトランザクションの外で行う
+	err = repoFor(c).CreateIsu(jiaIsuUUID, isuName, image, jiaUserID, isuActivator.Async())
 	if err != nil {
-		mysqlErr, ok := err.(*mysql.MySQLError)
-
-		if ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
-			return c.String(http.StatusConflict, "duplicated: isu")
+		if errors.Is(err, errIsuDuplicated) {
+			return newAPIError(http.StatusConflict, "duplicated: isu")
 		}
 
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	targetURL := getJIAServiceURL(tx) + "/api/activate"
-	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
-	bodyJSON, err := json.Marshal(body)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+	if isuActivator.Async() {
+		err = isuActivator.Enqueue(c.Request().Context(), jiaUserID, jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+		isu, err := repoFor(c).GetPendingIsu(jiaUserID, jiaIsuUUID)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				c.Logger().Errorf("db error: %v", err)
+				return newAPIError(http.StatusInternalServerError, "")
+			}
+			// 返す前に activate が終わっていた
+			isu, err = repoFor(c).GetIsu(jiaUserID, jiaIsuUUID)
+			if err != nil {
+				c.Logger().Errorf("db error: %v", err)
+				return newAPIError(http.StatusInternalServerError, "")
+			}
+		}
+		c.Response().Header().Set(echo.HeaderLocation, "/api/isu/"+jiaIsuUUID)
+		return c.JSON(http.StatusAccepted, isu)
 	}
 
-	reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewBuffer(bodyJSON))
+	jiaServiceURL := getJIAServiceURL(c.Request().Context())
+	isuFromJIA, err := jiaClient.Activate(c.Request().Context(), jiaServiceURL, postIsuConditionTargetBaseURL, jiaIsuUUID)
 	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		cancelIsuRegistration(c, jiaServiceURL, jiaUserID, jiaIsuUUID, false)
+		return respondJIAServiceError(err)
 	}
 
-	reqJIA.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(reqJIA)
+	isu, err := repoFor(c).ActivateIsu(jiaUserID, jiaIsuUUID, isuFromJIA)
 	if err != nil {
-		c.Logger().Errorf("failed to request to JIAService: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Errorf("db error: %v", err)
+		cancelIsuRegistration(c, jiaServiceURL, jiaUserID, jiaIsuUUID, true)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
-	defer res.Body.Close()
 
-	resBody, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
+	isuIconCache.Set(jiaIsuUUID, jiaUserID, image, isu.UpdatedAt)
 
-	if res.StatusCode != http.StatusAccepted {
-		c.Logger().Errorf("JIAService returned error: status code %v, message: %v", res.StatusCode, string(resBody))
-		return c.String(res.StatusCode, "JIAService returned error")
-	}
+	return c.JSON(http.StatusCreated, isu)
+}
 
-	var isuFromJIA IsuFromJIA
-	err = json.Unmarshal(resBody, &isuFromJIA)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+// activate できなかった ISU の登録を取り消す。deactivate が true なら JIA のサービスでも deactivate する
+func cancelIsuRegistration(c echo.Context, jiaServiceURL string, jiaUserID string, jiaIsuUUID string, deactivate bool) {
+	if deactivate {
+		if err := jiaClient.Deactivate(c.Request().Context(), jiaServiceURL, jiaIsuUUID); err != nil {
+			c.Logger().Errorf("failed to deactivate isu %v: %v", jiaIsuUUID, err)
+		}
 	}
-
-	_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE  `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	if err := repoFor(c).DeleteIsu(jiaUserID, jiaIsuUUID); err != nil {
+		c.Logger().Errorf("failed to delete isu %v: %v", jiaIsuUUID, err)
 	}
+}
 
-	var isu Isu
-	err = tx.Get(
-		&isu,
-		"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+// JIA のサービスの呼び出しの失敗をレスポンスにする
+func respondJIAServiceError(err error) error {
+	if errors.Is(err, errJIAServiceUnavailable) {
+		apiErr := newAPIError(http.StatusServiceUnavailable, "JIAService is unavailable")
+		apiErr.retryAfter = jiaClient.retryAfterSeconds()
+		return apiErr
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	var jiaErr *JIAServiceError
+	if errors.As(err, &jiaErr) {
+		return newAPIError(jiaErr.StatusCode, "JIAService returned error")
 	}
-
-	return c.JSON(http.StatusCreated, isu)
+	return newAPIError(http.StatusInternalServerError, "")
 }
 
 // GET /api/isu/:jia_isu_uuid
@@ -661,602 +960,2111 @@ func getIsuID(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
-	var res Isu
-	err = db.Get(&res, "SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	res, err := repoFor(c).GetIsu(jiaUserID, jiaIsuUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// activate 前の ISU は所有者にだけ activation_status を見せる
+		res, err = repoFor(c).GetPendingIsu(jiaUserID, jiaIsuUUID)
+	}
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return c.String(http.StatusNotFound, "not found: isu")
+			return newAPIError(http.StatusNotFound, "not found: isu")
 		}
 
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	return c.JSON(http.StatusOK, res)
 }
 
-// GET /api/isu/:jia_isu_uuid/icon
-// ISUのアイコンを取得
-func getIsuIcon(c echo.Context) error {
+// PATCH /api/isu/:jia_isu_uuid
+// ISUの名前とアイコンを変更
+func patchIsu(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
+	form, err := c.MultipartForm()
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+
+	var isuName *string
+	if values, ok := form.Value["isu_name"]; ok {
+		if len(values) != 1 || values[0] == "" {
+			return newAPIError(http.StatusBadRequest, "bad format: isu_name")
+		}
+		isuName = &values[0]
+	}
+
 	var image []byte
-	err = db.Get(&image, "SELECT `image` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	if files, ok := form.File["image"]; ok {
+		if len(files) != 1 {
+			return newAPIError(http.StatusBadRequest, "bad format: icon")
+		}
+		file, err := files[0].Open()
+		if err != nil {
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+		defer file.Close()
+
+		image, err = ioutil.ReadAll(file)
+		if err != nil {
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+	} else if c.FormValue("use_default_image") == "true" {
+		image, err = ioutil.ReadFile(defaultIconFilePath)
+		if err != nil {
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+	}
+
+	if isuName == nil && image == nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+
+	isu, err := repoFor(c).UpdateIsu(jiaUserID, jiaIsuUUID, isuName, image)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return c.String(http.StatusNotFound, "not found: isu")
+			return respondNotIsuOwner(c, jiaUserID, jiaIsuUUID)
 		}
 
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if image != nil {
+		isuIconCache.Set(jiaIsuUUID, jiaUserID, image, isu.UpdatedAt)
 	}
 
-	return c.Blob(http.StatusOK, "", image)
+	return c.JSON(http.StatusOK, isu)
 }
 
-// GET /api/isu/:jia_isu_uuid/graph
-// ISUのコンディショングラフ描画のための情報を取得
-func getIsuGraph(c echo.Context) error {
+// DELETE /api/isu/:jia_isu_uuid
+// JIAのサービスでISUをdeactivateし、ISUとそのコンディションを削除
+func deleteIsu(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
-	datetimeStr := c.QueryParam("datetime")
-	if datetimeStr == "" {
-		return c.String(http.StatusBadRequest, "missing: datetime")
-	}
-	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+
+	exists, err := repoFor(c).IsuExistsByUser(jiaUserID, jiaIsuUUID)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad format: datetime")
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !exists {
+		return deletePendingIsu(c, jiaUserID, jiaIsuUUID)
 	}
-	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
 
-	tx, err := db.Beginx()
+	err = jiaClient.Deactivate(c.Request().Context(), getJIAServiceURL(c.Request().Context()), jiaIsuUUID)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Error(err)
+		return respondJIAServiceError(err)
 	}
-	defer tx.Rollback()
 
-	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
-		jiaUserID, jiaIsuUUID)
+	err = repoFor(c).DeleteIsu(jiaUserID, jiaIsuUUID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	if count == 0 {
-		return c.String(http.StatusNotFound, "not found: isu")
+		return newAPIError(http.StatusInternalServerError, "")
 	}
+	alertManager.ForgetIsu(jiaIsuUUID)
+	isuIconCache.Delete(jiaIsuUUID)
 
-	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, date)
+	err = alertManager.RefreshRuleCount(c.Request().Context())
 	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	err = tx.Commit()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// activate 前の ISU の登録を取り消す。activate 前の ISU でなければ respondNotIsuOwner と同じレスポンスを返す
+func deletePendingIsu(c echo.Context, jiaUserID string, jiaIsuUUID string) error {
+	isu, err := repoFor(c).GetPendingIsu(jiaUserID, jiaIsuUUID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return respondNotIsuOwner(c, jiaUserID, jiaIsuUUID)
+		}
+
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	return c.JSON(http.StatusOK, res)
-}
-
-// グラフのデータ点を一日分生成
-func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Time) ([]GraphResponse, error) {
-	dataPoints := []GraphDataPointWithInfo{}
-	conditionsInThisHour := []IsuCondition{}
-	timestampsInThisHour := []int64{}
-	var startTimeInThisHour time.Time
-	var condition IsuCondition
-
-	rows, err := tx.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` ASC", jiaIsuUUID)
+	err = repoFor(c).DeleteIsu(jiaUserID, jiaIsuUUID)
 	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
-	}
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
 
-	for rows.Next() {
-		err = rows.StructScan(&condition)
-		if err != nil {
-			return nil, err
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	// 削除する直前に activate が終わっていたかもしれないので、JIA のサービスでも deactivate しておく
+	if isu.ActivationStatus == isuActivationStatusPending {
+		if err := jiaClient.Deactivate(c.Request().Context(), getJIAServiceURL(c.Request().Context()), jiaIsuUUID); err != nil {
+			c.Logger().Errorf("failed to deactivate isu %v: %v", jiaIsuUUID, err)
 		}
+	}
+	isuIconCache.Delete(jiaIsuUUID)
 
-		truncatedConditionTime := condition.Timestamp.Truncate(time.Hour)
-		if truncatedConditionTime != startTimeInThisHour {
-			if len(conditionsInThisHour) > 0 {
-				data, err := calculateGraphDataPoint(conditionsInThisHour)
-				if err != nil {
-					return nil, err
-				}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 所有者だけができる操作で、共有されているユーザーには 403、それ以外には 404 を返す
+func respondNotIsuOwner(c echo.Context, jiaUserID string, jiaIsuUUID string) error {
+	_, err := repoFor(c).GetIsuRole(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	return newAPIError(http.StatusForbidden, "forbidden")
+}
+
+// GET /api/isu/:jia_isu_uuid/icon
+// ISUのアイコンを取得
+func getIsuIcon(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	icon, ok := isuIconCache.Get(jiaIsuUUID)
+	if !ok {
+		res, err := repoFor(c).GetIsuIcon(jiaIsuUUID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return newAPIError(http.StatusNotFound, "not found: isu")
+			}
+
+			c.Logger().Errorf("db error: %v", err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+		icon = isuIconCache.Load(jiaIsuUUID, res.JIAUserID, res.Image, res.UpdatedAt)
+	}
+	// キャッシュには所有者しか持たないので、それ以外は共有されているかを確かめる
+	if icon.jiaUserID != jiaUserID {
+		_, err := repoFor(c).GetIsuRole(jiaUserID, jiaIsuUUID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return newAPIError(http.StatusNotFound, "not found: isu")
+			}
+
+			c.Logger().Errorf("db error: %v", err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+	}
+
+	// If-None-Match, If-Modified-Since の判定は http.ServeContent に任せる
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, icon.contentType)
+	header.Set("ETag", icon.etag)
+	header.Set("Cache-Control", "private, no-cache")
+	http.ServeContent(c.Response(), c.Request(), "", icon.modTime, bytes.NewReader(icon.image))
+	return nil
+}
+
+// GET /api/isu/:jia_isu_uuid/graph
+// ISUのコンディショングラフ描画のための情報を取得。resolution (hour, day, week) 毎のデータ点を range 分返す
+// tz (無ければユーザーのタイムゾーン) があればその暦の 0 時で区切る
+func getIsuGraph(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr == "" {
+		return newAPIError(http.StatusBadRequest, "missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: datetime")
+	}
+	resolutionName := c.QueryParam("resolution")
+	if resolutionName == "" {
+		resolutionName = graphResolutionHour
+	}
+	resolution, ok := graphResolutions[resolutionName]
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "bad format: resolution")
+	}
+	if rangeName := c.QueryParam("range"); rangeName != "" && rangeName != resolution.rangeName {
+		return newAPIError(http.StatusBadRequest, "bad format: range")
+	}
+
+	// tz が無ければユーザーのタイムゾーンを使う
+	timezone := c.QueryParam("tz")
+	useUserTimezone := timezone == ""
+	if useUserTimezone {
+		timezone, err = repoFor(c).GetUserTimezone(jiaUserID)
+		if err != nil {
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+	}
+	var loc *time.Location
+	if timezone != "" {
+		loc, err = loadGraphLocation(timezone)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "bad format: tz")
+		}
+	}
+	boundaries, err := resolution.boundaries(time.Unix(datetimeInt64, 0), loc)
+	if err != nil && useUserTimezone {
+		// 送られていない tz を理由に 400 を返さないよう、扱えないユーザーのタイムゾーンは無いものとする
+		boundaries, err = resolution.boundaries(time.Unix(datetimeInt64, 0), nil)
+	}
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: tz")
+	}
+
+	_, err = repoFor(c).GetIsuRole(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	res, err := generateIsuGraphResponse(c.Request().Context(), jiaIsuUUID, boundaries, resolution.name == graphResolutionHour)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// グラフのデータ点を boundaries の区間毎に生成
+// condition_timestamps は withTimestamps (resolution が hour) のときだけ返す
+func generateIsuGraphResponse(ctx context.Context, jiaIsuUUID string, boundaries []time.Time, withTimestamps bool) ([]GraphResponse, error) {
+	dataPoints, err := repo.WithContext(ctx).GetGraphHourly(jiaIsuUUID, boundaries[0], boundaries[len(boundaries)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	responseList := []GraphResponse{}
+	index := 0
+
+	for i := 0; i+1 < len(boundaries); i++ {
+		thisTime, nextTime := boundaries[i], boundaries[i+1]
+		aggregate := IsuGraphHourly{JIAIsuUUID: jiaIsuUUID, StartAt: thisTime}
+		timestamps := []int64{}
+
+		for index < len(dataPoints) && dataPoints[index].StartAt.Before(nextTime) {
+			dataPoint := dataPoints[index]
+			aggregate.merge(&dataPoint)
+			if withTimestamps {
+				timestamps, err = dataPoint.timestamps()
+				if err != nil {
+					return nil, err
+				}
+			}
+			index++
+		}
+
+		var data *GraphDataPoint
+		if aggregate.ConditionCount > 0 {
+			d := aggregate.dataPoint()
+			data = &d
+		}
+
+		resp := GraphResponse{
+			StartAt:             thisTime.Unix(),
+			EndAt:               nextTime.Unix(),
+			Data:                data,
+			ConditionTimestamps: timestamps,
+		}
+		responseList = append(responseList, resp)
+	}
+
+	return responseList, nil
+}
+
+// GET /api/condition/:jia_isu_uuid
+// ISUのコンディションを取得
+func getIsuConditions(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return newAPIError(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+
+	// limit か cursor が指定されたときは next_cursor 付きのレスポンスを返す
+	paginated := false
+	limit := conditionLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || conditionMaxLimit < limit {
+			return newAPIError(http.StatusBadRequest, "bad format: limit")
+		}
+		paginated = true
+	}
+
+	var cursor ConditionCursor
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		cursor, err = decodeConditionCursor(cursorStr)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "bad format: cursor")
+		}
+		if !paginated {
+			limit = cursor.Limit
+		}
+		paginated = true
+	} else {
+		endTimeInt64, err := strconv.ParseInt(c.QueryParam("end_time"), 10, 64)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "bad format: end_time")
+		}
+		conditionLevelCSV := c.QueryParam("condition_level")
+		if conditionLevelCSV == "" {
+			return newAPIError(http.StatusBadRequest, "missing: condition_level")
+		}
+
+		var startTimeInt64 int64
+		startTimeStr := c.QueryParam("start_time")
+		if startTimeStr != "" {
+			startTimeInt64, err = strconv.ParseInt(startTimeStr, 10, 64)
+			if err != nil {
+				return newAPIError(http.StatusBadRequest, "bad format: start_time")
+			}
+		}
+
+		cursor = ConditionCursor{
+			EndTime:        endTimeInt64,
+			ConditionLevel: strings.Split(conditionLevelCSV, ","),
+			StartTime:      startTimeInt64,
+		}
+	}
+	cursor.Limit = limit
+
+	isuName, err := repoFor(c).GetIsuName(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	conditionsResponse, nextCursor, err := getIsuConditionsFromDB(c.Request().Context(), jiaIsuUUID, cursor, isuName)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !paginated {
+		return c.JSON(http.StatusOK, conditionsResponse)
+	}
+
+	res := GetIsuConditionPageResponse{Conditions: conditionsResponse}
+	if nextCursor != nil {
+		nextCursorStr, err := nextCursor.Encode()
+		if err != nil {
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+		res.NextCursor = &nextCursorStr
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// ISUのコンディションをDBから取得
+// 取得件数が cursor.Limit に達したときは続きを取得するためのカーソルも返す
+func getIsuConditionsFromDB(ctx context.Context, jiaIsuUUID string, cursor ConditionCursor, isuName string) ([]*GetIsuConditionResponse, *ConditionCursor, error) {
+	conditions, err := repo.WithContext(ctx).GetConditions(jiaIsuUUID, cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conditionsResponse := []*GetIsuConditionResponse{}
+	for _, c := range conditions {
+		data := GetIsuConditionResponse{
+			JIAIsuUUID:     c.JIAIsuUUID,
+			IsuName:        isuName,
+			Timestamp:      c.Timestamp.Unix(),
+			IsSitting:      c.IsSitting,
+			Condition:      c.Condition,
+			ConditionLevel: c.ConditionLevel,
+			Message:        c.Message,
+		}
+		conditionsResponse = append(conditionsResponse, &data)
+	}
+
+	if len(conditions) < cursor.Limit {
+		return conditionsResponse, nil, nil
+	}
+	last := conditions[len(conditions)-1]
+	nextCursor := cursor
+	nextCursor.EndTime = last.Timestamp.Unix()
+	nextCursor.EndID = last.ID
+	return conditionsResponse, &nextCursor, nil
+}
+
+// GET /api/isu/:jia_isu_uuid/export
+// ISUの [from, to) のコンディションを全件 csv か ndjson で書き出す
+func getIsuExport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	isu, err := repoFor(c).GetIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return exportConditions(c, []Isu{isu}, jiaIsuUUID)
+}
+
+// GET /api/export
+// サインインしているユーザーの全ISUの [from, to) のコンディションを ISU 毎に書き出す
+func getExport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	isuList, err := repoFor(c).GetIsuListByUser(jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return exportConditions(c, isuList, "isucondition")
+}
+
+func exportConditions(c echo.Context, isuList []Isu, filename string) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = exportFormatCSV
+	}
+
+	startAt := time.Unix(0, 0)
+	if fromStr := c.QueryParam("from"); fromStr != "" {
+		from, err := strconv.ParseInt(fromStr, 10, 64)
+		if err != nil || from < 0 {
+			return newAPIError(http.StatusBadRequest, "bad format: from")
+		}
+		startAt = time.Unix(from, 0)
+	}
+	endAt := exportMaxTime
+	if toStr := c.QueryParam("to"); toStr != "" {
+		to, err := strconv.ParseInt(toStr, 10, 64)
+		if err != nil || to < startAt.Unix() {
+			return newAPIError(http.StatusBadRequest, "bad format: to")
+		}
+		endAt = time.Unix(to, 0)
+	}
+
+	res := c.Response()
+	w, ok := newConditionExportWriter(format, res)
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "bad format: format")
+	}
+
+	res.Header().Set(echo.HeaderContentType, w.contentType())
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, filename, format))
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	// ヘッダを送った後はステータスコードを変えられないので、失敗したらそこで打ち切る
+	err := w.writeHeader()
+	if err != nil {
+		return nil
+	}
+	for _, isu := range isuList {
+		err = exportIsuConditions(c.Request().Context(), w, isu, startAt, endAt, res.Flush)
+		if err != nil {
+			// クライアントの切断は失敗として記録しない
+			if c.Request().Context().Err() == nil {
+				c.Logger().Errorf("failed to export conditions: %v", err)
+			}
+			return nil
+		}
+	}
+	if err := w.flush(); err != nil {
+		return nil
+	}
+	res.Flush()
+	return nil
+}
+
+// POST /api/isu/:jia_isu_uuid/import
+// ISUのコンディションを NDJSON か CSV で一括で取り込む。書き込みは非同期で、進捗は Location のリソースで参照する
+func postIsuImport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	// format の指定がなければ Content-Type で判断する
+	format := c.QueryParam("format")
+	if format == "" {
+		format = importFormatNDJSON
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+			format = importFormatCSV
+		}
+	}
+	if format != importFormatCSV && format != importFormatNDJSON {
+		return newAPIError(http.StatusBadRequest, "bad format: format")
+	}
+
+	exists, err := repoFor(c).IsuExistsByUser(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !exists {
+		return newAPIError(http.StatusNotFound, "not found: isu")
+	}
+
+	status, err := importManager.Start(c.Request().Context(), jiaUserID, jiaIsuUUID, format, c.Request().Body)
+	if err != nil {
+		if errors.Is(err, errImportTooLarge) {
+			return newAPIError(http.StatusRequestEntityTooLarge, "request body is too large")
+		}
+
+		c.Logger().Errorf("failed to start import: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/isu/%s/import/%s", jiaIsuUUID, status.ID))
+	return c.JSON(http.StatusAccepted, status)
+}
+
+// GET /api/isu/:jia_isu_uuid/import/:import_id
+// 一括インポートの進捗と不正な行を取得
+func getIsuImport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	status, ok := importManager.Get(jiaUserID, c.Param("jia_isu_uuid"), c.Param("import_id"))
+	if !ok {
+		return newAPIError(http.StatusNotFound, "not found: import")
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// GET /api/isu/:jia_isu_uuid/member
+// ISUの所有者とメンバーを取得。所有者と manager だけが参照できる
+func getIsuMembers(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	isu, err := repoFor(c).GetIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	role, err := repoFor(c).GetIsuRole(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !canManageMembers(role) {
+		return newAPIError(http.StatusForbidden, "forbidden")
+	}
+
+	members, err := repoFor(c).GetIsuMembers(jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	res := []IsuMember{{JIAIsuUUID: jiaIsuUUID, JIAUserID: isu.JIAUserID, Role: isuRoleOwner}}
+	res = append(res, members...)
+	return c.JSON(http.StatusOK, res)
+}
+
+// DELETE /api/isu/:jia_isu_uuid/member/:jia_user_id
+// ISUのメンバーを外す。自分自身を外すと共有から抜ける
+func deleteIsuMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	memberUserID := c.Param("jia_user_id")
+
+	role, err := repoFor(c).GetIsuRole(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	member, err := repoFor(c).GetIsuMember(jiaIsuUUID, memberUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: member")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !canRemoveMember(jiaUserID, role, member) {
+		return newAPIError(http.StatusForbidden, "forbidden")
+	}
+
+	err = repoFor(c).DeleteIsuMember(jiaIsuUUID, memberUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: member")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/isu/:jia_isu_uuid/invitation
+// 他のユーザーをISUのメンバーに招待する。同じユーザーへの招待は role を置き換える
+func postIsuInvitation(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	var req PostIsuInvitationRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+	if req.JIAUserID == "" || req.JIAUserID == jiaUserID {
+		return newAPIError(http.StatusBadRequest, "bad format: jia_user_id")
+	}
+	if !isValidMemberRole(req.Role) {
+		return newAPIError(http.StatusBadRequest, "bad format: role")
+	}
+
+	role, err := repoFor(c).GetIsuRole(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !canInviteAs(role, req.Role) {
+		return newAPIError(http.StatusForbidden, "forbidden")
+	}
+
+	// 所有者や既にメンバーのユーザーは招待できない
+	_, err = repoFor(c).GetIsuRole(req.JIAUserID, jiaIsuUUID)
+	if err == nil {
+		return newAPIError(http.StatusConflict, "duplicated: member")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	invitation, err := repoFor(c).CreateIsuInvitation(IsuInvitation{
+		JIAIsuUUID: jiaIsuUUID,
+		JIAUserID:  req.JIAUserID,
+		Role:       req.Role,
+		InvitedBy:  jiaUserID,
+	})
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusCreated, invitation)
+}
+
+// GET /api/invitation
+// サインインしているユーザーへのISUの招待を取得
+func getInvitationList(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	invitations, err := repoFor(c).GetIsuInvitationsByUser(jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusOK, invitations)
+}
+
+// POST /api/invitation/:invitation_id/accept
+// ISUの招待を受け入れてメンバーになる
+func postInvitationAccept(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	invitationID, err := strconv.ParseInt(c.Param("invitation_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: invitation_id")
+	}
+
+	member, err := repoFor(c).AcceptIsuInvitation(jiaUserID, invitationID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: invitation")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusOK, member)
+}
+
+// DELETE /api/invitation/:invitation_id
+// ISUの招待を断る
+func deleteInvitation(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	invitationID, err := strconv.ParseInt(c.Param("invitation_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: invitation_id")
+	}
+
+	err = repoFor(c).DeleteIsuInvitation(jiaUserID, invitationID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: invitation")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/org
+// 組織を作成する。作成したユーザーが admin になる
+func postOrganization(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	var req PostOrganizationRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > organizationNameMaxLength {
+		return newAPIError(http.StatusBadRequest, "bad format: name")
+	}
+
+	org, err := repoFor(c).CreateOrganization(req.Name, jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusCreated, org)
+}
+
+// GET /api/org
+// サインインしているユーザーが所属する組織の一覧を取得
+func getOrganizationList(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	orgs, err := repoFor(c).GetOrganizationsByUser(jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusOK, orgs)
+}
+
+// GET /api/org/:organization_id
+// 組織の情報をメンバーと ISU と共に取得
+func getOrganization(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: organization_id")
+	}
+
+	org, err := repoFor(c).GetOrganization(organizationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: organization")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	members, err := repoFor(c).GetOrganizationMembers(organizationID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	isuList, err := repoFor(c).GetOrganizationIsuList(organizationID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	res := GetOrganizationResponse{
+		Organization: org,
+		Members:      members,
+		Isus:         isuList,
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// POST /api/org/:organization_id/member
+// 組織にメンバーを追加する。admin だけが追加できる
+func postOrganizationMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: organization_id")
+	}
+
+	var req PostOrganizationMemberRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+	if req.JIAUserID == "" {
+		return newAPIError(http.StatusBadRequest, "bad format: jia_user_id")
+	}
+	if req.Role == "" {
+		req.Role = organizationRoleMember
+	}
+	if !isValidOrganizationRole(req.Role) {
+		return newAPIError(http.StatusBadRequest, "bad format: role")
+	}
+
+	org, err := repoFor(c).GetOrganization(organizationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: organization")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if org.Role != organizationRoleAdmin {
+		return newAPIError(http.StatusForbidden, "forbidden")
+	}
+
+	exists, err := repoFor(c).UserExists(req.JIAUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !exists {
+		return newAPIError(http.StatusNotFound, "not found: user")
+	}
+
+	member := OrganizationMember{
+		OrganizationID: organizationID,
+		JIAUserID:      req.JIAUserID,
+		Role:           req.Role,
+	}
+	err = repoFor(c).AddOrganizationMember(member)
+	if err != nil {
+		if errors.Is(err, errOrganizationMemberDuplicated) {
+			return newAPIError(http.StatusConflict, "duplicated: member")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusCreated, member)
+}
+
+// DELETE /api/org/:organization_id/member/:jia_user_id
+// 組織からメンバーを外す。admin は誰でも、メンバーは自分自身を外せる
+func deleteOrganizationMember(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: organization_id")
+	}
+	memberUserID := c.Param("jia_user_id")
+
+	org, err := repoFor(c).GetOrganization(organizationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: organization")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !canRemoveOrganizationMember(jiaUserID, org.Role, memberUserID) {
+		return newAPIError(http.StatusForbidden, "forbidden")
+	}
+
+	// admin がいなくなる削除は受け付けない
+	members, err := repoFor(c).GetOrganizationMembers(organizationID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	adminCount := 0
+	removingAdmin := false
+	for _, member := range members {
+		if member.Role != organizationRoleAdmin {
+			continue
+		}
+		adminCount++
+		if member.JIAUserID == memberUserID {
+			removingAdmin = true
+		}
+	}
+	if removingAdmin && adminCount == 1 {
+		return newAPIError(http.StatusBadRequest, "bad request: last admin")
+	}
+
+	err = repoFor(c).DeleteOrganizationMember(organizationID, memberUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: member")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/org/:organization_id/isu
+// 組織に ISU を加える。ISU の所有者であるメンバーだけが加えられる
+func postOrganizationIsu(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: organization_id")
+	}
+
+	var req PostOrganizationIsuRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+	if req.JIAIsuUUID == "" {
+		return newAPIError(http.StatusBadRequest, "bad format: jia_isu_uuid")
+	}
+
+	_, err = repoFor(c).GetOrganization(organizationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: organization")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	exists, err := repoFor(c).IsuExistsByUser(jiaUserID, req.JIAIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if !exists {
+		return newAPIError(http.StatusNotFound, "not found: isu")
+	}
+
+	err = repoFor(c).AddOrganizationIsu(organizationID, req.JIAIsuUUID)
+	if err != nil {
+		if errors.Is(err, errOrganizationIsuDuplicated) {
+			return newAPIError(http.StatusConflict, "duplicated: isu")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// DELETE /api/org/:organization_id/isu/:jia_isu_uuid
+// 組織から ISU を外す。admin と ISU の所有者が外せる
+func deleteOrganizationIsu(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: organization_id")
+	}
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	org, err := repoFor(c).GetOrganization(organizationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: organization")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	isuList, err := repoFor(c).GetOrganizationIsuList(organizationID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	var target *OrganizationIsu
+	for i := range isuList {
+		if isuList[i].JIAIsuUUID == jiaIsuUUID {
+			target = &isuList[i]
+			break
+		}
+	}
+	if target == nil {
+		return newAPIError(http.StatusNotFound, "not found: isu")
+	}
+	if !canRemoveOrganizationIsu(jiaUserID, org.Role, *target) {
+		return newAPIError(http.StatusForbidden, "forbidden")
+	}
+
+	err = repoFor(c).DeleteOrganizationIsu(organizationID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/org/:organization_id/summary
+// 組織の ISU 全体の一日分のダッシュボードを取得
+func getOrganizationSummary(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	organizationID, err := strconv.ParseInt(c.Param("organization_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: organization_id")
+	}
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr == "" {
+		return newAPIError(http.StatusBadRequest, "missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: datetime")
+	}
+	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+
+	org, err := repoFor(c).GetOrganization(organizationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: organization")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	res, err := generateOrganizationSummary(c.Request().Context(), org, date)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// GET /api/condition/:jia_isu_uuid/stream
+// ISUの新しいコンディションを Server-Sent Events で配信
+// Last-Event-ID (コンディションの timestamp) が指定された場合はそれより新しいものを DB から再送してから配信する
+// 再送するものが conditionStreamResumeLimit 件を超える場合は再送せず、reset イベントを送ってから配信する
+func getIsuConditionStream(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return newAPIError(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+
+	conditionLevel := []string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical}
+	if conditionLevelCSV := c.QueryParam("condition_level"); conditionLevelCSV != "" {
+		conditionLevel = strings.Split(conditionLevelCSV, ",")
+	}
+	conditionLevelFilter := map[string]struct{}{}
+	for _, level := range conditionLevel {
+		conditionLevelFilter[level] = struct{}{}
+	}
+
+	// EventSource は初回接続時にヘッダを付けられないのでクエリパラメータでも受け付ける
+	lastEventIDStr := c.Request().Header.Get("Last-Event-ID")
+	if lastEventIDStr == "" {
+		lastEventIDStr = c.QueryParam("last_event_id")
+	}
+	resume := lastEventIDStr != ""
+	var lastEventID int64
+	if resume {
+		lastEventID, err = strconv.ParseInt(lastEventIDStr, 10, 64)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "bad format: Last-Event-ID")
+		}
+	}
+
+	isuName, err := repoFor(c).GetIsuName(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	// DB からの再送との間で取りこぼさないよう、先に購読しておく
+	sub := conditionHub.Subscribe(jiaIsuUUID)
+	defer conditionHub.Unsubscribe(jiaIsuUUID, sub)
+
+	backlog := []IsuCondition{}
+	truncated := false
+	if resume {
+		backlog, err = repoFor(c).GetConditionsAfter(jiaIsuUUID, time.Unix(lastEventID, 0), conditionLevel, conditionStreamResumeLimit+1)
+		if err != nil {
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+		// 再送しきれないときは再送せず、reset で GET /api/condition/:jia_isu_uuid から取り直してもらう
+		if len(backlog) > conditionStreamResumeLimit {
+			backlog = backlog[:0]
+			truncated = true
+		}
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	if truncated {
+		_, err = res.Write([]byte("event: reset\ndata: {}\n\n"))
+		if err != nil {
+			return nil
+		}
+	}
+	for _, cond := range backlog {
+		err = writeConditionEvent(res, &GetIsuConditionResponse{
+			JIAIsuUUID:     cond.JIAIsuUUID,
+			IsuName:        isuName,
+			Timestamp:      cond.Timestamp.Unix(),
+			IsSitting:      cond.IsSitting,
+			Condition:      cond.Condition,
+			ConditionLevel: cond.ConditionLevel,
+			Message:        cond.Message,
+		})
+		if err != nil {
+			return nil
+		}
+		if lastEventID < cond.Timestamp.Unix() {
+			lastEventID = cond.Timestamp.Unix()
+		}
+	}
+	res.Flush()
+
+	ticker := time.NewTicker(conditionStreamKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-sub.Overflow:
+			// 取りこぼした分はクライアントが Last-Event-ID で再接続して取り直す
+			return nil
+		case <-conditionHub.Done():
+			return nil
+		case <-ticker.C:
+			_, err = res.Write([]byte(": keepalive\n\n"))
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		case cond := <-sub.C:
+			// 再送済みのものは送らない
+			if resume && cond.Timestamp <= lastEventID {
+				continue
+			}
+			cLevel, err := conditionSchema.Level(cond.Condition)
+			if err != nil {
+				continue
+			}
+			if _, ok := conditionLevelFilter[cLevel]; !ok {
+				continue
+			}
+
+			err = writeConditionEvent(res, &GetIsuConditionResponse{
+				JIAIsuUUID:     jiaIsuUUID,
+				IsuName:        isuName,
+				Timestamp:      cond.Timestamp,
+				IsSitting:      cond.IsSitting,
+				Condition:      cond.Condition,
+				ConditionLevel: cLevel,
+				Message:        cond.Message,
+			})
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
 
-				dataPoints = append(dataPoints,
-					GraphDataPointWithInfo{
-						JIAIsuUUID:          jiaIsuUUID,
-						StartAt:             startTimeInThisHour,
-						Data:                data,
-						ConditionTimestamps: timestampsInThisHour})
-			}
+// コンディションを SSE のイベントとして書き込む。id はコンディションの timestamp
+func writeConditionEvent(w io.Writer, condition *GetIsuConditionResponse) error {
+	data, err := json.Marshal(condition)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: condition\ndata: %s\n\n", condition.Timestamp, data)
+	return err
+}
 
-			startTimeInThisHour = truncatedConditionTime
-			conditionsInThisHour = []IsuCondition{}
-			timestampsInThisHour = []int64{}
+// GET /api/trend
+// ISUの性格毎の最新のコンディション情報。character, condition_level, since, limit で絞り込める
+func getTrend(c echo.Context) error {
+	filter := trendFilter{character: c.QueryParam("character")}
+	if conditionLevelCSV := c.QueryParam("condition_level"); conditionLevelCSV != "" {
+		filter.conditionLevels = map[string]struct{}{}
+		for _, level := range strings.Split(conditionLevelCSV, ",") {
+			if _, ok := conditionLevelRank[level]; !ok {
+				return newAPIError(http.StatusBadRequest, "bad format: condition_level")
+			}
+			filter.conditionLevels[level] = struct{}{}
 		}
-		conditionsInThisHour = append(conditionsInThisHour, condition)
-		timestampsInThisHour = append(timestampsInThisHour, condition.Timestamp.Unix())
 	}
-
-	if len(conditionsInThisHour) > 0 {
-		data, err := calculateGraphDataPoint(conditionsInThisHour)
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		sinceInt64, err := strconv.ParseInt(sinceStr, 10, 64)
 		if err != nil {
-			return nil, err
+			return newAPIError(http.StatusBadRequest, "bad format: since")
+		}
+		filter.since = time.Unix(sinceInt64, 0)
+	}
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return newAPIError(http.StatusBadRequest, "bad format: limit")
 		}
+		filter.limit = limit
+	}
+
+	characterList, err := repoFor(c).GetCharacters()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
 
-		dataPoints = append(dataPoints,
-			GraphDataPointWithInfo{
-				JIAIsuUUID:          jiaIsuUUID,
-				StartAt:             startTimeInThisHour,
-				Data:                data,
-				ConditionTimestamps: timestampsInThisHour})
+	rows, err := repoFor(c).GetLatestConditionsWithIsu()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	endTime := graphDate.Add(time.Hour * 24)
-	startIndex := len(dataPoints)
-	endNextIndex := len(dataPoints)
-	for i, graph := range dataPoints {
-		if startIndex == len(dataPoints) && !graph.StartAt.Before(graphDate) {
-			startIndex = i
+	trendByCharacter := map[string]*TrendResponse{}
+	for _, character := range characterList {
+		if !filter.matchCharacter(character) {
+			continue
 		}
-		if endNextIndex == len(dataPoints) && graph.StartAt.After(endTime) {
-			endNextIndex = i
+		trendByCharacter[character] = &TrendResponse{
+			Character: character,
+			Info:      []*TrendCondition{},
+			Warning:   []*TrendCondition{},
+			Critical:  []*TrendCondition{},
 		}
 	}
 
-	filteredDataPoints := []GraphDataPointWithInfo{}
-	if startIndex < endNextIndex {
-		filteredDataPoints = dataPoints[startIndex:endNextIndex]
+	for _, row := range rows {
+		trend, ok := trendByCharacter[row.Character]
+		if !ok {
+			continue
+		}
+		if row.Timestamp.Before(filter.since) {
+			continue
+		}
+		conditionLevel, err := conditionSchema.Level(row.Condition)
+		if err != nil {
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+		if !filter.matchConditionLevel(conditionLevel) {
+			continue
+		}
+		trendCondition := TrendCondition{
+			ID:        row.ID,
+			Timestamp: row.Timestamp.Unix(),
+		}
+		switch conditionLevel {
+		case "info":
+			trend.Info = append(trend.Info, &trendCondition)
+		case "warning":
+			trend.Warning = append(trend.Warning, &trendCondition)
+		case "critical":
+			trend.Critical = append(trend.Critical, &trendCondition)
+		}
 	}
 
-	responseList := []GraphResponse{}
-	index := 0
-	thisTime := graphDate
-
-	for thisTime.Before(graphDate.Add(time.Hour * 24)) {
-		var data *GraphDataPoint
-		timestamps := []int64{}
+	res := []TrendResponse{}
+	for _, character := range characterList {
+		trend, ok := trendByCharacter[character]
+		if !ok {
+			continue
+		}
+		trend.Info = filter.sortAndLimit(trend.Info)
+		trend.Warning = filter.sortAndLimit(trend.Warning)
+		trend.Critical = filter.sortAndLimit(trend.Critical)
+		res = append(res, *trend)
+	}
 
-		if index < len(filteredDataPoints) {
-			dataWithInfo := filteredDataPoints[index]
+	return c.JSON(http.StatusOK, res)
+}
 
-			if dataWithInfo.StartAt.Equal(thisTime) {
-				data = &dataWithInfo.Data
-				timestamps = dataWithInfo.ConditionTimestamps
-				index++
-			}
+// GET /api/trend/history
+// 性格毎のコンディションレベル毎の件数を resolution (hour, day, week) で区切って range 分取得
+func getTrendHistory(c echo.Context) error {
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr == "" {
+		return newAPIError(http.StatusBadRequest, "missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: datetime")
+	}
+	resolutionName := c.QueryParam("resolution")
+	if resolutionName == "" {
+		resolutionName = graphResolutionHour
+	}
+	resolution, ok := graphResolutions[resolutionName]
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "bad format: resolution")
+	}
+	if rangeName := c.QueryParam("range"); rangeName != "" && rangeName != resolution.rangeName {
+		return newAPIError(http.StatusBadRequest, "bad format: range")
+	}
+	var loc *time.Location
+	if timezone := c.QueryParam("tz"); timezone != "" {
+		loc, err = loadGraphLocation(timezone)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "bad format: tz")
 		}
+	}
+	boundaries, err := resolution.boundaries(time.Unix(datetimeInt64, 0), loc)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: tz")
+	}
 
-		resp := GraphResponse{
-			StartAt:             thisTime.Unix(),
-			EndAt:               thisTime.Add(time.Hour).Unix(),
-			Data:                data,
-			ConditionTimestamps: timestamps,
+	characterList, err := repoFor(c).GetCharacters()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if character := c.QueryParam("character"); character != "" {
+		filtered := []string{}
+		for _, name := range characterList {
+			if name == character {
+				filtered = append(filtered, name)
+			}
 		}
-		responseList = append(responseList, resp)
+		characterList = filtered
+	}
 
-		thisTime = thisTime.Add(time.Hour)
+	rows, err := repoFor(c).GetTrendHistory(boundaries[0], boundaries[len(boundaries)-1])
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	return responseList, nil
+	return c.JSON(http.StatusOK, generateTrendHistory(characterList, rows, boundaries))
 }
 
-// 複数のISUのコンディションからグラフの一つのデータ点を計算
-func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, error) {
-	conditionsCount := map[string]int{"is_broken": 0, "is_dirty": 0, "is_overweight": 0}
-	rawScore := 0
-	for _, condition := range isuConditions {
-		badConditionsCount := 0
-
-		if !isValidConditionFormat(condition.Condition) {
-			return GraphDataPoint{}, fmt.Errorf("invalid condition format")
+// GET /api/alert
+// アラートルールの一覧を取得
+func getAlertList(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		for _, condStr := range strings.Split(condition.Condition, ",") {
-			keyValue := strings.Split(condStr, "=")
-
-			conditionName := keyValue[0]
-			if keyValue[1] == "true" {
-				conditionsCount[conditionName] += 1
-				badConditionsCount++
-			}
-		}
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
 
-		if badConditionsCount >= 3 {
-			rawScore += scoreConditionLevelCritical
-		} else if badConditionsCount >= 1 {
-			rawScore += scoreConditionLevelWarning
-		} else {
-			rawScore += scoreConditionLevelInfo
-		}
+	rules, err := repoFor(c).GetAlertRulesByUser(jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	sittingCount := 0
-	for _, condition := range isuConditions {
-		if condition.IsSitting {
-			sittingCount++
+	return c.JSON(http.StatusOK, rules)
+}
+
+// POST /api/alert
+// アラートルールを登録
+func postAlert(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	isuConditionsLength := len(isuConditions)
+	var req PostAlertRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	}
+	errStatusCode, errMessage, err := validateAlertRequest(c.Request().Context(), jiaUserID, req)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if errStatusCode != 0 {
+		return newAPIError(errStatusCode, errMessage)
+	}
 
-	score := rawScore * 100 / 3 / isuConditionsLength
+	secret, err := generateAlertSecret()
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
 
-	sittingPercentage := sittingCount * 100 / isuConditionsLength
-	isBrokenPercentage := conditionsCount["is_broken"] * 100 / isuConditionsLength
-	isOverweightPercentage := conditionsCount["is_overweight"] * 100 / isuConditionsLength
-	isDirtyPercentage := conditionsCount["is_dirty"] * 100 / isuConditionsLength
+	rule, err := repoFor(c).CreateAlertRule(AlertRule{
+		JIAUserID:        jiaUserID,
+		JIAIsuUUID:       req.JIAIsuUUID,
+		Character:        req.Character,
+		ConditionLevel:   req.ConditionLevel,
+		SustainedSeconds: req.SustainedSeconds,
+		WebhookURL:       req.WebhookURL,
+		Secret:           secret,
+	})
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
 
-	dataPoint := GraphDataPoint{
-		Score: score,
-		Percentage: ConditionsPercentage{
-			Sitting:      sittingPercentage,
-			IsBroken:     isBrokenPercentage,
-			IsOverweight: isOverweightPercentage,
-			IsDirty:      isDirtyPercentage,
-		},
+	err = alertManager.RefreshRuleCount(c.Request().Context())
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
-	return dataPoint, nil
+
+	return c.JSON(http.StatusCreated, rule)
 }
 
-// GET /api/condition/:jia_isu_uuid
-// ISUのコンディションを取得
-func getIsuConditions(c echo.Context) error {
+// GET /api/alert/:alert_id
+// アラートルールを取得
+func getAlert(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
-			return c.String(http.StatusUnauthorized, "you are not signed in")
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
 		}
 
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	jiaIsuUUID := c.Param("jia_isu_uuid")
-	if jiaIsuUUID == "" {
-		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	alertID, err := strconv.ParseInt(c.Param("alert_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: alert_id")
 	}
 
-	endTimeInt64, err := strconv.ParseInt(c.QueryParam("end_time"), 10, 64)
+	rule, err := repoFor(c).GetAlertRule(jiaUserID, alertID)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad format: end_time")
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: alert")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
-	endTime := time.Unix(endTimeInt64, 0)
-	conditionLevelCSV := c.QueryParam("condition_level")
-	if conditionLevelCSV == "" {
-		return c.String(http.StatusBadRequest, "missing: condition_level")
+
+	return c.JSON(http.StatusOK, rule)
+}
+
+// PUT /api/alert/:alert_id
+// アラートルールを更新。secret は変わらない
+func putAlert(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
-	conditionLevel := map[string]interface{}{}
-	for _, level := range strings.Split(conditionLevelCSV, ",") {
-		conditionLevel[level] = struct{}{}
+
+	alertID, err := strconv.ParseInt(c.Param("alert_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: alert_id")
 	}
 
-	startTimeStr := c.QueryParam("start_time")
-	var startTime time.Time
-	if startTimeStr != "" {
-		startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
-		if err != nil {
-			return c.String(http.StatusBadRequest, "bad format: start_time")
-		}
-		startTime = time.Unix(startTimeInt64, 0)
+	var req PostAlertRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad request body")
 	}
 
-	var isuName string
-	err = db.Get(&isuName,
-		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
-		jiaIsuUUID, jiaUserID,
-	)
+	rule, err := repoFor(c).GetAlertRule(jiaUserID, alertID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return c.String(http.StatusNotFound, "not found: isu")
+			return newAPIError(http.StatusNotFound, "not found: alert")
 		}
 
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	errStatusCode, errMessage, err := validateAlertRequest(c.Request().Context(), jiaUserID, req)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	if errStatusCode != 0 {
+		return newAPIError(errStatusCode, errMessage)
 	}
 
-	conditionsResponse, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime, conditionLimit, isuName)
+	rule.JIAIsuUUID = req.JIAIsuUUID
+	rule.Character = req.Character
+	rule.ConditionLevel = req.ConditionLevel
+	rule.SustainedSeconds = req.SustainedSeconds
+	rule.WebhookURL = req.WebhookURL
+	err = repoFor(c).UpdateAlertRule(rule)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+	alertManager.Forget(alertID)
+
+	rule, err = repoFor(c).GetAlertRule(jiaUserID, alertID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
-	return c.JSON(http.StatusOK, conditionsResponse)
-}
 
-// ISUのコンディションをDBから取得
-func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, conditionLevel map[string]interface{}, startTime time.Time,
-	limit int, isuName string) ([]*GetIsuConditionResponse, error) {
+	return c.JSON(http.StatusOK, rule)
+}
 
-	conditions := []IsuCondition{}
-	var err error
+// DELETE /api/alert/:alert_id
+// アラートルールと配信ログを削除
+func deleteAlert(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
 
-	if startTime.IsZero() {
-		err = db.Select(&conditions,
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	ORDER BY `timestamp` DESC",
-			jiaIsuUUID, endTime,
-		)
-	} else {
-		err = db.Select(&conditions,
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	AND ? <= `timestamp`"+
-				"	ORDER BY `timestamp` DESC",
-			jiaIsuUUID, endTime, startTime,
-		)
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
+
+	alertID, err := strconv.ParseInt(c.Param("alert_id"), 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
+		return newAPIError(http.StatusBadRequest, "bad format: alert_id")
 	}
 
-	conditionsResponse := []*GetIsuConditionResponse{}
-	for _, c := range conditions {
-		cLevel, err := calculateConditionLevel(c.Condition)
-		if err != nil {
-			continue
+	err = repoFor(c).DeleteAlertRule(jiaUserID, alertID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: alert")
 		}
 
-		if _, ok := conditionLevel[cLevel]; ok {
-			data := GetIsuConditionResponse{
-				JIAIsuUUID:     c.JIAIsuUUID,
-				IsuName:        isuName,
-				Timestamp:      c.Timestamp.Unix(),
-				IsSitting:      c.IsSitting,
-				Condition:      c.Condition,
-				ConditionLevel: cLevel,
-				Message:        c.Message,
-			}
-			conditionsResponse = append(conditionsResponse, &data)
-		}
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
+	alertManager.Forget(alertID)
 
-	if len(conditionsResponse) > limit {
-		conditionsResponse = conditionsResponse[:limit]
+	err = alertManager.RefreshRuleCount(c.Request().Context())
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	return conditionsResponse, nil
+	return c.NoContent(http.StatusNoContent)
 }
 
-// ISUのコンディションの文字列からコンディションレベルを計算
-func calculateConditionLevel(condition string) (string, error) {
-	var conditionLevel string
+// GET /api/alert/:alert_id/delivery
+// アラートルールの webhook の配信ログを新しい順に取得
+func getAlertDeliveries(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return newAPIError(http.StatusUnauthorized, "you are not signed in")
+		}
 
-	warnCount := strings.Count(condition, "=true")
-	switch warnCount {
-	case 0:
-		conditionLevel = conditionLevelInfo
-	case 1, 2:
-		conditionLevel = conditionLevelWarning
-	case 3:
-		conditionLevel = conditionLevelCritical
-	default:
-		return "", fmt.Errorf("unexpected warn count")
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	return conditionLevel, nil
-}
+	alertID, err := strconv.ParseInt(c.Param("alert_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "bad format: alert_id")
+	}
 
-// GET /api/trend
-// ISUの性格毎の最新のコンディション情報
-func getTrend(c echo.Context) error {
-	characterList := []Isu{}
-	err := db.Select(&characterList, "SELECT `character` FROM `isu` GROUP BY `character`")
+	_, err = repoFor(c).GetAlertRule(jiaUserID, alertID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: alert")
+		}
+
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
 
-	res := []TrendResponse{}
+	deliveries, err := repoFor(c).GetAlertDeliveries(alertID, alertDeliveryListLimit)
+	if err != nil {
+		c.Logger().Error(err)
+		return newAPIError(http.StatusInternalServerError, "")
+	}
+
+	res := make([]GetAlertDeliveryResponse, 0, len(deliveries))
+	for _, d := range deliveries {
+		res = append(res, GetAlertDeliveryResponse{
+			ID:             d.ID,
+			AlertID:        d.AlertRuleID,
+			JIAIsuUUID:     d.JIAIsuUUID,
+			Event:          d.Event,
+			Payload:        json.RawMessage(d.Payload),
+			Status:         d.Status,
+			Attempts:       d.Attempts,
+			ResponseStatus: d.ResponseStatus,
+			LastError:      d.LastError,
+			CreatedAt:      d.CreatedAt.Unix(),
+			UpdatedAt:      d.UpdatedAt.Unix(),
+		})
+	}
 
-	for _, character := range characterList {
-		isuList := []Isu{}
-		err = db.Select(&isuList,
-			"SELECT * FROM `isu` WHERE `character` = ?",
-			character.Character,
-		)
-		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
-
-		characterInfoIsuConditions := []*TrendCondition{}
-		characterWarningIsuConditions := []*TrendCondition{}
-		characterCriticalIsuConditions := []*TrendCondition{}
-		for _, isu := range isuList {
-			conditions := []IsuCondition{}
-			err = db.Select(&conditions,
-				"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY timestamp DESC",
-				isu.JIAIsuUUID,
-			)
-			if err != nil {
-				c.Logger().Errorf("db error: %v", err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
+	return c.JSON(http.StatusOK, res)
+}
 
-			if len(conditions) > 0 {
-				isuLastCondition := conditions[0]
-				conditionLevel, err := calculateConditionLevel(isuLastCondition.Condition)
-				if err != nil {
-					c.Logger().Error(err)
-					return c.NoContent(http.StatusInternalServerError)
-				}
-				trendCondition := TrendCondition{
-					ID:        isu.ID,
-					Timestamp: isuLastCondition.Timestamp.Unix(),
-				}
-				switch conditionLevel {
-				case "info":
-					characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
-				case "warning":
-					characterWarningIsuConditions = append(characterWarningIsuConditions, &trendCondition)
-				case "critical":
-					characterCriticalIsuConditions = append(characterCriticalIsuConditions, &trendCondition)
-				}
-			}
+// アラートルールのリクエストを検証し、不正なときはステータスコードとメッセージを返す
+func validateAlertRequest(ctx context.Context, jiaUserID string, req PostAlertRequest) (int, string, error) {
+	// 対象は ISU か性格のどちらか一方で指定する
+	if (req.JIAIsuUUID == nil) == (req.Character == nil) {
+		return http.StatusBadRequest, "bad format: jia_isu_uuid or character", nil
+	}
+	if req.Character != nil && *req.Character == "" {
+		return http.StatusBadRequest, "bad format: character", nil
+	}
+	if req.ConditionLevel != conditionLevelWarning && req.ConditionLevel != conditionLevelCritical {
+		return http.StatusBadRequest, "bad format: condition_level", nil
+	}
+	if req.SustainedSeconds < 0 {
+		return http.StatusBadRequest, "bad format: sustained_seconds", nil
+	}
+	webhookURL, err := url.Parse(req.WebhookURL)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return http.StatusBadRequest, "bad format: webhook_url", nil
+	}
+	// ループバックやプライベートのアドレスへは送らない
+	err = alertManager.ValidateWebhookHost(ctx, webhookURL.Hostname())
+	if err != nil {
+		return http.StatusBadRequest, "bad format: webhook_url", nil
+	}
 
+	// 共有された ISU にもルールを作れる
+	if req.JIAIsuUUID != nil {
+		_, err := repo.WithContext(ctx).GetIsuName(jiaUserID, *req.JIAIsuUUID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return http.StatusNotFound, "not found: isu", nil
+			}
+			return 0, "", fmt.Errorf("db error: %v", err)
 		}
-
-		sort.Slice(characterInfoIsuConditions, func(i, j int) bool {
-			return characterInfoIsuConditions[i].Timestamp > characterInfoIsuConditions[j].Timestamp
-		})
-		sort.Slice(characterWarningIsuConditions, func(i, j int) bool {
-			return characterWarningIsuConditions[i].Timestamp > characterWarningIsuConditions[j].Timestamp
-		})
-		sort.Slice(characterCriticalIsuConditions, func(i, j int) bool {
-			return characterCriticalIsuConditions[i].Timestamp > characterCriticalIsuConditions[j].Timestamp
-		})
-		res = append(res,
-			TrendResponse{
-				Character: character.Character,
-				Info:      characterInfoIsuConditions,
-				Warning:   characterWarningIsuConditions,
-				Critical:  characterCriticalIsuConditions,
-			})
 	}
-
-	return c.JSON(http.StatusOK, res)
+	return 0, "", nil
 }
 
 // POST /api/condition/:jia_isu_uuid
 // ISUからのコンディションを受け取る
 func postIsuCondition(c echo.Context) error {
-	// TODO: 一定割合リクエストを落としてしのぐようにしたが、本来は全量さばけるようにすべき
-	dropProbability := 0.9
-	if rand.Float64() <= dropProbability {
-		c.Logger().Warnf("drop post isu condition request")
-		return c.NoContent(http.StatusAccepted)
-	}
-
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 	if jiaIsuUUID == "" {
-		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+		return newAPIError(http.StatusBadRequest, "missing: jia_isu_uuid")
 	}
 
-	req := []PostIsuConditionRequest{}
-	err := c.Bind(&req)
+	idempotencyKey := c.Request().Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > idempotencyKeyMaxLength {
+		return newAPIError(http.StatusBadRequest, "bad format: Idempotency-Key")
+	}
+
+	// 署名の検証のため、Bind する前にリクエストボディをそのまま読んでおく
+	body, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request body")
-	} else if len(req) == 0 {
-		return c.String(http.StatusBadRequest, "bad request body")
+		return newAPIError(http.StatusBadRequest, "bad request body")
 	}
+	c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
 
-	tx, err := db.Beginx()
+	req := []PostIsuConditionRequest{}
+	err = c.Bind(&req)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusBadRequest, "bad request body")
+	} else if len(req) == 0 {
+		return newAPIError(http.StatusBadRequest, "bad request body")
 	}
-	defer tx.Rollback()
 
-	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	secret, err := repoFor(c).GetIsuConditionSecret(jiaIsuUUID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "not found: isu")
+		}
+
 		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return newAPIError(http.StatusInternalServerError, "")
 	}
-	if count == 0 {
-		return c.String(http.StatusNotFound, "not found: isu")
+	err = verifyConditionSignature(secret, c.Request().Header, body, time.Now())
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, "bad signature")
 	}
 
 	for _, cond := range req {
-		timestamp := time.Unix(cond.Timestamp, 0)
-
-		if !isValidConditionFormat(cond.Condition) {
-			return c.String(http.StatusBadRequest, "bad request body")
+		if err := validatePostIsuCondition(cond); err != nil {
+			return newAPIError(http.StatusBadRequest, "bad request body")
 		}
+	}
 
-		_, err = tx.Exec(
-			"INSERT INTO `isu_condition`"+
-				"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
-				"	VALUES (?, ?, ?, ?, ?)",
-			jiaIsuUUID, timestamp, cond.IsSitting, cond.Condition, cond.Message)
+	// 同じ Idempotency-Key のバッチは一度だけ受け付け、再送には最初のレスポンスを返す
+	if idempotencyKey != "" {
+		requestHash, err := hashConditionRequest(req)
 		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
 		}
+		key := jiaIsuUUID + "\x00" + idempotencyKey
+		entry, owner, err := conditionIdempotency.Begin(key, requestHash)
+		if err != nil {
+			if errors.Is(err, errIdempotencyKeyReused) {
+				return newAPIError(http.StatusUnprocessableEntity, "idempotency key is reused with a different request body")
+			}
 
-	}
+			c.Logger().Error(err)
+			return newAPIError(http.StatusInternalServerError, "")
+		}
+		if !owner {
+			c.Response().Header().Set("Idempotent-Replayed", "true")
+			return c.JSON(http.StatusAccepted, entry.res)
+		}
 
-	err = tx.Commit()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		res, statusCode, err := acceptIsuConditions(c.Request().Context(), jiaIsuUUID, req)
+		if statusCode != http.StatusAccepted {
+			conditionIdempotency.Abort(key, entry)
+			return respondAcceptIsuConditionsError(c, statusCode, err)
+		}
+		conditionIdempotency.Complete(key, entry, res)
+		return c.JSON(http.StatusAccepted, res)
 	}
 
-	return c.NoContent(http.StatusAccepted)
+	res, statusCode, err := acceptIsuConditions(c.Request().Context(), jiaIsuUUID, req)
+	if statusCode != http.StatusAccepted {
+		return respondAcceptIsuConditionsError(c, statusCode, err)
+	}
+	return c.JSON(http.StatusAccepted, res)
 }
 
-// ISUのコンディションの文字列がcsv形式になっているか検証
-func isValidConditionFormat(conditionStr string) bool {
-
-	keys := []string{"is_dirty=", "is_overweight=", "is_broken="}
-	const valueTrue = "true"
-	const valueFalse = "false"
-
-	idxCondStr := 0
-
-	for idxKeys, key := range keys {
-		if !strings.HasPrefix(conditionStr[idxCondStr:], key) {
-			return false
+// 既にあるもの、書き込み待ちのもの、バッチ内で重複するものを除いて書き込みキューに積む
+// SSE の配信とアラートの評価は書き込んだ後にキューが行う
+func acceptIsuConditions(ctx context.Context, jiaIsuUUID string, req []PostIsuConditionRequest) (PostIsuConditionResponse, int, error) {
+	// 先に書き込み待ちにしてから DB を確認するので、その間に書き込まれたものも DB で見つかる
+	reserved := conditionQueue.Reserve(jiaIsuUUID, req)
+	timestamps := make([]int64, 0, len(reserved))
+	for _, cond := range reserved {
+		timestamps = append(timestamps, cond.Timestamp)
+	}
+	existing, err := repo.WithContext(ctx).GetConditionTimestamps(jiaIsuUUID, timestamps)
+	if err != nil {
+		conditionQueue.Release(jiaIsuUUID, reserved)
+		return PostIsuConditionResponse{}, http.StatusInternalServerError, err
+	}
+	seen := make(map[int64]struct{}, len(existing))
+	for _, timestamp := range existing {
+		seen[timestamp] = struct{}{}
+	}
+	conditions := make([]PostIsuConditionRequest, 0, len(reserved))
+	duplicated := make([]PostIsuConditionRequest, 0, len(existing))
+	for _, cond := range reserved {
+		if _, ok := seen[cond.Timestamp]; ok {
+			duplicated = append(duplicated, cond)
+			continue
 		}
-		idxCondStr += len(key)
+		conditions = append(conditions, cond)
+	}
+	conditionQueue.Release(jiaIsuUUID, duplicated)
+	res := PostIsuConditionResponse{Inserted: len(conditions), Skipped: len(req) - len(conditions)}
+	metrics.AddConditionIngest(metricsIngestResultSkipped, res.Skipped)
+	if len(conditions) == 0 {
+		return res, http.StatusAccepted, nil
+	}
 
-		if strings.HasPrefix(conditionStr[idxCondStr:], valueTrue) {
-			idxCondStr += len(valueTrue)
-		} else if strings.HasPrefix(conditionStr[idxCondStr:], valueFalse) {
-			idxCondStr += len(valueFalse)
-		} else {
-			return false
+	err = conditionQueue.Enqueue(ConditionBatch{JIAIsuUUID: jiaIsuUUID, Conditions: conditions, traceparent: traceparentFromContext(ctx)})
+	if err != nil {
+		metrics.AddConditionIngest(metricsIngestResultDropped, len(conditions))
+		if errors.Is(err, errConditionQueueFull) {
+			return PostIsuConditionResponse{}, http.StatusServiceUnavailable, err
 		}
+		return PostIsuConditionResponse{}, http.StatusInternalServerError, err
+	}
+	metrics.AddConditionIngest(metricsIngestResultAccepted, len(conditions))
 
-		if idxKeys < (len(keys) - 1) {
-			if conditionStr[idxCondStr] != ',' {
-				return false
-			}
-			idxCondStr++
-		}
+	return res, http.StatusAccepted, nil
+}
+
+func respondAcceptIsuConditionsError(c echo.Context, statusCode int, err error) error {
+	if statusCode == http.StatusServiceUnavailable {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(conditionRetryAfterSeconds))
+		return newAPIError(http.StatusServiceUnavailable, "condition queue is full")
 	}
 
-	return (idxCondStr == len(conditionStr))
+	c.Logger().Error(err)
+	return newAPIError(statusCode, "")
+}
+
+// GET /api/condition_queue
+// コンディション書き込みキューの滞留状況を取得
+func getConditionQueue(c echo.Context) error {
+	return c.JSON(http.StatusOK, conditionQueue.Stats())
 }
 
 func getIndex(c echo.Context) error {
-	return c.File(frontendContentsPath + "/index.html")
+	indexPath := frontendContentsPath + "/index.html"
+	etag, err := staticFileETag(indexPath)
+	if err == nil {
+		c.Response().Header().Set("ETag", etag)
+		c.Response().Header().Set("Cache-Control", "no-cache")
+	}
+	return c.File(indexPath)
 }
@@ -0,0 +1,299 @@
+package main
+
+// Prometheus のメトリクス (GET /metrics)
+// ルート毎のレイテンシとステータスコード、DB のコネクションプール、コンディションの受け付け、JIA の呼び出しを
+// text exposition format で返す。METRICS_PORT を指定するとアプリとは別のポートでだけ返す。
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	metricsIngestResultAccepted = "accepted"
+	metricsIngestResultSkipped  = "skipped"
+	metricsIngestResultDropped  = "dropped"
+)
+
+// Prometheus のクライアントのデフォルトと同じ秒単位のバケット
+var metricsLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricsLatencyBuckets))
+	}
+	for i, bound := range metricsLatencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+type httpRouteKey struct {
+	method string
+	route  string
+}
+
+type httpStatusKey struct {
+	method string
+	route  string
+	status int
+}
+
+type jiaRequestKey struct {
+	operation string
+	result    string
+}
+
+type Metrics struct {
+	mu               sync.Mutex
+	httpDurations    map[httpRouteKey]*histogram
+	httpRequests     map[httpStatusKey]uint64
+	conditionIngests map[string]uint64
+	// コンディションレベル毎の書き込みキューに積んだ件数
+	conditionInserts map[string]uint64
+	jiaDurations     map[jiaRequestKey]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		httpDurations:    map[httpRouteKey]*histogram{},
+		httpRequests:     map[httpStatusKey]uint64{},
+		conditionIngests: map[string]uint64{},
+		conditionInserts: map[string]uint64{},
+		jiaDurations:     map[jiaRequestKey]*histogram{},
+	}
+}
+
+// ルート毎のレイテンシとステータスコードを数える echo のミドルウェア
+func (m *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			// レスポンスはこの後 httpErrorHandler が書くので、エラーからステータスコードを決める
+			status = errorStatusCode(err)
+		}
+		// ルーティングできなかったリクエストのパスはラベルにしない
+		route := c.Path()
+		if route == "" || err == echo.ErrNotFound {
+			route = "unmatched"
+		}
+		m.observeHTTPRequest(c.Request().Method, route, status, time.Since(start))
+		return err
+	}
+}
+
+func (m *Metrics) observeHTTPRequest(method string, route string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := httpRouteKey{method: method, route: route}
+	h, ok := m.httpDurations[key]
+	if !ok {
+		h = &histogram{}
+		m.httpDurations[key] = h
+	}
+	h.observe(duration.Seconds())
+	m.httpRequests[httpStatusKey{method: method, route: route, status: status}]++
+}
+
+// POST /api/condition/:jia_isu_uuid で受け付けた (accepted)、重複で捨てた (skipped)、キューが一杯で断った (dropped) 件数を数える
+func (m *Metrics) AddConditionIngest(result string, count int) {
+	if count == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conditionIngests[result] += uint64(count)
+}
+
+// 書き込みキューが isu_condition に書き込んだコンディションをコンディションレベル毎に数える
+func (m *Metrics) AddConditionInserts(conditions []PostIsuConditionRequest) {
+	levels := map[string]uint64{}
+	for _, cond := range conditions {
+		level, err := conditionSchema.Level(cond.Condition)
+		if err != nil {
+			continue
+		}
+		levels[level]++
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for level, count := range levels {
+		m.conditionInserts[level] += count
+	}
+}
+
+// JIA のサービスの呼び出し (再試行を含む) にかかった時間を記録する
+func (m *Metrics) ObserveJIARequest(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+		if errors.Is(err, errJIAServiceUnavailable) {
+			result = "circuit_open"
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := jiaRequestKey{operation: operation, result: result}
+	h, ok := m.jiaDurations[key]
+	if !ok {
+		h = &histogram{}
+		m.jiaDurations[key] = h
+	}
+	h.observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.render())
+}
+
+func (m *Metrics) render() []byte {
+	buf := &bytes.Buffer{}
+
+	m.mu.Lock()
+	writeMetricHeader(buf, "isucondition_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	routeKeys := make([]httpRouteKey, 0, len(m.httpDurations))
+	for key := range m.httpDurations {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		if routeKeys[i].route != routeKeys[j].route {
+			return routeKeys[i].route < routeKeys[j].route
+		}
+		return routeKeys[i].method < routeKeys[j].method
+	})
+	for _, key := range routeKeys {
+		writeHistogram(buf, "isucondition_http_request_duration_seconds",
+			[]string{"method", key.method, "route", key.route}, m.httpDurations[key])
+	}
+
+	writeMetricHeader(buf, "isucondition_http_requests_total", "counter", "HTTP requests by route and status code.")
+	statusKeys := make([]httpStatusKey, 0, len(m.httpRequests))
+	for key := range m.httpRequests {
+		statusKeys = append(statusKeys, key)
+	}
+	sort.Slice(statusKeys, func(i, j int) bool {
+		if statusKeys[i].route != statusKeys[j].route {
+			return statusKeys[i].route < statusKeys[j].route
+		}
+		if statusKeys[i].method != statusKeys[j].method {
+			return statusKeys[i].method < statusKeys[j].method
+		}
+		return statusKeys[i].status < statusKeys[j].status
+	})
+	for _, key := range statusKeys {
+		writeSample(buf, "isucondition_http_requests_total",
+			[]string{"method", key.method, "route", key.route, "status", strconv.Itoa(key.status)}, float64(m.httpRequests[key]))
+	}
+
+	writeMetricHeader(buf, "isucondition_condition_ingest_total", "counter", "Conditions posted to POST /api/condition/:jia_isu_uuid by result.")
+	for _, result := range []string{metricsIngestResultAccepted, metricsIngestResultSkipped, metricsIngestResultDropped} {
+		writeSample(buf, "isucondition_condition_ingest_total", []string{"result", result}, float64(m.conditionIngests[result]))
+	}
+
+	writeMetricHeader(buf, "isucondition_condition_inserted_total", "counter", "Conditions inserted by the write queue by condition level.")
+	for _, level := range []string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical} {
+		writeSample(buf, "isucondition_condition_inserted_total", []string{"condition_level", level}, float64(m.conditionInserts[level]))
+	}
+
+	writeMetricHeader(buf, "isucondition_jia_request_duration_seconds", "histogram", "JIAService call latency including retries.")
+	jiaKeys := make([]jiaRequestKey, 0, len(m.jiaDurations))
+	for key := range m.jiaDurations {
+		jiaKeys = append(jiaKeys, key)
+	}
+	sort.Slice(jiaKeys, func(i, j int) bool {
+		if jiaKeys[i].operation != jiaKeys[j].operation {
+			return jiaKeys[i].operation < jiaKeys[j].operation
+		}
+		return jiaKeys[i].result < jiaKeys[j].result
+	})
+	for _, key := range jiaKeys {
+		writeHistogram(buf, "isucondition_jia_request_duration_seconds",
+			[]string{"operation", key.operation, "result", key.result}, m.jiaDurations[key])
+	}
+	m.mu.Unlock()
+
+	stats := repo.DBStats()
+	for _, gauge := range []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"isucondition_db_max_open_connections", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections)},
+		{"isucondition_db_open_connections", "Number of established connections.", float64(stats.OpenConnections)},
+		{"isucondition_db_in_use_connections", "Number of connections currently in use.", float64(stats.InUse)},
+		{"isucondition_db_idle_connections", "Number of idle connections.", float64(stats.Idle)},
+	} {
+		writeMetricHeader(buf, gauge.name, "gauge", gauge.help)
+		writeSample(buf, gauge.name, nil, gauge.value)
+	}
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"isucondition_db_wait_count_total", "Total number of connections waited for.", float64(stats.WaitCount)},
+		{"isucondition_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", stats.WaitDuration.Seconds()},
+		{"isucondition_db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.", float64(stats.MaxIdleClosed)},
+		{"isucondition_db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.", float64(stats.MaxLifetimeClosed)},
+	} {
+		writeMetricHeader(buf, counter.name, "counter", counter.help)
+		writeSample(buf, counter.name, nil, counter.value)
+	}
+
+	return buf.Bytes()
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// labels は名前と値を交互に並べる
+func writeSample(buf *bytes.Buffer, name string, labels []string, value float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, `%s="%s"`, labels[i], metricsLabelReplacer.Replace(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	buf.WriteByte('\n')
+}
+
+func writeHistogram(buf *bytes.Buffer, name string, labels []string, h *histogram) {
+	for i, bound := range metricsLatencyBuckets {
+		writeSample(buf, name+"_bucket", append(labels[:len(labels):len(labels)], "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(h.counts[i]))
+	}
+	writeSample(buf, name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.count))
+	writeSample(buf, name+"_sum", labels, h.sum)
+	writeSample(buf, name+"_count", labels, float64(h.count))
+}
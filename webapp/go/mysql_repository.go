@@ -0,0 +1,118 @@
+package main
+
+// MySQL (MariaDB) 向けの sqlDialect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	mysqlErrNumDuplicateEntry = 1062
+	sqlDirPath                = "../sql"
+)
+
+type MySQLConnectionEnv struct {
+	Host     string
+	Port     string
+	User     string
+	DBName   string
+	Password string
+}
+
+func NewMySQLConnectionEnv() *MySQLConnectionEnv {
+	return &MySQLConnectionEnv{
+		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
+		Port:     getEnv("MYSQL_PORT", "3306"),
+		User:     getEnv("MYSQL_USER", "isucon"),
+		DBName:   getEnv("MYSQL_DBNAME", "isucondition"),
+		Password: getEnv("MYSQL_PASS", "isucon"),
+	}
+}
+
+func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
+	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true&loc=Asia%%2FTokyo", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
+	return sqlx.Open("mysql", dsn)
+}
+
+func NewMySQLRepository(mc *MySQLConnectionEnv) (Repository, error) {
+	db, err := mc.ConnectDB()
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(10)
+	return newSQLRepository(db, mysqlDialect{}, "mysql"), nil
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) insertIgnore() string {
+	return "INSERT IGNORE"
+}
+
+func (mysqlDialect) onDuplicateKeyUpdate(keys string) string {
+	return "	ON DUPLICATE KEY UPDATE"
+}
+
+func (mysqlDialect) excluded(column string) string {
+	return "VALUES(`" + column + "`)"
+}
+
+func (mysqlDialect) greatest(a string, b string) string {
+	return "GREATEST(" + a + ", " + b + ")"
+}
+
+func (mysqlDialect) concat(args ...string) string {
+	return "CONCAT(" + strings.Join(args, ", ") + ")"
+}
+
+func (mysqlDialect) isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry)
+}
+
+func (mysqlDialect) timeValue(t time.Time) interface{} {
+	return t
+}
+
+// init.sh と同様に 0_Schema.sql と 1_InitData.sql を流し込む
+func (mysqlDialect) resetDatabase(db *sqlx.DB) error {
+	// mysqldump の出力は SET や LOCK TABLES でセッションの状態を変えるので、同じ接続で実行する
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer conn.Close()
+
+	for _, name := range []string{"0_Schema.sql", "1_InitData.sql"} {
+		file, err := os.Open(filepath.Join(sqlDirPath, name))
+		if err != nil {
+			return err
+		}
+		err = readSQLStatements(file, func(stmt []byte) error {
+			_, err := conn.ExecContext(context.Background(), string(stmt))
+			return err
+		})
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to execute %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (mysqlDialect) alterConditionLevel(db *sqlx.DB, expr string) error {
+	_, err := db.Exec("ALTER TABLE `isu_condition` MODIFY COLUMN `condition_level` VARCHAR(16) AS (" + expr + ") STORED INVISIBLE")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+// 組織 (organization)
+// ユーザーと ISU をまとめ、GET /api/org/:organization_id/summary で組織の ISU 全体のダッシュボードを返す。
+// 組織を作ったユーザーが admin になり、admin はメンバーの追加と削除ができる。
+// ISU を組織に加えられるのはその ISU の所有者であるメンバーだけで、組織に加えても ISU の個別の参照権限は変わらない。
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+const (
+	organizationRoleAdmin  = "admin"
+	organizationRoleMember = "member"
+
+	organizationNameMaxLength = 255
+	// summary の worst_isus の件数
+	organizationWorstIsuLimit = 5
+)
+
+type Organization struct {
+	ID   int64  `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+	// サインインしているユーザーの role
+	Role      string    `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+}
+
+type OrganizationMember struct {
+	OrganizationID int64     `db:"organization_id" json:"-"`
+	JIAUserID      string    `db:"jia_user_id" json:"jia_user_id"`
+	Role           string    `db:"role" json:"role"`
+	CreatedAt      time.Time `db:"created_at" json:"-"`
+}
+
+type OrganizationIsu struct {
+	JIAIsuUUID string `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Name       string `db:"name" json:"name"`
+	Character  string `db:"character" json:"character"`
+	// ISU の所有者
+	JIAUserID string `db:"jia_user_id" json:"jia_user_id"`
+	ID        int    `db:"id" json:"-"`
+}
+
+func isValidOrganizationRole(role string) bool {
+	return role == organizationRoleAdmin || role == organizationRoleMember
+}
+
+// メンバーを外せるか。自分自身はいつでも外れられ、admin は誰でも外せる
+func canRemoveOrganizationMember(jiaUserID string, role string, targetUserID string) bool {
+	return targetUserID == jiaUserID || role == organizationRoleAdmin
+}
+
+// 組織の ISU を外せるか。admin と ISU の所有者が外せる
+func canRemoveOrganizationIsu(jiaUserID string, role string, isu OrganizationIsu) bool {
+	return isu.JIAUserID == jiaUserID || role == organizationRoleAdmin
+}
+
+// 組織のダッシュボードを graphDate から一日分生成
+// スコアと割合は ISU 毎のグラフと同じ計算 (IsuGraphHourly.dataPoint) を組織の全コンディションに対して行う
+func generateOrganizationSummary(ctx context.Context, org Organization, graphDate time.Time) (GetOrganizationSummaryResponse, error) {
+	endTime := graphDate.Add(time.Hour * 24)
+
+	isuList, err := repo.WithContext(ctx).GetOrganizationIsuList(org.ID)
+	if err != nil {
+		return GetOrganizationSummaryResponse{}, err
+	}
+	latestConditions, err := repo.WithContext(ctx).GetOrganizationLatestConditions(org.ID)
+	if err != nil {
+		return GetOrganizationSummaryResponse{}, err
+	}
+	dataPoints, err := repo.WithContext(ctx).GetOrganizationGraphHourly(org.ID, graphDate, endTime)
+	if err != nil {
+		return GetOrganizationSummaryResponse{}, err
+	}
+
+	levelCounts := map[string]int{
+		conditionLevelInfo:     0,
+		conditionLevelWarning:  0,
+		conditionLevelCritical: 0,
+	}
+	for _, isu := range isuList {
+		cond, ok := latestConditions[isu.JIAIsuUUID]
+		if !ok {
+			continue
+		}
+		conditionLevel, err := conditionSchema.Level(cond.Condition)
+		if err != nil {
+			return GetOrganizationSummaryResponse{}, err
+		}
+		levelCounts[conditionLevel]++
+	}
+
+	// 時間毎と ISU 毎にまとめる
+	hourly := map[int64]*IsuGraphHourly{}
+	isuCountByHour := map[int64]int{}
+	daily := map[string]*IsuGraphHourly{}
+	for i := range dataPoints {
+		dataPoint := &dataPoints[i]
+		if dataPoint.ConditionCount == 0 {
+			continue
+		}
+		startAt := dataPoint.StartAt.Unix()
+		if _, ok := hourly[startAt]; !ok {
+			hourly[startAt] = &IsuGraphHourly{StartAt: dataPoint.StartAt}
+		}
+		hourly[startAt].merge(dataPoint)
+		isuCountByHour[startAt]++
+
+		if _, ok := daily[dataPoint.JIAIsuUUID]; !ok {
+			daily[dataPoint.JIAIsuUUID] = &IsuGraphHourly{JIAIsuUUID: dataPoint.JIAIsuUUID, StartAt: graphDate}
+		}
+		daily[dataPoint.JIAIsuUUID].merge(dataPoint)
+	}
+
+	graph := []OrganizationGraphResponse{}
+	for thisTime := graphDate; thisTime.Before(endTime); thisTime = thisTime.Add(time.Hour) {
+		var data *GraphDataPoint
+		if aggregate, ok := hourly[thisTime.Unix()]; ok {
+			d := aggregate.dataPoint()
+			data = &d
+		}
+		graph = append(graph, OrganizationGraphResponse{
+			StartAt:  thisTime.Unix(),
+			EndAt:    thisTime.Add(time.Hour).Unix(),
+			Data:     data,
+			IsuCount: isuCountByHour[thisTime.Unix()],
+		})
+	}
+
+	worstIsus := []OrganizationWorstIsu{}
+	for _, isu := range isuList {
+		aggregate, ok := daily[isu.JIAIsuUUID]
+		if !ok {
+			continue
+		}
+		worstIsus = append(worstIsus, OrganizationWorstIsu{
+			JIAIsuUUID: isu.JIAIsuUUID,
+			Name:       isu.Name,
+			Score:      aggregate.dataPoint().Score,
+			id:         isu.ID,
+		})
+	}
+	sort.Slice(worstIsus, func(i, j int) bool {
+		if worstIsus[i].Score != worstIsus[j].Score {
+			return worstIsus[i].Score < worstIsus[j].Score
+		}
+		return worstIsus[i].id < worstIsus[j].id
+	})
+	if len(worstIsus) > organizationWorstIsuLimit {
+		worstIsus = worstIsus[:organizationWorstIsuLimit]
+	}
+
+	return GetOrganizationSummaryResponse{
+		OrganizationID:       org.ID,
+		Name:                 org.Name,
+		IsuCount:             len(isuList),
+		ConditionLevelCounts: levelCounts,
+		Graph:                graph,
+		WorstIsus:            worstIsus,
+	}, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+// 永続化層
+// ハンドラは Repository だけを参照し、MySQL か SQLite (組み込み) かは環境変数 STORAGE_BACKEND で切り替える。
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	storageBackendMySQL  = "mysql"
+	storageBackendSQLite = "sqlite"
+)
+
+var (
+	errIsuDuplicated                = errors.New("duplicated: isu")
+	errOrganizationMemberDuplicated = errors.New("duplicated: member")
+	errOrganizationIsuDuplicated    = errors.New("duplicated: isu")
+)
+
+type Repository interface {
+	// スキーマと初期データを入れ直し、集計テーブルを作り直して JIA の URL を登録する
+	Initialize(jiaServiceURL string) error
+	Close() error
+	// DB の呼び出しを ctx の span の子としてトレースする Repository を返す
+	WithContext(ctx context.Context) Repository
+	// コネクションプールの統計 (GET /metrics)
+	DBStats() sql.DBStats
+	// DB に繋がるか確かめる (GET /readyz)
+	Ping(ctx context.Context) error
+
+	GetJIAServiceURL() (string, error)
+
+	// ユーザーが存在しなければ作成する
+	CreateUser(jiaUserID string) error
+	UserExists(jiaUserID string) (bool, error)
+	// ユーザーが設定したタイムゾーン (IANA の名前) を返す。設定していなければ空文字列
+	GetUserTimezone(jiaUserID string) (string, error)
+	// 空文字列なら設定を消す
+	SetUserTimezone(jiaUserID string, timezone string) error
+
+	// GetIsuListByUser, GetIsu, GetIsuName, GetLatestConditionsByUser は所有している ISU と共有されている ISU を対象にする。
+	// ISU を参照するメソッドは CreateIsu の後 ActivateIsu の前の ISU を見つからないものとして扱う
+	GetIsuListByUser(jiaUserID string) ([]Isu, error)
+	// 見つからないときは sql.ErrNoRows を返す
+	GetIsu(jiaUserID string, jiaIsuUUID string) (Isu, error)
+	GetIsuName(jiaUserID string, jiaIsuUUID string) (string, error)
+	// ISU に対するユーザーの role (owner, manager, viewer) を返す。所有者でもメンバーでもなければ sql.ErrNoRows を返す
+	GetIsuRole(jiaUserID string, jiaIsuUUID string) (string, error)
+	GetIsuIcon(jiaIsuUUID string) (IsuIcon, error)
+	// ISU がコンディションの署名に使う secret を返す。署名の導入前に登録された ISU では空文字列。
+	// ISU が見つからないときは sql.ErrNoRows を返す
+	GetIsuConditionSecret(jiaIsuUUID string) (string, error)
+	// ユーザーが ISU の所有者なら true を返す
+	IsuExistsByUser(jiaUserID string, jiaIsuUUID string) (bool, error)
+	// ISU を activate 前の状態 (character が NULL) で登録する。既に登録済みの場合は errIsuDuplicated を返す。
+	// pending が true なら isu_activation にも pending として記録する
+	CreateIsu(jiaIsuUUID string, name string, image []byte, jiaUserID string, pending bool) error
+	// JIA のサービスで activate した ISU の性格とコンディションの署名に使う secret を記録し、isu_activation から消す。
+	// activate 前の ISU が見つからない (途中で削除された) ときは sql.ErrNoRows を返す
+	ActivateIsu(jiaUserID string, jiaIsuUUID string, isuFromJIA IsuFromJIA) (Isu, error)
+	// 所有している activate 前の ISU を activation_status と共に返す。見つからないときは sql.ErrNoRows を返す
+	GetPendingIsu(jiaUserID string, jiaIsuUUID string) (Isu, error)
+	// isu_activation の status, reason, attempts を更新する
+	UpdateIsuActivation(activation IsuActivation) error
+	// status が pending のものを登録された順に取得
+	GetPendingIsuActivations() ([]IsuActivation, error)
+	// name, image のうち nil でないものだけを更新する。見つからないときは sql.ErrNoRows を返す
+	UpdateIsu(jiaUserID string, jiaIsuUUID string, name *string, image []byte) (Isu, error)
+	// ISU とそのコンディション、集計、メンバーと招待、組織への登録、ISU を指定したアラートルールを削除する。activate 前の ISU も isu_activation と共に削除する
+	DeleteIsu(jiaUserID string, jiaIsuUUID string) error
+	GetCharacters() ([]string, error)
+
+	// 所有者を除いたメンバーを追加された順に取得
+	GetIsuMembers(jiaIsuUUID string) ([]IsuMember, error)
+	// 見つからないときは sql.ErrNoRows を返す
+	GetIsuMember(jiaIsuUUID string, jiaUserID string) (IsuMember, error)
+	// 見つからないときは sql.ErrNoRows を返す
+	DeleteIsuMember(jiaIsuUUID string, jiaUserID string) error
+	// 同じ ISU に同じユーザーへの招待があれば role と招待したユーザーを置き換える
+	CreateIsuInvitation(invitation IsuInvitation) (IsuInvitation, error)
+	// ユーザーへの招待を ISU の名前と共に新しい順に取得
+	GetIsuInvitationsByUser(jiaUserID string) ([]IsuInvitationWithIsu, error)
+	// ユーザーへの招待を受け入れて isu_member に移す。見つからないときは sql.ErrNoRows を返す
+	AcceptIsuInvitation(jiaUserID string, invitationID int64) (IsuMember, error)
+	// ユーザーへの招待を断る。見つからないときは sql.ErrNoRows を返す
+	DeleteIsuInvitation(jiaUserID string, invitationID int64) error
+
+	// 組織を作成し、作成したユーザーを admin にする
+	CreateOrganization(name string, jiaUserID string) (Organization, error)
+	// ユーザーが所属する組織を作成された順に取得
+	GetOrganizationsByUser(jiaUserID string) ([]Organization, error)
+	// ユーザーの role と共に取得する。ユーザーがメンバーでなければ sql.ErrNoRows を返す
+	GetOrganization(organizationID int64, jiaUserID string) (Organization, error)
+	GetOrganizationMembers(organizationID int64) ([]OrganizationMember, error)
+	// 既にメンバーの場合は errOrganizationMemberDuplicated を返す
+	AddOrganizationMember(member OrganizationMember) error
+	// 見つからないときは sql.ErrNoRows を返す
+	DeleteOrganizationMember(organizationID int64, jiaUserID string) error
+	GetOrganizationIsuList(organizationID int64) ([]OrganizationIsu, error)
+	// 既に組織の ISU の場合は errOrganizationIsuDuplicated を返す
+	AddOrganizationIsu(organizationID int64, jiaIsuUUID string) error
+	// 見つからないときは sql.ErrNoRows を返す
+	DeleteOrganizationIsu(organizationID int64, jiaIsuUUID string) error
+	GetOrganizationLatestConditions(organizationID int64) (map[string]IsuLatestCondition, error)
+	// 組織の全 ISU の集計を (start_at, jia_isu_uuid) の順に取得
+	GetOrganizationGraphHourly(organizationID int64, startAt time.Time, endAt time.Time) ([]IsuGraphHourly, error)
+
+	// コンディションを isu_condition に書き込み、isu_latest_condition と isu_graph_hourly を更新する。
+	// 削除済みの ISU のコンディションと、(jia_isu_uuid, timestamp) が既にあるものは捨て、書き込んだコンディションを返す
+	InsertConditions(batches []ConditionBatch) ([]ConditionBatch, error)
+	GetConditions(jiaIsuUUID string, cursor ConditionCursor) ([]IsuCondition, error)
+	// timestamp が after より新しいコンディションを古い順に limit 件取得
+	GetConditionsAfter(jiaIsuUUID string, after time.Time, conditionLevel []string, limit int) ([]IsuCondition, error)
+	// timestamps のうち既にコンディションがあるものを返す
+	GetConditionTimestamps(jiaIsuUUID string, timestamps []int64) ([]int64, error)
+	// [startAt, endAt) のコンディションを (timestamp, id) の昇順で after より後ろから limit 件取得
+	GetConditionsInRange(jiaIsuUUID string, startAt time.Time, endAt time.Time, after ConditionPosition, limit int) ([]IsuCondition, error)
+	GetLatestConditionsByUser(jiaUserID string) (map[string]IsuLatestCondition, error)
+	GetLatestConditionsWithIsu() ([]IsuLatestConditionWithIsu, error)
+	// [startAt, endAt) の isu_graph_hourly のコンディションレベル毎の件数を性格と start_at 毎に合計する
+	GetTrendHistory(startAt time.Time, endAt time.Time) ([]TrendHistoryHourly, error)
+	GetGraphHourly(jiaIsuUUID string, startAt time.Time, endAt time.Time) ([]IsuGraphHourly, error)
+
+	// 全ユーザーのルールの件数。0 件なら書き込んだコンディションの評価を省く
+	CountAlertRules() (int, error)
+	GetAlertRulesByUser(jiaUserID string) ([]AlertRule, error)
+	// 見つからないときは sql.ErrNoRows を返す
+	GetAlertRule(jiaUserID string, alertID int64) (AlertRule, error)
+	// ISU に適用されるルール (ISU の指定か、性格の指定が一致するもの) のうち、ルールのユーザーが ISU を所有しているか共有されているものを取得
+	GetAlertRulesByIsu(jiaIsuUUID string) ([]AlertRule, error)
+	CreateAlertRule(rule AlertRule) (AlertRule, error)
+	UpdateAlertRule(rule AlertRule) error
+	// ルールと配信ログを削除する
+	DeleteAlertRule(jiaUserID string, alertID int64) error
+	CreateAlertDelivery(delivery AlertDelivery) (int64, error)
+	UpdateAlertDelivery(delivery AlertDelivery) error
+	// 配信ログを新しい順に limit 件取得
+	GetAlertDeliveries(alertID int64, limit int) ([]AlertDelivery, error)
+}
+
+type IsuLatestConditionWithIsu struct {
+	ID        int       `db:"id"`
+	Character string    `db:"character"`
+	Timestamp time.Time `db:"timestamp"`
+	Condition string    `db:"condition"`
+}
+
+// (timestamp, id) の順序でのコンディションの位置。ゼロ値は先頭を表す
+type ConditionPosition struct {
+	Timestamp time.Time
+	ID        int
+}
+
+func NewRepositoryFromEnv() (Repository, error) {
+	switch backend := getEnv("STORAGE_BACKEND", storageBackendMySQL); backend {
+	case storageBackendMySQL:
+		return NewMySQLRepository(NewMySQLConnectionEnv())
+	case storageBackendSQLite:
+		return NewSQLiteRepository(getEnv("SQLITE_PATH", defaultSQLitePath))
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND: %v", backend)
+	}
+}
@@ -0,0 +1,1404 @@
+package main
+
+// database/sql で扱える RDB 向けの Repository の実装
+// MySQL と SQLite で異なる部分は sqlDialect にまとめている。
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type sqlDialect interface {
+	// 一意キーが重複する行は無視する INSERT の先頭部分
+	insertIgnore() string
+	// 一意キー keys が重複したときに続く代入を行う句
+	onDuplicateKeyUpdate(keys string) string
+	// onDuplicateKeyUpdate の代入の中で、挿入しようとした値を参照する式
+	excluded(column string) string
+	greatest(a string, b string) string
+	concat(args ...string) string
+	isDuplicateEntry(err error) bool
+	// DATETIME 列に書き込む値
+	timeValue(t time.Time) interface{}
+	// スキーマと初期データを流し込む
+	resetDatabase(db *sqlx.DB) error
+	// isu_condition.condition_level の生成列の式を置き換える
+	alterConditionLevel(db *sqlx.DB, expr string) error
+}
+
+// tracedDB と tracedTx に共通の SELECT
+type sqlSelecter interface {
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+type sqlRepository struct {
+	db      *tracedDB
+	dialect sqlDialect
+}
+
+func newSQLRepository(db *sqlx.DB, dialect sqlDialect, system string) *sqlRepository {
+	return &sqlRepository{db: &tracedDB{DB: db, ctx: context.Background(), system: system}, dialect: dialect}
+}
+
+func (r *sqlRepository) WithContext(ctx context.Context) Repository {
+	if spanFromContext(ctx) == nil {
+		return r
+	}
+	return &sqlRepository{db: &tracedDB{DB: r.db.DB, ctx: ctx, system: r.db.system}, dialect: r.dialect}
+}
+
+func (r *sqlRepository) Initialize(jiaServiceURL string) error {
+	err := r.dialect.resetDatabase(r.db.DB)
+	if err != nil {
+		return err
+	}
+
+	// 0_Schema.sql の生成列は既定のコンディションのスキーマの規則なので、それ以外なら作り直す
+	if !conditionSchema.isDefault() {
+		err = r.dialect.alterConditionLevel(r.db.DB, conditionSchema.levelExpr(r.dialect))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = r.rebuildLatestConditions()
+	if err != nil {
+		return err
+	}
+
+	err = r.rebuildGraphHourly()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(
+		"INSERT INTO `isu_association_config` (`name`, `url`) VALUES (?, ?)"+
+			r.dialect.onDuplicateKeyUpdate("`name`")+
+			"	`url` = "+r.dialect.excluded("url"),
+		"jia_service_url",
+		jiaServiceURL,
+	)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *sqlRepository) DBStats() sql.DBStats {
+	return r.db.Stats()
+}
+
+func (r *sqlRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r *sqlRepository) GetJIAServiceURL() (string, error) {
+	var config Config
+	err := r.db.Get(&config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
+	if err != nil {
+		return "", err
+	}
+	return config.URL, nil
+}
+
+func (r *sqlRepository) CreateUser(jiaUserID string) error {
+	_, err := r.db.Exec(r.dialect.insertIgnore()+" INTO `user` (`jia_user_id`) VALUES (?)", jiaUserID)
+	return err
+}
+
+func (r *sqlRepository) UserExists(jiaUserID string) (bool, error) {
+	var count int
+	err := r.db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?",
+		jiaUserID)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *sqlRepository) GetUserTimezone(jiaUserID string) (string, error) {
+	var timezone string
+	err := r.db.Get(&timezone, "SELECT `timezone` FROM `user_preference` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("db error: %v", err)
+	}
+	return timezone, nil
+}
+
+func (r *sqlRepository) SetUserTimezone(jiaUserID string, timezone string) error {
+	if timezone == "" {
+		_, err := r.db.Exec("DELETE FROM `user_preference` WHERE `jia_user_id` = ?", jiaUserID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		return nil
+	}
+
+	_, err := r.db.Exec(
+		"INSERT INTO `user_preference` (`jia_user_id`, `timezone`) VALUES (?, ?)"+
+			r.dialect.onDuplicateKeyUpdate("`jia_user_id`")+
+			"	`timezone` = "+r.dialect.excluded("timezone")+", `updated_at` = ?",
+		jiaUserID, timezone, r.dialect.timeValue(time.Now()))
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// activate 済みの `isu` の条件。activate 前の ISU は character が NULL
+const isuActivatedCondition = "`isu`.`character` IS NOT NULL"
+
+// ユーザーが所有しているか共有されている activate 済みの `isu` の条件。jia_user_id を2回渡す
+var isuAccessibleCondition = isuAccessibleBy("?")
+
+// user (jia_user_id の式) が所有しているか共有されている activate 済みの `isu` の条件
+func isuAccessibleBy(user string) string {
+	return "(`isu`.`jia_user_id` = " + user +
+		" OR `isu`.`jia_isu_uuid` IN (SELECT `jia_isu_uuid` FROM `isu_member` WHERE `jia_user_id` = " + user + "))" +
+		" AND " + isuActivatedCondition
+}
+
+func (r *sqlRepository) GetIsuListByUser(jiaUserID string) ([]Isu, error) {
+	isuList := []Isu{}
+	err := r.db.Select(
+		&isuList,
+		"SELECT * FROM `isu` WHERE "+isuAccessibleCondition+" ORDER BY `id` DESC",
+		jiaUserID, jiaUserID)
+	if err != nil {
+		return nil, err
+	}
+	return isuList, nil
+}
+
+func (r *sqlRepository) GetIsu(jiaUserID string, jiaIsuUUID string) (Isu, error) {
+	var isu Isu
+	err := r.db.Get(&isu, "SELECT * FROM `isu` WHERE "+isuAccessibleCondition+" AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaUserID, jiaIsuUUID)
+	if err != nil {
+		return Isu{}, err
+	}
+	isu.ActivationStatus = isuActivationStatusActive
+	return isu, nil
+}
+
+func (r *sqlRepository) GetIsuName(jiaUserID string, jiaIsuUUID string) (string, error) {
+	var isuName string
+	err := r.db.Get(&isuName,
+		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND "+isuAccessibleCondition,
+		jiaIsuUUID, jiaUserID, jiaUserID,
+	)
+	return isuName, err
+}
+
+func (r *sqlRepository) GetIsuRole(jiaUserID string, jiaIsuUUID string) (string, error) {
+	var role string
+	err := r.db.Get(&role,
+		"SELECT CASE WHEN `isu`.`jia_user_id` = ? THEN '"+isuRoleOwner+"' ELSE m.`role` END FROM `isu`"+
+			"	LEFT JOIN `isu_member` m ON m.`jia_isu_uuid` = `isu`.`jia_isu_uuid` AND m.`jia_user_id` = ?"+
+			"	WHERE `isu`.`jia_isu_uuid` = ? AND (`isu`.`jia_user_id` = ? OR m.`jia_user_id` IS NOT NULL) AND "+isuActivatedCondition,
+		jiaUserID, jiaUserID, jiaIsuUUID, jiaUserID)
+	return role, err
+}
+
+func (r *sqlRepository) GetIsuIcon(jiaIsuUUID string) (IsuIcon, error) {
+	var icon IsuIcon
+	err := r.db.Get(&icon, "SELECT `jia_user_id`, `image`, `updated_at` FROM `isu` WHERE `jia_isu_uuid` = ? AND "+isuActivatedCondition,
+		jiaIsuUUID)
+	return icon, err
+}
+
+func (r *sqlRepository) GetIsuConditionSecret(jiaIsuUUID string) (string, error) {
+	var secret string
+	err := r.db.Get(&secret, "SELECT COALESCE(`s`.`secret`, '') FROM `isu` AS `i`"+
+		" LEFT JOIN `isu_condition_secret` AS `s` ON `s`.`jia_isu_uuid` = `i`.`jia_isu_uuid`"+
+		" WHERE `i`.`jia_isu_uuid` = ? AND `i`.`character` IS NOT NULL",
+		jiaIsuUUID)
+	return secret, err
+}
+
+func (r *sqlRepository) IsuExistsByUser(jiaUserID string, jiaIsuUUID string) (bool, error) {
+	var count int
+	err := r.db.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ? AND "+isuActivatedCondition,
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *sqlRepository) CreateIsu(jiaIsuUUID string, name string, image []byte, jiaUserID string, pending bool) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO `isu`"+
+		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`) VALUES (?, ?, ?, ?)",
+		jiaIsuUUID, name, image, jiaUserID)
+	if err != nil {
+		if r.dialect.isDuplicateEntry(err) {
+			return errIsuDuplicated
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+	if pending {
+		_, err = tx.Exec("INSERT INTO `isu_activation` (`jia_isu_uuid`, `status`) VALUES (?, ?)",
+			jiaIsuUUID, isuActivationStatusPending)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) ActivateIsu(jiaUserID string, jiaIsuUUID string, isuFromJIA IsuFromJIA) (Isu, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE `isu` SET `character` = ? WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ? AND `character` IS NULL",
+		isuFromJIA.Character, jiaUserID, jiaIsuUUID)
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return Isu{}, sql.ErrNoRows
+	}
+	_, err = tx.Exec("INSERT INTO `isu_condition_secret` (`jia_isu_uuid`, `secret`) VALUES (?, ?)",
+		jiaIsuUUID, isuFromJIA.ConditionSecret)
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec("DELETE FROM `isu_activation` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+
+	var isu Isu
+	err = tx.Get(
+		&isu,
+		"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+	isu.ActivationStatus = isuActivationStatusActive
+	return isu, nil
+}
+
+// isu_activation が無いのは同期で activate している途中の ISU なので pending とする
+func (r *sqlRepository) GetPendingIsu(jiaUserID string, jiaIsuUUID string) (Isu, error) {
+	var isu Isu
+	err := r.db.Get(&isu, "SELECT `isu`.`id`, `isu`.`jia_isu_uuid`, `isu`.`name`, `isu`.`image`, '' AS `character`,"+
+		"	`isu`.`jia_user_id`, `isu`.`created_at`, `isu`.`updated_at`,"+
+		"	COALESCE(a.`status`, '"+isuActivationStatusPending+"') AS `activation_status`, COALESCE(a.`reason`, '') AS `activation_error`"+
+		"	FROM `isu` LEFT JOIN `isu_activation` a ON a.`jia_isu_uuid` = `isu`.`jia_isu_uuid`"+
+		"	WHERE `isu`.`jia_user_id` = ? AND `isu`.`jia_isu_uuid` = ? AND `isu`.`character` IS NULL",
+		jiaUserID, jiaIsuUUID)
+	return isu, err
+}
+
+func (r *sqlRepository) UpdateIsuActivation(activation IsuActivation) error {
+	_, err := r.db.Exec("UPDATE `isu_activation` SET `status` = ?, `reason` = ?, `attempts` = ?, `updated_at` = ?"+
+		"	WHERE `jia_isu_uuid` = ?",
+		activation.Status, activation.Reason, activation.Attempts, r.dialect.timeValue(time.Now()),
+		activation.JIAIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) GetPendingIsuActivations() ([]IsuActivation, error) {
+	activations := []IsuActivation{}
+	err := r.db.Select(&activations,
+		"SELECT a.`jia_isu_uuid`, `isu`.`jia_user_id`, a.`status`, COALESCE(a.`reason`, '') AS `reason`, a.`attempts`"+
+			"	FROM `isu_activation` a JOIN `isu` ON `isu`.`jia_isu_uuid` = a.`jia_isu_uuid`"+
+			"	WHERE a.`status` = ? ORDER BY a.`created_at`",
+		isuActivationStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return activations, nil
+}
+
+func (r *sqlRepository) UpdateIsu(jiaUserID string, jiaIsuUUID string, name *string, image []byte) (Isu, error) {
+	sets := []string{"`updated_at` = ?"}
+	args := []interface{}{r.dialect.timeValue(time.Now())}
+	if name != nil {
+		sets = append(sets, "`name` = ?")
+		args = append(args, *name)
+	}
+	if image != nil {
+		sets = append(sets, "`image` = ?")
+		args = append(args, image)
+	}
+	args = append(args, jiaUserID, jiaIsuUUID)
+
+	_, err := r.db.Exec("UPDATE `isu` SET "+strings.Join(sets, ", ")+" WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ? AND "+isuActivatedCondition, args...)
+	if err != nil {
+		return Isu{}, fmt.Errorf("db error: %v", err)
+	}
+
+	// GetIsu は共有されているユーザーにも返すので、所有者で絞り込んで取得する
+	var isu Isu
+	err = r.db.Get(&isu, "SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ? AND "+isuActivatedCondition,
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		return Isu{}, err
+	}
+	isu.ActivationStatus = isuActivationStatusActive
+	return isu, nil
+}
+
+func (r *sqlRepository) DeleteIsu(jiaUserID string, jiaIsuUUID string) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?", jiaUserID, jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	for _, query := range []string{
+		"DELETE FROM `isu_condition` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_latest_condition` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_graph_hourly` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_graph_hourly_condition` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_condition_secret` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_activation` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_member` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `isu_invitation` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `organization_isu` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `alert_delivery` WHERE `jia_isu_uuid` = ?",
+		"DELETE FROM `alert_rule` WHERE `jia_isu_uuid` = ?",
+	} {
+		_, err = tx.Exec(query, jiaIsuUUID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) GetCharacters() ([]string, error) {
+	characters := []string{}
+	err := r.db.Select(&characters, "SELECT `character` FROM `isu` WHERE "+isuActivatedCondition+" GROUP BY `character`")
+	if err != nil {
+		return nil, err
+	}
+	return characters, nil
+}
+
+func (r *sqlRepository) GetIsuMembers(jiaIsuUUID string) ([]IsuMember, error) {
+	members := []IsuMember{}
+	err := r.db.Select(&members,
+		"SELECT * FROM `isu_member` WHERE `jia_isu_uuid` = ? ORDER BY `created_at`, `jia_user_id`",
+		jiaIsuUUID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return members, nil
+}
+
+func (r *sqlRepository) GetIsuMember(jiaIsuUUID string, jiaUserID string) (IsuMember, error) {
+	var member IsuMember
+	err := r.db.Get(&member, "SELECT * FROM `isu_member` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		jiaIsuUUID, jiaUserID)
+	return member, err
+}
+
+func (r *sqlRepository) DeleteIsuMember(jiaIsuUUID string, jiaUserID string) error {
+	result, err := r.db.Exec("DELETE FROM `isu_member` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		jiaIsuUUID, jiaUserID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *sqlRepository) CreateIsuInvitation(invitation IsuInvitation) (IsuInvitation, error) {
+	_, err := r.db.Exec(
+		"INSERT INTO `isu_invitation` (`jia_isu_uuid`, `jia_user_id`, `role`, `invited_by`) VALUES (?, ?, ?, ?)"+
+			r.dialect.onDuplicateKeyUpdate("`jia_isu_uuid`, `jia_user_id`")+
+			"	`role` = "+r.dialect.excluded("role")+", `invited_by` = "+r.dialect.excluded("invited_by"),
+		invitation.JIAIsuUUID, invitation.JIAUserID, invitation.Role, invitation.InvitedBy)
+	if err != nil {
+		return IsuInvitation{}, fmt.Errorf("db error: %v", err)
+	}
+
+	var created IsuInvitation
+	err = r.db.Get(&created, "SELECT * FROM `isu_invitation` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		invitation.JIAIsuUUID, invitation.JIAUserID)
+	if err != nil {
+		return IsuInvitation{}, fmt.Errorf("db error: %v", err)
+	}
+	return created, nil
+}
+
+func (r *sqlRepository) GetIsuInvitationsByUser(jiaUserID string) ([]IsuInvitationWithIsu, error) {
+	invitations := []IsuInvitationWithIsu{}
+	err := r.db.Select(&invitations,
+		"SELECT i.*, `isu`.`name` AS `isu_name` FROM `isu_invitation` i"+
+			"	INNER JOIN `isu` ON `isu`.`jia_isu_uuid` = i.`jia_isu_uuid`"+
+			"	WHERE i.`jia_user_id` = ? ORDER BY i.`id` DESC",
+		jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return invitations, nil
+}
+
+func (r *sqlRepository) AcceptIsuInvitation(jiaUserID string, invitationID int64) (IsuMember, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return IsuMember{}, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	var invitation IsuInvitation
+	err = tx.Get(&invitation, "SELECT * FROM `isu_invitation` WHERE `id` = ? AND `jia_user_id` = ?",
+		invitationID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IsuMember{}, err
+		}
+		return IsuMember{}, fmt.Errorf("db error: %v", err)
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO `isu_member` (`jia_isu_uuid`, `jia_user_id`, `role`) VALUES (?, ?, ?)"+
+			r.dialect.onDuplicateKeyUpdate("`jia_isu_uuid`, `jia_user_id`")+
+			"	`role` = "+r.dialect.excluded("role"),
+		invitation.JIAIsuUUID, invitation.JIAUserID, invitation.Role)
+	if err != nil {
+		return IsuMember{}, fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec("DELETE FROM `isu_invitation` WHERE `id` = ?", invitationID)
+	if err != nil {
+		return IsuMember{}, fmt.Errorf("db error: %v", err)
+	}
+
+	var member IsuMember
+	err = tx.Get(&member, "SELECT * FROM `isu_member` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		invitation.JIAIsuUUID, invitation.JIAUserID)
+	if err != nil {
+		return IsuMember{}, fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return IsuMember{}, fmt.Errorf("db error: %v", err)
+	}
+	return member, nil
+}
+
+func (r *sqlRepository) DeleteIsuInvitation(jiaUserID string, invitationID int64) error {
+	result, err := r.db.Exec("DELETE FROM `isu_invitation` WHERE `id` = ? AND `jia_user_id` = ?",
+		invitationID, jiaUserID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *sqlRepository) CreateOrganization(name string, jiaUserID string) (Organization, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return Organization{}, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO `organization` (`name`) VALUES (?)", name)
+	if err != nil {
+		return Organization{}, fmt.Errorf("db error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Organization{}, fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec("INSERT INTO `organization_member` (`organization_id`, `jia_user_id`, `role`) VALUES (?, ?, ?)",
+		id, jiaUserID, organizationRoleAdmin)
+	if err != nil {
+		return Organization{}, fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Organization{}, fmt.Errorf("db error: %v", err)
+	}
+
+	org, err := r.GetOrganization(id, jiaUserID)
+	if err != nil {
+		return Organization{}, fmt.Errorf("db error: %v", err)
+	}
+	return org, nil
+}
+
+func (r *sqlRepository) GetOrganizationsByUser(jiaUserID string) ([]Organization, error) {
+	orgs := []Organization{}
+	err := r.db.Select(&orgs,
+		"SELECT o.`id`, o.`name`, m.`role`, o.`created_at` FROM `organization` o"+
+			"	INNER JOIN `organization_member` m ON m.`organization_id` = o.`id`"+
+			"	WHERE m.`jia_user_id` = ? ORDER BY o.`id`",
+		jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return orgs, nil
+}
+
+func (r *sqlRepository) GetOrganization(organizationID int64, jiaUserID string) (Organization, error) {
+	var org Organization
+	err := r.db.Get(&org,
+		"SELECT o.`id`, o.`name`, m.`role`, o.`created_at` FROM `organization` o"+
+			"	INNER JOIN `organization_member` m ON m.`organization_id` = o.`id`"+
+			"	WHERE o.`id` = ? AND m.`jia_user_id` = ?",
+		organizationID, jiaUserID)
+	return org, err
+}
+
+func (r *sqlRepository) GetOrganizationMembers(organizationID int64) ([]OrganizationMember, error) {
+	members := []OrganizationMember{}
+	err := r.db.Select(&members,
+		"SELECT * FROM `organization_member` WHERE `organization_id` = ? ORDER BY `created_at`, `jia_user_id`",
+		organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return members, nil
+}
+
+func (r *sqlRepository) AddOrganizationMember(member OrganizationMember) error {
+	_, err := r.db.Exec("INSERT INTO `organization_member` (`organization_id`, `jia_user_id`, `role`) VALUES (?, ?, ?)",
+		member.OrganizationID, member.JIAUserID, member.Role)
+	if err != nil {
+		if r.dialect.isDuplicateEntry(err) {
+			return errOrganizationMemberDuplicated
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) DeleteOrganizationMember(organizationID int64, jiaUserID string) error {
+	result, err := r.db.Exec("DELETE FROM `organization_member` WHERE `organization_id` = ? AND `jia_user_id` = ?",
+		organizationID, jiaUserID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *sqlRepository) GetOrganizationIsuList(organizationID int64) ([]OrganizationIsu, error) {
+	isuList := []OrganizationIsu{}
+	err := r.db.Select(&isuList,
+		"SELECT `isu`.`id`, `isu`.`jia_isu_uuid`, `isu`.`name`, `isu`.`character`, `isu`.`jia_user_id` FROM `isu`"+
+			"	INNER JOIN `organization_isu` o ON o.`jia_isu_uuid` = `isu`.`jia_isu_uuid`"+
+			"	WHERE o.`organization_id` = ? AND "+isuActivatedCondition+" ORDER BY `isu`.`id`",
+		organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return isuList, nil
+}
+
+func (r *sqlRepository) AddOrganizationIsu(organizationID int64, jiaIsuUUID string) error {
+	_, err := r.db.Exec("INSERT INTO `organization_isu` (`organization_id`, `jia_isu_uuid`) VALUES (?, ?)",
+		organizationID, jiaIsuUUID)
+	if err != nil {
+		if r.dialect.isDuplicateEntry(err) {
+			return errOrganizationIsuDuplicated
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) DeleteOrganizationIsu(organizationID int64, jiaIsuUUID string) error {
+	result, err := r.db.Exec("DELETE FROM `organization_isu` WHERE `organization_id` = ? AND `jia_isu_uuid` = ?",
+		organizationID, jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *sqlRepository) GetOrganizationLatestConditions(organizationID int64) (map[string]IsuLatestCondition, error) {
+	conditions := []IsuLatestCondition{}
+	err := r.db.Select(&conditions,
+		"SELECT l.* FROM `isu_latest_condition` l"+
+			"	INNER JOIN `organization_isu` o ON o.`jia_isu_uuid` = l.`jia_isu_uuid`"+
+			"	WHERE o.`organization_id` = ?",
+		organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := make(map[string]IsuLatestCondition, len(conditions))
+	for _, cond := range conditions {
+		res[cond.JIAIsuUUID] = cond
+	}
+	return res, nil
+}
+
+// コンディションを conditionInsertChunkSize 件ずつ multi-row INSERT する
+func (r *sqlRepository) InsertConditions(batches []ConditionBatch) ([]ConditionBatch, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	batches, err = filterRegisteredIsu(tx, batches)
+	if err != nil {
+		return nil, err
+	}
+	batches, err = r.filterDuplicatedConditions(tx, batches)
+	if err != nil {
+		return nil, err
+	}
+	if len(batches) == 0 {
+		return nil, tx.Commit()
+	}
+
+	placeholders := []string{}
+	args := []interface{}{}
+	exec := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		_, err := tx.Exec(
+			"INSERT INTO `isu_condition`"+
+				"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
+				"	VALUES "+strings.Join(placeholders, ","),
+			args...)
+		placeholders = placeholders[:0]
+		args = args[:0]
+		return err
+	}
+
+	for _, batch := range batches {
+		for _, cond := range batch.Conditions {
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+			args = append(args, batch.JIAIsuUUID, r.dialect.timeValue(time.Unix(cond.Timestamp, 0)), cond.IsSitting, cond.Condition, cond.Message)
+			if len(placeholders) >= conditionInsertChunkSize {
+				if err := exec(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := exec(); err != nil {
+		return nil, err
+	}
+
+	if err := r.upsertLatestConditions(tx, batches); err != nil {
+		return nil, err
+	}
+	if err := r.upsertGraphHourly(tx, batches); err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// 登録されている ISU のバッチだけを残す
+func filterRegisteredIsu(tx *tracedTx, batches []ConditionBatch) ([]ConditionBatch, error) {
+	jiaIsuUUIDs := make([]string, 0, len(batches))
+	for _, batch := range batches {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, batch.JIAIsuUUID)
+	}
+	query, args, err := sqlx.In("SELECT `jia_isu_uuid` FROM `isu` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	registered := []string{}
+	err = tx.Select(&registered, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	registeredSet := make(map[string]struct{}, len(registered))
+	for _, jiaIsuUUID := range registered {
+		registeredSet[jiaIsuUUID] = struct{}{}
+	}
+	filtered := make([]ConditionBatch, 0, len(batches))
+	for _, batch := range batches {
+		if _, ok := registeredSet[batch.JIAIsuUUID]; ok {
+			filtered = append(filtered, batch)
+		}
+	}
+	return filtered, nil
+}
+
+// 既に書き込まれているものと、timestamp がバッチ間やバッチ内で重複するコンディションを除く。
+// 並行して同じものを書き込んだ場合は一意キーの違反で失敗し、再試行時にここで除かれる
+func (r *sqlRepository) filterDuplicatedConditions(tx *tracedTx, batches []ConditionBatch) ([]ConditionBatch, error) {
+	timestampsByIsu := map[string][]int64{}
+	for _, batch := range batches {
+		for _, cond := range batch.Conditions {
+			timestampsByIsu[batch.JIAIsuUUID] = append(timestampsByIsu[batch.JIAIsuUUID], cond.Timestamp)
+		}
+	}
+	seenByIsu := make(map[string]map[int64]struct{}, len(timestampsByIsu))
+	for jiaIsuUUID, timestamps := range timestampsByIsu {
+		existing, err := r.selectConditionTimestamps(tx, jiaIsuUUID, timestamps)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[int64]struct{}, len(timestamps))
+		for _, timestamp := range existing {
+			seen[timestamp] = struct{}{}
+		}
+		seenByIsu[jiaIsuUUID] = seen
+	}
+
+	filtered := make([]ConditionBatch, 0, len(batches))
+	for _, batch := range batches {
+		seen := seenByIsu[batch.JIAIsuUUID]
+		conditions := make([]PostIsuConditionRequest, 0, len(batch.Conditions))
+		for _, cond := range batch.Conditions {
+			if _, ok := seen[cond.Timestamp]; ok {
+				continue
+			}
+			seen[cond.Timestamp] = struct{}{}
+			conditions = append(conditions, cond)
+		}
+		if len(conditions) > 0 {
+			batch.Conditions = conditions
+			filtered = append(filtered, batch)
+		}
+	}
+	return filtered, nil
+}
+
+// ISUのコンディションを cursor の条件で新しい順に取得
+func (r *sqlRepository) GetConditions(jiaIsuUUID string, cursor ConditionCursor) ([]IsuCondition, error) {
+	query := "SELECT `id`, `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `condition_level`" +
+		"	FROM `isu_condition` WHERE `jia_isu_uuid` = ?" +
+		"	AND `condition_level` IN (?)"
+	args := []interface{}{jiaIsuUUID, cursor.ConditionLevel}
+	endTime := r.dialect.timeValue(time.Unix(cursor.EndTime, 0))
+	if cursor.EndID == 0 {
+		query += "	AND `timestamp` < ?"
+		args = append(args, endTime)
+	} else {
+		query += "	AND (`timestamp` < ? OR (`timestamp` = ? AND `id` < ?))"
+		args = append(args, endTime, endTime, cursor.EndID)
+	}
+	if cursor.StartTime != 0 {
+		query += "	AND ? <= `timestamp`"
+		args = append(args, r.dialect.timeValue(time.Unix(cursor.StartTime, 0)))
+	}
+	query += "	ORDER BY `timestamp` DESC, `id` DESC LIMIT ?"
+	args = append(args, cursor.Limit)
+
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []IsuCondition{}
+	err = r.db.Select(&conditions, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return conditions, nil
+}
+
+func (r *sqlRepository) GetConditionsAfter(jiaIsuUUID string, after time.Time, conditionLevel []string, limit int) ([]IsuCondition, error) {
+	query, args, err := sqlx.In(
+		"SELECT `id`, `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `condition_level`"+
+			"	FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
+			"	AND `condition_level` IN (?)"+
+			"	AND ? < `timestamp`"+
+			"	ORDER BY `timestamp` ASC, `id` ASC LIMIT ?",
+		jiaIsuUUID, conditionLevel, r.dialect.timeValue(after), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []IsuCondition{}
+	err = r.db.Select(&conditions, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return conditions, nil
+}
+
+func (r *sqlRepository) GetConditionTimestamps(jiaIsuUUID string, timestamps []int64) ([]int64, error) {
+	existing, err := r.selectConditionTimestamps(r.db, jiaIsuUUID, timestamps)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return existing, nil
+}
+
+func (r *sqlRepository) selectConditionTimestamps(q sqlSelecter, jiaIsuUUID string, timestamps []int64) ([]int64, error) {
+	res := []int64{}
+	for start := 0; start < len(timestamps); start += conditionInsertChunkSize {
+		end := start + conditionInsertChunkSize
+		if end > len(timestamps) {
+			end = len(timestamps)
+		}
+		values := make([]interface{}, 0, end-start)
+		for _, timestamp := range timestamps[start:end] {
+			values = append(values, r.dialect.timeValue(time.Unix(timestamp, 0)))
+		}
+		query, args, err := sqlx.In(
+			"SELECT `timestamp` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` IN (?)",
+			jiaIsuUUID, values)
+		if err != nil {
+			return nil, err
+		}
+
+		existing := []time.Time{}
+		err = q.Select(&existing, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range existing {
+			res = append(res, t.Unix())
+		}
+	}
+	return res, nil
+}
+
+func (r *sqlRepository) GetConditionsInRange(jiaIsuUUID string, startAt time.Time, endAt time.Time, after ConditionPosition, limit int) ([]IsuCondition, error) {
+	query := "SELECT `id`, `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `condition_level`" +
+		"	FROM `isu_condition` WHERE `jia_isu_uuid` = ?" +
+		"	AND `timestamp` < ?"
+	args := []interface{}{jiaIsuUUID, r.dialect.timeValue(endAt)}
+	if after.ID == 0 {
+		query += "	AND ? <= `timestamp`"
+		args = append(args, r.dialect.timeValue(startAt))
+	} else {
+		afterTime := r.dialect.timeValue(after.Timestamp)
+		query += "	AND (? < `timestamp` OR (`timestamp` = ? AND ? < `id`))"
+		args = append(args, afterTime, afterTime, after.ID)
+	}
+	query += "	ORDER BY `timestamp` ASC, `id` ASC LIMIT ?"
+	args = append(args, limit)
+
+	conditions := []IsuCondition{}
+	err := r.db.Select(&conditions, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return conditions, nil
+}
+
+// ユーザーの ISU の最新のコンディションを jia_isu_uuid 毎に取得
+func (r *sqlRepository) GetLatestConditionsByUser(jiaUserID string) (map[string]IsuLatestCondition, error) {
+	conditions := []IsuLatestCondition{}
+	err := r.db.Select(&conditions,
+		"SELECT l.* FROM `isu_latest_condition` l"+
+			"	INNER JOIN `isu` ON `isu`.`jia_isu_uuid` = l.`jia_isu_uuid`"+
+			"	WHERE "+isuAccessibleCondition,
+		jiaUserID, jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := make(map[string]IsuLatestCondition, len(conditions))
+	for _, cond := range conditions {
+		res[cond.JIAIsuUUID] = cond
+	}
+	return res, nil
+}
+
+// 全 ISU の最新のコンディションを ISU の情報と共に取得
+func (r *sqlRepository) GetLatestConditionsWithIsu() ([]IsuLatestConditionWithIsu, error) {
+	rows := []IsuLatestConditionWithIsu{}
+	err := r.db.Select(&rows,
+		"SELECT `isu`.`id`, `isu`.`character`, l.`timestamp`, l.`condition` FROM `isu`"+
+			"	INNER JOIN `isu_latest_condition` l ON l.`jia_isu_uuid` = `isu`.`jia_isu_uuid`",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return rows, nil
+}
+
+// [startAt, endAt) の1時間毎の集計を start_at の昇順で取得
+func (r *sqlRepository) GetTrendHistory(startAt time.Time, endAt time.Time) ([]TrendHistoryHourly, error) {
+	rows := []TrendHistoryHourly{}
+	err := r.db.Select(&rows,
+		"SELECT `isu`.`character`, g.`start_at`,"+
+			"	SUM(g.`info_count`) AS `info_count`, SUM(g.`warning_count`) AS `warning_count`, SUM(g.`critical_count`) AS `critical_count`"+
+			"	FROM `isu_graph_hourly` g"+
+			"	INNER JOIN `isu` ON `isu`.`jia_isu_uuid` = g.`jia_isu_uuid`"+
+			"	WHERE ? <= g.`start_at` AND g.`start_at` < ?"+
+			"	GROUP BY `isu`.`character`, g.`start_at`",
+		r.dialect.timeValue(startAt), r.dialect.timeValue(endAt))
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return rows, nil
+}
+
+func (r *sqlRepository) GetGraphHourly(jiaIsuUUID string, startAt time.Time, endAt time.Time) ([]IsuGraphHourly, error) {
+	return r.selectGraphHourly("`jia_isu_uuid` = ?", jiaIsuUUID, startAt, endAt)
+}
+
+func (r *sqlRepository) GetOrganizationGraphHourly(organizationID int64, startAt time.Time, endAt time.Time) ([]IsuGraphHourly, error) {
+	return r.selectGraphHourly(
+		"`jia_isu_uuid` IN (SELECT `jia_isu_uuid` FROM `organization_isu` WHERE `organization_id` = ?)",
+		organizationID, startAt, endAt)
+}
+
+// isuCondition に当てはまる ISU の [startAt, endAt) の集計をキー毎の件数と共に取得
+func (r *sqlRepository) selectGraphHourly(isuCondition string, arg interface{}, startAt time.Time, endAt time.Time) ([]IsuGraphHourly, error) {
+	dataPoints := []IsuGraphHourly{}
+	err := r.db.Select(&dataPoints,
+		"SELECT * FROM `isu_graph_hourly` WHERE "+isuCondition+
+			"	AND ? <= `start_at` AND `start_at` < ?"+
+			"	ORDER BY `start_at` ASC, `jia_isu_uuid` ASC",
+		arg, r.dialect.timeValue(startAt), r.dialect.timeValue(endAt))
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	counts := []IsuGraphHourlyCondition{}
+	err = r.db.Select(&counts,
+		"SELECT * FROM `isu_graph_hourly_condition` WHERE "+isuCondition+
+			"	AND ? <= `start_at` AND `start_at` < ?",
+		arg, r.dialect.timeValue(startAt), r.dialect.timeValue(endAt))
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	indexByKey := map[graphHourlyKey]int{}
+	for i := range dataPoints {
+		dataPoints[i].ConditionCounts = map[string]int{}
+		indexByKey[graphHourlyKey{JIAIsuUUID: dataPoints[i].JIAIsuUUID, StartAt: dataPoints[i].StartAt.Unix()}] = i
+	}
+	for _, count := range counts {
+		if i, ok := indexByKey[graphHourlyKey{JIAIsuUUID: count.JIAIsuUUID, StartAt: count.StartAt.Unix()}]; ok {
+			dataPoints[i].ConditionCounts[count.ConditionKey] = count.Count
+		}
+	}
+	return dataPoints, nil
+}
+
+func (r *sqlRepository) CountAlertRules() (int, error) {
+	var count int
+	err := r.db.Get(&count, "SELECT COUNT(*) FROM `alert_rule`")
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	return count, nil
+}
+
+func (r *sqlRepository) GetAlertRulesByUser(jiaUserID string) ([]AlertRule, error) {
+	rules := []AlertRule{}
+	err := r.db.Select(&rules, "SELECT * FROM `alert_rule` WHERE `jia_user_id` = ? ORDER BY `id` DESC", jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return rules, nil
+}
+
+func (r *sqlRepository) GetAlertRule(jiaUserID string, alertID int64) (AlertRule, error) {
+	var rule AlertRule
+	err := r.db.Get(&rule, "SELECT * FROM `alert_rule` WHERE `jia_user_id` = ? AND `id` = ?", jiaUserID, alertID)
+	return rule, err
+}
+
+func (r *sqlRepository) GetAlertRulesByIsu(jiaIsuUUID string) ([]AlertRule, error) {
+	rules := []AlertRule{}
+	err := r.db.Select(&rules,
+		"SELECT r.* FROM `alert_rule` r"+
+			"	INNER JOIN `isu` ON "+isuAccessibleBy("r.`jia_user_id`")+
+			"	WHERE `isu`.`jia_isu_uuid` = ?"+
+			"	AND (r.`jia_isu_uuid` = `isu`.`jia_isu_uuid` OR r.`character` = `isu`.`character`)",
+		jiaIsuUUID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return rules, nil
+}
+
+func (r *sqlRepository) CreateAlertRule(rule AlertRule) (AlertRule, error) {
+	result, err := r.db.Exec("INSERT INTO `alert_rule`"+
+		"	(`jia_user_id`, `jia_isu_uuid`, `character`, `condition_level`, `sustained_seconds`, `webhook_url`, `secret`)"+
+		"	VALUES (?, ?, ?, ?, ?, ?, ?)",
+		rule.JIAUserID, rule.JIAIsuUUID, rule.Character, rule.ConditionLevel, rule.SustainedSeconds, rule.WebhookURL, rule.Secret)
+	if err != nil {
+		return AlertRule{}, fmt.Errorf("db error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return AlertRule{}, fmt.Errorf("db error: %v", err)
+	}
+
+	created, err := r.GetAlertRule(rule.JIAUserID, id)
+	if err != nil {
+		return AlertRule{}, fmt.Errorf("db error: %v", err)
+	}
+	return created, nil
+}
+
+func (r *sqlRepository) UpdateAlertRule(rule AlertRule) error {
+	_, err := r.db.Exec("UPDATE `alert_rule` SET"+
+		"	`jia_isu_uuid` = ?, `character` = ?, `condition_level` = ?, `sustained_seconds` = ?, `webhook_url` = ?, `updated_at` = ?"+
+		"	WHERE `jia_user_id` = ? AND `id` = ?",
+		rule.JIAIsuUUID, rule.Character, rule.ConditionLevel, rule.SustainedSeconds, rule.WebhookURL, r.dialect.timeValue(time.Now()),
+		rule.JIAUserID, rule.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) DeleteAlertRule(jiaUserID string, alertID int64) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM `alert_rule` WHERE `jia_user_id` = ? AND `id` = ?", jiaUserID, alertID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("DELETE FROM `alert_delivery` WHERE `alert_rule_id` = ?", alertID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) CreateAlertDelivery(delivery AlertDelivery) (int64, error) {
+	result, err := r.db.Exec("INSERT INTO `alert_delivery`"+
+		"	(`alert_rule_id`, `jia_isu_uuid`, `event`, `payload`, `status`, `attempts`, `response_status`, `last_error`)"+
+		"	VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		delivery.AlertRuleID, delivery.JIAIsuUUID, delivery.Event, delivery.Payload,
+		delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.LastError)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	return id, nil
+}
+
+func (r *sqlRepository) UpdateAlertDelivery(delivery AlertDelivery) error {
+	_, err := r.db.Exec("UPDATE `alert_delivery` SET"+
+		"	`status` = ?, `attempts` = ?, `response_status` = ?, `last_error` = ?, `updated_at` = ?"+
+		"	WHERE `id` = ?",
+		delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.LastError, r.dialect.timeValue(time.Now()),
+		delivery.ID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) GetAlertDeliveries(alertID int64, limit int) ([]AlertDelivery, error) {
+	deliveries := []AlertDelivery{}
+	err := r.db.Select(&deliveries,
+		"SELECT * FROM `alert_delivery` WHERE `alert_rule_id` = ? ORDER BY `id` DESC LIMIT ?",
+		alertID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return deliveries, nil
+}
+
+// 書き込むコンディションのうち ISU 毎に最新のもので isu_latest_condition を更新する
+func (r *sqlRepository) upsertLatestConditions(tx *tracedTx, batches []ConditionBatch) error {
+	latest := latestConditions(batches)
+	if len(latest) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, 0, len(latest))
+	args := make([]interface{}, 0, len(latest)*5)
+	for jiaIsuUUID, cond := range latest {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+		args = append(args, jiaIsuUUID, r.dialect.timeValue(time.Unix(cond.Timestamp, 0)), cond.IsSitting, cond.Condition, cond.Message)
+	}
+
+	// `timestamp` の比較に古い値を使うため、`timestamp` の更新は最後に行う
+	isNewer := "CASE WHEN " + r.dialect.excluded("timestamp") + " >= `timestamp`"
+	_, err := tx.Exec(
+		"INSERT INTO `isu_latest_condition`"+
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
+			"	VALUES "+strings.Join(placeholders, ",")+
+			r.dialect.onDuplicateKeyUpdate("`jia_isu_uuid`")+
+			"	`is_sitting` = "+isNewer+" THEN "+r.dialect.excluded("is_sitting")+" ELSE `is_sitting` END,"+
+			"	`condition` = "+isNewer+" THEN "+r.dialect.excluded("condition")+" ELSE `condition` END,"+
+			"	`message` = "+isNewer+" THEN "+r.dialect.excluded("message")+" ELSE `message` END,"+
+			"	`timestamp` = "+r.dialect.greatest(r.dialect.excluded("timestamp"), "`timestamp`"),
+		args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// isu_condition から isu_latest_condition を作り直す
+func (r *sqlRepository) rebuildLatestConditions() error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `isu_latest_condition`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	_, err = tx.Exec(
+		r.dialect.insertIgnore() + " INTO `isu_latest_condition`" +
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)" +
+			"	SELECT c.`jia_isu_uuid`, c.`timestamp`, c.`is_sitting`, c.`condition`, c.`message`" +
+			"	FROM `isu_condition` c" +
+			"	INNER JOIN (" +
+			"		SELECT `jia_isu_uuid`, MAX(`timestamp`) AS `timestamp` FROM `isu_condition` GROUP BY `jia_isu_uuid`" +
+			"	) latest ON c.`jia_isu_uuid` = latest.`jia_isu_uuid` AND c.`timestamp` = latest.`timestamp`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 書き込むコンディションを isu_graph_hourly に加算する
+func (r *sqlRepository) upsertGraphHourly(tx *tracedTx, batches []ConditionBatch) error {
+	aggregates := map[graphHourlyKey]*IsuGraphHourly{}
+	for _, batch := range batches {
+		for _, cond := range batch.Conditions {
+			err := addGraphHourly(aggregates, batch.JIAIsuUUID, cond.Timestamp, cond.IsSitting, cond.Condition)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return r.insertGraphHourly(tx, aggregates)
+}
+
+func (r *sqlRepository) insertGraphHourly(tx *tracedTx, aggregates map[graphHourlyKey]*IsuGraphHourly) error {
+	placeholders := []string{}
+	args := []interface{}{}
+	conditionPlaceholders := []string{}
+	conditionArgs := []interface{}{}
+	sum := func(column string) string {
+		return "	`" + column + "` = `" + column + "` + " + r.dialect.excluded(column)
+	}
+	exec := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		_, err := tx.Exec(
+			"INSERT INTO `isu_graph_hourly`"+
+				"	(`jia_isu_uuid`, `start_at`, `condition_count`, `sitting_count`, `raw_score_sum`,"+
+				"	`info_count`, `warning_count`, `critical_count`, `condition_timestamps`)"+
+				"	VALUES "+strings.Join(placeholders, ",")+
+				r.dialect.onDuplicateKeyUpdate("`jia_isu_uuid`, `start_at`")+
+				sum("condition_count")+","+
+				sum("sitting_count")+","+
+				sum("raw_score_sum")+","+
+				sum("info_count")+","+
+				sum("warning_count")+","+
+				sum("critical_count")+","+
+				"	`condition_timestamps` = "+r.dialect.concat("`condition_timestamps`", "','", r.dialect.excluded("condition_timestamps")),
+			args...)
+		placeholders = placeholders[:0]
+		args = args[:0]
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		return nil
+	}
+	execCondition := func() error {
+		if len(conditionPlaceholders) == 0 {
+			return nil
+		}
+		_, err := tx.Exec(
+			"INSERT INTO `isu_graph_hourly_condition` (`jia_isu_uuid`, `start_at`, `condition_key`, `count`)"+
+				"	VALUES "+strings.Join(conditionPlaceholders, ",")+
+				r.dialect.onDuplicateKeyUpdate("`jia_isu_uuid`, `start_at`, `condition_key`")+
+				sum("count"),
+			conditionArgs...)
+		conditionPlaceholders = conditionPlaceholders[:0]
+		conditionArgs = conditionArgs[:0]
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		return nil
+	}
+
+	for _, g := range aggregates {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, g.JIAIsuUUID, r.dialect.timeValue(g.StartAt), g.ConditionCount, g.SittingCount,
+			g.RawScoreSum, g.InfoCount, g.WarningCount, g.CriticalCount, g.ConditionTimestamps)
+		if len(placeholders) >= graphHourlyInsertChunkSize {
+			if err := exec(); err != nil {
+				return err
+			}
+		}
+
+		for key, count := range g.ConditionCounts {
+			conditionPlaceholders = append(conditionPlaceholders, "(?, ?, ?, ?)")
+			conditionArgs = append(conditionArgs, g.JIAIsuUUID, r.dialect.timeValue(g.StartAt), key, count)
+			if len(conditionPlaceholders) >= graphHourlyInsertChunkSize {
+				if err := execCondition(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := exec(); err != nil {
+		return err
+	}
+	return execCondition()
+}
+
+// isu_condition から isu_graph_hourly を作り直す
+func (r *sqlRepository) rebuildGraphHourly() error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"isu_graph_hourly", "isu_graph_hourly_condition"} {
+		_, err = tx.Exec("DELETE FROM `" + table + "`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	rows, err := tx.Queryx("SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition` FROM `isu_condition`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+
+	aggregates := map[graphHourlyKey]*IsuGraphHourly{}
+	var condition IsuCondition
+	for rows.Next() {
+		err = rows.StructScan(&condition)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		err = addGraphHourly(aggregates, condition.JIAIsuUUID, condition.Timestamp.Unix(), condition.IsSitting, condition.Condition)
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	rows.Close()
+
+	err = r.insertGraphHourly(tx, aggregates)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
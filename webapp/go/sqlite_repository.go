@@ -0,0 +1,208 @@
+package main
+
+// 組み込みの SQLite 向けの sqlDialect
+// MySQL を用意せずに手元や CI でアプリとベンチマーカーを動かすためのもの。
+// DATETIME 列には unixtime を整数で格納する。
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	defaultSQLitePath = "./isucondition.db"
+	// mysqldump の DATETIME 列は MySQL への接続時の loc で書き込まれている
+	mysqlDumpTimeZone = "Asia/Tokyo"
+)
+
+func NewSQLiteRepository(path string) (Repository, error) {
+	db, err := sqlx.Open("sqlite3", fmt.Sprintf("file:%s?_loc=auto&_busy_timeout=5000&_journal_mode=WAL", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite は書き込みを並行できないので接続を一本にまとめる
+	db.SetMaxOpenConns(1)
+	return newSQLRepository(db, sqliteDialect{}, "sqlite"), nil
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) insertIgnore() string {
+	return "INSERT OR IGNORE"
+}
+
+func (sqliteDialect) onDuplicateKeyUpdate(keys string) string {
+	return "	ON CONFLICT (" + keys + ") DO UPDATE SET"
+}
+
+func (sqliteDialect) excluded(column string) string {
+	return "excluded.`" + column + "`"
+}
+
+func (sqliteDialect) greatest(a string, b string) string {
+	return "MAX(" + a + ", " + b + ")"
+}
+
+func (sqliteDialect) concat(args ...string) string {
+	return "(" + strings.Join(args, " || ") + ")"
+}
+
+func (sqliteDialect) isDuplicateEntry(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+func (sqliteDialect) timeValue(t time.Time) interface{} {
+	return t.Unix()
+}
+
+// sqlite/0_Schema.sql を流し込み、mysqldump 形式の 1_InitData.sql から INSERT だけを取り込む
+func (sqliteDialect) resetDatabase(db *sqlx.DB) error {
+	schema, err := os.Open(filepath.Join(sqlDirPath, "sqlite", "0_Schema.sql"))
+	if err != nil {
+		return err
+	}
+	defer schema.Close()
+	err = readSQLStatements(schema, func(stmt []byte) error {
+		_, err := db.Exec(string(stmt))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute 0_Schema.sql: %v", err)
+	}
+
+	loc, err := time.LoadLocation(mysqlDumpTimeZone)
+	if err != nil {
+		return err
+	}
+
+	initData, err := os.Open(filepath.Join(sqlDirPath, "1_InitData.sql"))
+	if err != nil {
+		return err
+	}
+	defer initData.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	columnTypes := map[string][]string{}
+	err = readSQLStatements(initData, func(stmt []byte) error {
+		// SET や LOCK TABLES など INSERT 以外は MySQL 向けなので読み飛ばす
+		if len(stmt) < len("INSERT") || !strings.EqualFold(string(stmt[:len("INSERT")]), "INSERT") {
+			return nil
+		}
+		table, rows, err := parseMySQLDumpInsert(stmt)
+		if err != nil {
+			return err
+		}
+
+		types, ok := columnTypes[table]
+		if !ok {
+			types, err = sqliteColumnTypes(tx, table)
+			if err != nil {
+				return err
+			}
+			columnTypes[table] = types
+		}
+
+		query := "INSERT INTO `" + table + "` VALUES (?" + strings.Repeat(", ?", len(types)-1) + ")"
+		for _, row := range rows {
+			if len(row) != len(types) {
+				return fmt.Errorf("column count mismatch for %v: expected %d, got %d", table, len(types), len(row))
+			}
+			for i, value := range row {
+				row[i], err = convertMySQLDumpValue(value, types[i], loc)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = tx.Exec(query, row...)
+			if err != nil {
+				return fmt.Errorf("db error: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import 1_InitData.sql: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// SQLite は生成列を変更できず、STORED の生成列は追加もできないので VIRTUAL で作り直す
+func (sqliteDialect) alterConditionLevel(db *sqlx.DB, expr string) error {
+	for _, query := range []string{
+		"DROP INDEX `isu_condition_level_timestamp`",
+		"ALTER TABLE `isu_condition` DROP COLUMN `condition_level`",
+		"ALTER TABLE `isu_condition` ADD COLUMN `condition_level` VARCHAR(16) GENERATED ALWAYS AS (" + expr + ") VIRTUAL",
+		"CREATE INDEX `isu_condition_level_timestamp` ON `isu_condition` (`jia_isu_uuid`, `condition_level`, `timestamp`)",
+	} {
+		_, err := db.Exec(query)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
+
+// 生成列を除いた列の型を定義順に取得
+func sqliteColumnTypes(tx *sqlx.Tx, table string) ([]string, error) {
+	type column struct {
+		CID          int         `db:"cid"`
+		Name         string      `db:"name"`
+		Type         string      `db:"type"`
+		NotNull      bool        `db:"notnull"`
+		DefaultValue interface{} `db:"dflt_value"`
+		PK           int         `db:"pk"`
+	}
+	columns := []column{}
+	err := tx.Select(&columns, "PRAGMA table_info(`"+table+"`)")
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("unknown table: %v", table)
+	}
+
+	types := make([]string, 0, len(columns))
+	for _, c := range columns {
+		types = append(types, strings.ToUpper(c.Type))
+	}
+	return types, nil
+}
+
+// mysqldump の値を SQLite の列の型に合わせる
+func convertMySQLDumpValue(value interface{}, columnType string, loc *time.Location) (interface{}, error) {
+	str, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+
+	switch {
+	case strings.Contains(columnType, "BLOB"):
+		return []byte(str), nil
+	case strings.HasPrefix(columnType, "DATETIME"):
+		t, err := time.ParseInLocation("2006-01-02 15:04:05.999999", str, loc)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: datetime: %v", err)
+		}
+		return t.Unix(), nil
+	}
+	return str, nil
+}
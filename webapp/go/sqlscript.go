@@ -0,0 +1,331 @@
+package main
+
+// SQL ファイル (0_Schema.sql, mysqldump で作った 1_InitData.sql) の読み込み
+// POST /initialize で mysql コマンドを使わずにスキーマと初期データを流し込むために使う。
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// SQL を文毎に分割して fn に渡す。文字列や識別子の中の ; は区切りとみなさない。
+// fn に渡すスライスは次の呼び出しで上書きされる
+func readSQLStatements(r io.Reader, fn func(stmt []byte) error) error {
+	const (
+		stateNormal = iota
+		stateSingleQuote
+		stateDoubleQuote
+		stateBacktick
+		stateLineComment
+		stateBlockComment
+	)
+
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	buf := []byte{}
+	state := stateNormal
+	blockCommentStart := 0
+	emit := func() error {
+		stmt := bytes.TrimSpace(buf)
+		buf = buf[:0]
+		if len(stmt) == 0 {
+			return nil
+		}
+		return fn(stmt)
+	}
+
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		switch state {
+		case stateNormal:
+			switch b {
+			case ';':
+				if err := emit(); err != nil {
+					return err
+				}
+				continue
+			case '\'':
+				state = stateSingleQuote
+			case '"':
+				state = stateDoubleQuote
+			case '`':
+				state = stateBacktick
+			case '#':
+				state = stateLineComment
+				continue
+			case '-':
+				next, _ := reader.Peek(2)
+				if len(next) >= 1 && next[0] == '-' && (len(next) == 1 || next[1] == ' ' || next[1] == '\t' || next[1] == '\n' || next[1] == '\r') {
+					state = stateLineComment
+					continue
+				}
+			case '/':
+				next, _ := reader.Peek(1)
+				if len(next) == 1 && next[0] == '*' {
+					_, _ = reader.ReadByte()
+					blockCommentStart = len(buf)
+					buf = append(buf, '/', '*')
+					state = stateBlockComment
+					continue
+				}
+			}
+		case stateSingleQuote, stateDoubleQuote:
+			quote := byte('\'')
+			if state == stateDoubleQuote {
+				quote = '"'
+			}
+			if b == '\\' {
+				buf = append(buf, b)
+				b, err = reader.ReadByte()
+				if err != nil {
+					return fmt.Errorf("unterminated string: %v", err)
+				}
+			} else if b == quote {
+				state = stateNormal
+			}
+		case stateBacktick:
+			if b == '`' {
+				state = stateNormal
+			}
+		case stateLineComment:
+			if b == '\n' {
+				state = stateNormal
+				buf = append(buf, b)
+			}
+			continue
+		case stateBlockComment:
+			if b == '/' && len(buf)-1 > blockCommentStart+1 && buf[len(buf)-1] == '*' {
+				state = stateNormal
+			}
+		}
+		buf = append(buf, b)
+	}
+
+	return emit()
+}
+
+// mysqldump の INSERT INTO `table` VALUES (...),(...) を解析する。
+// 文字列は string、_binary や 0x で始まる値は []byte、数値は int64 か float64、NULL は nil になる
+func parseMySQLDumpInsert(stmt []byte) (string, [][]interface{}, error) {
+	p := &mysqlDumpParser{s: stmt}
+
+	if !p.consumeKeyword("INSERT") || !p.consumeKeyword("INTO") {
+		return "", nil, fmt.Errorf("not an INSERT statement")
+	}
+	table, err := p.identifier()
+	if err != nil {
+		return "", nil, err
+	}
+	if !p.consumeKeyword("VALUES") {
+		return "", nil, fmt.Errorf("unsupported INSERT statement for %v", table)
+	}
+
+	rows := [][]interface{}{}
+	for {
+		if !p.consume('(') {
+			return "", nil, p.errorf("expected (")
+		}
+		row := []interface{}{}
+		for {
+			value, err := p.value()
+			if err != nil {
+				return "", nil, err
+			}
+			row = append(row, value)
+			if p.consume(',') {
+				continue
+			}
+			if p.consume(')') {
+				break
+			}
+			return "", nil, p.errorf("expected , or )")
+		}
+		rows = append(rows, row)
+
+		if !p.consume(',') {
+			break
+		}
+	}
+	p.skipSpaces()
+	if p.pos != len(p.s) {
+		return "", nil, p.errorf("unexpected trailing characters")
+	}
+
+	return table, rows, nil
+}
+
+type mysqlDumpParser struct {
+	s   []byte
+	pos int
+}
+
+func (p *mysqlDumpParser) errorf(message string) error {
+	return fmt.Errorf("failed to parse INSERT statement at %d: %s", p.pos, message)
+}
+
+func (p *mysqlDumpParser) skipSpaces() {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *mysqlDumpParser) consume(c byte) bool {
+	p.skipSpaces()
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *mysqlDumpParser) consumeKeyword(keyword string) bool {
+	p.skipSpaces()
+	end := p.pos + len(keyword)
+	if end > len(p.s) || !bytes.EqualFold(p.s[p.pos:end], []byte(keyword)) {
+		return false
+	}
+	if end < len(p.s) && isIdentifierByte(p.s[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *mysqlDumpParser) identifier() (string, error) {
+	p.skipSpaces()
+	if p.consume('`') {
+		end := bytes.IndexByte(p.s[p.pos:], '`')
+		if end < 0 {
+			return "", p.errorf("unterminated identifier")
+		}
+		name := string(p.s[p.pos : p.pos+end])
+		p.pos += end + 1
+		return name, nil
+	}
+	start := p.pos
+	for p.pos < len(p.s) && isIdentifierByte(p.s[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected identifier")
+	}
+	return string(p.s[start:p.pos]), nil
+}
+
+func (p *mysqlDumpParser) value() (interface{}, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("unexpected end of statement")
+	}
+
+	switch {
+	case p.s[p.pos] == '\'':
+		return p.quoted()
+	case p.consumeKeyword("_binary"):
+		p.skipSpaces()
+		str, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(str), nil
+	case p.consumeKeyword("NULL"):
+		return nil, nil
+	case bytes.HasPrefix(p.s[p.pos:], []byte("0x")):
+		p.pos += 2
+		start := p.pos
+		for p.pos < len(p.s) && isHexByte(p.s[p.pos]) {
+			p.pos++
+		}
+		b := make([]byte, (p.pos-start)/2)
+		for i := range b {
+			v, err := strconv.ParseUint(string(p.s[start+i*2:start+i*2+2]), 16, 8)
+			if err != nil {
+				return nil, p.errorf("invalid hex literal")
+			}
+			b[i] = byte(v)
+		}
+		return b, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && bytes.IndexByte([]byte("+-.0123456789eE"), p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	number := string(p.s[start:p.pos])
+	if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("unsupported value")
+}
+
+// MySQL のエスケープを解釈して '...' の中身を返す
+func (p *mysqlDumpParser) quoted() (string, error) {
+	p.pos++
+	buf := []byte{}
+	for p.pos < len(p.s) {
+		b := p.s[p.pos]
+		p.pos++
+		switch b {
+		case '\\':
+			if p.pos >= len(p.s) {
+				return "", p.errorf("unterminated string")
+			}
+			escaped := p.s[p.pos]
+			p.pos++
+			switch escaped {
+			case '0':
+				buf = append(buf, 0)
+			case 'b':
+				buf = append(buf, '\b')
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'Z':
+				buf = append(buf, 26)
+			case '%', '_':
+				buf = append(buf, '\\', escaped)
+			default:
+				buf = append(buf, escaped)
+			}
+		case '\'':
+			if p.pos < len(p.s) && p.s[p.pos] == '\'' {
+				buf = append(buf, '\'')
+				p.pos++
+				continue
+			}
+			return string(buf), nil
+		default:
+			buf = append(buf, b)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func isIdentifierByte(b byte) bool {
+	return b == '_' || b == '$' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+func isHexByte(b byte) bool {
+	return ('0' <= b && b <= '9') || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+}
@@ -0,0 +1,384 @@
+package main
+
+// リクエストのトレース
+// W3C Trace Context の traceparent ヘッダーでトレースを引き継ぎ、ハンドラ、DB の呼び出し、JIA のサービスの呼び出しを
+// span として TRACE_EXPORT_PATH のファイルに一行一つの JSON で書き出す。TRACE_EXPORT_PATH が空ならトレースしない。
+// traceparent が無いリクエストでは新しいトレースを始め、sampled でない traceparent のリクエストは記録しない。
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	traceServiceName    = "isucondition"
+	traceparentHeader   = "traceparent"
+	traceStatementLimit = 1000
+
+	spanKindServer   = "server"
+	spanKindClient   = "client"
+	spanKindInternal = "internal"
+
+	spanStatusOK    = "ok"
+	spanStatusError = "error"
+)
+
+type Span struct {
+	TraceID        string                 `json:"trace_id"`
+	SpanID         string                 `json:"span_id"`
+	ParentSpanID   string                 `json:"parent_span_id,omitempty"`
+	Service        string                 `json:"service"`
+	Name           string                 `json:"name"`
+	Kind           string                 `json:"kind"`
+	StartTime      time.Time              `json:"start_time"`
+	EndTime        time.Time              `json:"end_time"`
+	DurationMicros int64                  `json:"duration_us"`
+	Attributes     map[string]interface{} `json:"attributes,omitempty"`
+	Status         string                 `json:"status"`
+	StatusMessage  string                 `json:"status_message,omitempty"`
+
+	tracer *Tracer
+	// traceparent から作った親。書き出さない
+	remote bool
+	ended  int32
+}
+
+type spanContextKey struct{}
+
+type Tracer struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewTracerFromEnv() (*Tracer, error) {
+	path := getEnv("TRACE_EXPORT_PATH", "")
+	if path == "" {
+		return &Tracer{}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace export file: %v", err)
+	}
+	return &Tracer{file: file}, nil
+}
+
+func (t *Tracer) Enabled() bool {
+	return t.file != nil
+}
+
+// リクエスト毎に server の span を始め、ハンドラに context で渡す echo のミドルウェア
+func (t *Tracer) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !t.Enabled() {
+			return next(c)
+		}
+		req := c.Request()
+		ctx, ok := t.contextWithTraceparent(req.Context(), req.Header.Get(traceparentHeader))
+		if !ok {
+			return next(c)
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := startSpan(ctx, req.Method+" "+route, spanKindServer)
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", req.URL.RequestURI())
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = errorStatusCode(err)
+		}
+		span.SetAttribute("http.status_code", status)
+		if requestID := c.Response().Header().Get(echo.HeaderXRequestID); requestID != "" {
+			span.SetAttribute("http.request_id", requestID)
+		}
+		if status >= http.StatusInternalServerError {
+			span.setStatus(spanStatusError, http.StatusText(status))
+		}
+		span.End(nil)
+		return err
+	}
+}
+
+// traceparent の span を親とする context を返す。traceparent が空か不正なら新しいトレースを始める。
+// トレースしないとき (無効か sampled でない) は false を返す
+func (t *Tracer) contextWithTraceparent(ctx context.Context, traceparent string) (context.Context, bool) {
+	if !t.Enabled() {
+		return ctx, false
+	}
+	traceID, spanID, sampled, ok := parseTraceparent(traceparent)
+	if !ok {
+		return context.WithValue(ctx, spanContextKey{}, &Span{TraceID: newTraceID(), tracer: t, remote: true}), true
+	}
+	if !sampled {
+		return ctx, false
+	}
+	return context.WithValue(ctx, spanContextKey{}, &Span{TraceID: traceID, SpanID: spanID, tracer: t, remote: true}), true
+}
+
+func (t *Tracer) export(span *Span) {
+	b, err := json.Marshal(span)
+	if err != nil {
+		log.Errorf("failed to marshal span: %v", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.file.Write(append(b, '\n'))
+	if err != nil {
+		log.Errorf("failed to export span: %v", err)
+	}
+}
+
+// "00-<trace-id>-<parent-id>-<trace-flags>"
+func parseTraceparent(traceparent string) (string, string, bool, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[0]) != 2 || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+	traceID, spanID, flags := strings.ToLower(parts[1]), strings.ToLower(parts[2]), parts[3]
+	if !isHexID(traceID, 16) || !isHexID(spanID, 8) || len(flags) != 2 {
+		return "", "", false, false
+	}
+	b, err := hex.DecodeString(flags)
+	if err != nil {
+		return "", "", false, false
+	}
+	return traceID, spanID, b[0]&0x01 != 0, true
+}
+
+// byteLen バイトの16進数で、全て 0 ではなければ true
+func isHexID(id string, byteLen int) bool {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != byteLen {
+		return false
+	}
+	for _, v := range b {
+		if v != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newTraceID() string {
+	return randomHexID(16)
+}
+
+func newSpanID() string {
+	return randomHexID(8)
+}
+
+func randomHexID(byteLen int) string {
+	b := make([]byte, byteLen)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// ctx の span の子を始める。ctx に span が無ければ何も記録せず nil を返す (nil の Span のメソッドは何もしない)
+func startSpan(ctx context.Context, name string, kind string) (context.Context, *Span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		TraceID:      parent.TraceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: parent.SpanID,
+		Service:      traceServiceName,
+		Name:         name,
+		Kind:         kind,
+		StartTime:    time.Now(),
+		Status:       spanStatusOK,
+		tracer:       parent.tracer,
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// ctx の span を親とする traceparent を返す。ctx に span が無ければ空文字列
+func traceparentFromContext(ctx context.Context) string {
+	span := spanFromContext(ctx)
+	if span == nil || span.SpanID == "" {
+		return ""
+	}
+	return "00-" + span.TraceID + "-" + span.SpanID + "-01"
+}
+
+// バックグラウンドの処理に引き継いだ traceparent の span を親とする context を返す。traceparent が空ならトレースしない
+func contextFromTraceparent(traceparent string) context.Context {
+	ctx := context.Background()
+	if traceparent != "" {
+		ctx, _ = tracer.contextWithTraceparent(ctx, traceparent)
+	}
+	return ctx
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+}
+
+func (s *Span) setStatus(status string, message string) {
+	s.Status = status
+	s.StatusMessage = message
+}
+
+// span を終えて書き出す。err が nil でなければ error とする。二回目以降の呼び出しは何もしない
+func (s *Span) End(err error) {
+	if s == nil || s.remote || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	if err != nil {
+		s.setStatus(spanStatusError, err.Error())
+	}
+	s.EndTime = time.Now()
+	s.DurationMicros = s.EndTime.Sub(s.StartTime).Microseconds()
+	s.tracer.export(s)
+}
+
+// sqlx.DB の呼び出しを ctx の span の子として記録する
+type tracedDB struct {
+	*sqlx.DB
+	ctx    context.Context
+	system string
+}
+
+func (db *tracedDB) Get(dest interface{}, query string, args ...interface{}) error {
+	span := startDBSpan(db.ctx, db.system, query)
+	err := db.DB.Get(dest, query, args...)
+	endDBSpan(span, err)
+	return err
+}
+
+func (db *tracedDB) Select(dest interface{}, query string, args ...interface{}) error {
+	span := startDBSpan(db.ctx, db.system, query)
+	err := db.DB.Select(dest, query, args...)
+	endDBSpan(span, err)
+	return err
+}
+
+func (db *tracedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	span := startDBSpan(db.ctx, db.system, query)
+	result, err := db.DB.Exec(query, args...)
+	endDBSpan(span, err)
+	return result, err
+}
+
+// トランザクション全体を一つの span とし、その中の呼び出しを子にする
+func (db *tracedDB) Beginx() (*tracedTx, error) {
+	ctx, span := startSpan(db.ctx, "db.transaction", spanKindClient)
+	span.SetAttribute("db.system", db.system)
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+	return &tracedTx{Tx: tx, ctx: ctx, system: db.system, span: span}, nil
+}
+
+type tracedTx struct {
+	*sqlx.Tx
+	ctx    context.Context
+	system string
+	span   *Span
+}
+
+func (tx *tracedTx) Get(dest interface{}, query string, args ...interface{}) error {
+	span := startDBSpan(tx.ctx, tx.system, query)
+	err := tx.Tx.Get(dest, query, args...)
+	endDBSpan(span, err)
+	return err
+}
+
+func (tx *tracedTx) Select(dest interface{}, query string, args ...interface{}) error {
+	span := startDBSpan(tx.ctx, tx.system, query)
+	err := tx.Tx.Select(dest, query, args...)
+	endDBSpan(span, err)
+	return err
+}
+
+func (tx *tracedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	span := startDBSpan(tx.ctx, tx.system, query)
+	result, err := tx.Tx.Exec(query, args...)
+	endDBSpan(span, err)
+	return result, err
+}
+
+func (tx *tracedTx) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	span := startDBSpan(tx.ctx, tx.system, query)
+	rows, err := tx.Tx.Queryx(query, args...)
+	endDBSpan(span, err)
+	return rows, err
+}
+
+func (tx *tracedTx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.span.SetAttribute("db.outcome", "commit")
+	tx.span.End(err)
+	return err
+}
+
+// Commit の後の defer での呼び出しは sql.ErrTxDone を返すだけなので span を変えない
+func (tx *tracedTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	if !errors.Is(err, sql.ErrTxDone) {
+		tx.span.SetAttribute("db.outcome", "rollback")
+		tx.span.End(err)
+	}
+	return err
+}
+
+// span の名前はクエリの最初の単語 (SELECT, INSERT など) にする
+func startDBSpan(ctx context.Context, system string, query string) *Span {
+	if spanFromContext(ctx) == nil {
+		return nil
+	}
+	operation := "query"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		operation = strings.ToUpper(fields[0])
+	}
+	_, span := startSpan(ctx, "db."+operation, spanKindClient)
+	span.SetAttribute("db.system", system)
+	span.SetAttribute("db.statement", truncateString(query, traceStatementLimit))
+	return span
+}
+
+// 見つからなかったことは失敗として扱わない
+func endDBSpan(span *Span, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		span.SetAttribute("db.rows", 0)
+		err = nil
+	}
+	span.End(err)
+}
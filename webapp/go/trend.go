@@ -0,0 +1,90 @@
+package main
+
+// トレンド (GET /api/trend, GET /api/trend/history)
+// GET /api/trend は ISU 毎の最新のコンディションを性格とコンディションレベルで分けて返し、
+// character, condition_level, since, limit で絞り込める。
+// GET /api/trend/history は性格毎のコンディションレベル毎の件数を isu_graph_hourly の集計から時間で区切って返す。
+
+import (
+	"sort"
+	"time"
+)
+
+type TrendHistoryHourly struct {
+	Character     string    `db:"character"`
+	StartAt       time.Time `db:"start_at"`
+	InfoCount     int       `db:"info_count"`
+	WarningCount  int       `db:"warning_count"`
+	CriticalCount int       `db:"critical_count"`
+}
+
+type trendFilter struct {
+	// 空なら全ての性格
+	character string
+	// nil なら全てのコンディションレベル
+	conditionLevels map[string]struct{}
+	// timestamp がこれ以降のコンディションだけを返す。ゼロ値なら全て
+	since time.Time
+	// 性格とコンディションレベル毎の件数の上限。0 なら上限なし
+	limit int
+}
+
+func (f *trendFilter) matchCharacter(character string) bool {
+	return f.character == "" || f.character == character
+}
+
+func (f *trendFilter) matchConditionLevel(conditionLevel string) bool {
+	if f.conditionLevels == nil {
+		return true
+	}
+	_, ok := f.conditionLevels[conditionLevel]
+	return ok
+}
+
+// 新しい順 (timestamp が同じなら isu_id の昇順) に並べて limit 件に切り詰める
+func (f *trendFilter) sortAndLimit(conditions []*TrendCondition) []*TrendCondition {
+	sort.Slice(conditions, func(i, j int) bool {
+		if conditions[i].Timestamp != conditions[j].Timestamp {
+			return conditions[i].Timestamp > conditions[j].Timestamp
+		}
+		return conditions[i].ID < conditions[j].ID
+	})
+	if f.limit > 0 && len(conditions) > f.limit {
+		return conditions[:f.limit]
+	}
+	return conditions
+}
+
+// characterList の性格毎に boundaries の区間毎の件数をまとめる
+func generateTrendHistory(characterList []string, rows []TrendHistoryHourly, boundaries []time.Time) []TrendHistoryResponse {
+	index := map[string]int{}
+	res := []TrendHistoryResponse{}
+	for _, character := range characterList {
+		history := []TrendHistoryPoint{}
+		for i := 0; i+1 < len(boundaries); i++ {
+			history = append(history, TrendHistoryPoint{
+				StartAt: boundaries[i].Unix(),
+				EndAt:   boundaries[i+1].Unix(),
+			})
+		}
+		index[character] = len(res)
+		res = append(res, TrendHistoryResponse{Character: character, History: history})
+	}
+
+	for _, row := range rows {
+		i, ok := index[row.Character]
+		if !ok {
+			continue
+		}
+		history := res[i].History
+		// row.StartAt を含む区間
+		j := sort.Search(len(history), func(j int) bool { return row.StartAt.Unix() < history[j].EndAt })
+		if j == len(history) || row.StartAt.Unix() < history[j].StartAt {
+			continue
+		}
+		history[j].Info += row.InfoCount
+		history[j].Warning += row.WarningCount
+		history[j].Critical += row.CriticalCount
+	}
+	return res
+}
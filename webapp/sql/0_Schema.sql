@@ -1,7 +1,20 @@
 DROP TABLE IF EXISTS `isu_association_config`;
+DROP TABLE IF EXISTS `alert_rule`;
+DROP TABLE IF EXISTS `alert_delivery`;
 DROP TABLE IF EXISTS `isu_condition`;
+DROP TABLE IF EXISTS `isu_latest_condition`;
+DROP TABLE IF EXISTS `isu_graph_hourly`;
+DROP TABLE IF EXISTS `isu_graph_hourly_condition`;
+DROP TABLE IF EXISTS `isu_condition_secret`;
+DROP TABLE IF EXISTS `isu_activation`;
+DROP TABLE IF EXISTS `isu_member`;
+DROP TABLE IF EXISTS `isu_invitation`;
+DROP TABLE IF EXISTS `organization`;
+DROP TABLE IF EXISTS `organization_member`;
+DROP TABLE IF EXISTS `organization_isu`;
 DROP TABLE IF EXISTS `isu`;
 DROP TABLE IF EXISTS `user`;
+DROP TABLE IF EXISTS `user_preference`;
 
 CREATE TABLE `isu` (
   `id` bigint AUTO_INCREMENT,
@@ -23,15 +36,151 @@ CREATE TABLE `isu_condition` (
   `condition` VARCHAR(255) NOT NULL,
   `message` VARCHAR(255) NOT NULL,
   `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `condition_level` VARCHAR(16) AS (
+    CASE (CHAR_LENGTH(`condition`) - CHAR_LENGTH(REPLACE(`condition`, '=true', ''))) DIV 5
+      WHEN 0 THEN 'info'
+      WHEN 1 THEN 'warning'
+      WHEN 2 THEN 'warning'
+      WHEN 3 THEN 'critical'
+    END
+  ) STORED INVISIBLE,
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `isu_condition_jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`),
+  INDEX `isu_condition_level_timestamp` (`jia_isu_uuid`, `condition_level`, `timestamp`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_latest_condition` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `timestamp` DATETIME NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_graph_hourly` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `condition_count` INT NOT NULL,
+  `sitting_count` INT NOT NULL,
+  `raw_score_sum` INT NOT NULL,
+  `info_count` INT NOT NULL,
+  `warning_count` INT NOT NULL,
+  `critical_count` INT NOT NULL,
+  `condition_timestamps` MEDIUMTEXT NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `start_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_graph_hourly_condition` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `condition_key` VARCHAR(64) NOT NULL,
+  `count` INT NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `start_at`, `condition_key`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_condition_secret` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `secret` VARCHAR(255) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_activation` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(16) NOT NULL,
+  `reason` TEXT,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_member` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`jia_isu_uuid`, `jia_user_id`),
+  INDEX `isu_member_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `isu_invitation` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `invited_by` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `isu_invitation_jia_isu_uuid_jia_user_id` (`jia_isu_uuid`, `jia_user_id`),
+  INDEX `isu_invitation_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `organization` (
+  `id` bigint AUTO_INCREMENT,
+  `name` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
   PRIMARY KEY(`id`)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
+CREATE TABLE `organization_member` (
+  `organization_id` bigint NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`organization_id`, `jia_user_id`),
+  INDEX `organization_member_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `organization_isu` (
+  `organization_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`organization_id`, `jia_isu_uuid`),
+  INDEX `organization_isu_jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
 CREATE TABLE `user` (
   `jia_user_id` VARCHAR(255) PRIMARY KEY,
   `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
+CREATE TABLE `user_preference` (
+  `jia_user_id` VARCHAR(255) PRIMARY KEY,
+  `timezone` VARCHAR(64) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
 CREATE TABLE `isu_association_config` (
   `name` VARCHAR(255) PRIMARY KEY,
   `url` VARCHAR(255) NOT NULL UNIQUE
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `alert_rule` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `jia_isu_uuid` CHAR(36),
+  `character` VARCHAR(255),
+  `condition_level` VARCHAR(16) NOT NULL,
+  `sustained_seconds` INT NOT NULL,
+  `webhook_url` VARCHAR(255) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `alert_rule_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `alert_delivery` (
+  `id` bigint AUTO_INCREMENT,
+  `alert_rule_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `event` VARCHAR(32) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `response_status` INT NOT NULL DEFAULT 0,
+  `last_error` VARCHAR(255) NOT NULL DEFAULT '',
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `alert_delivery_alert_rule_id` (`alert_rule_id`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,183 @@
+-- STORAGE_BACKEND=sqlite 用のスキーマ (../0_Schema.sql と同じ構成)
+-- DATETIME 列には unixtime を整数で格納する
+
+DROP TABLE IF EXISTS `isu_association_config`;
+DROP TABLE IF EXISTS `alert_rule`;
+DROP TABLE IF EXISTS `alert_delivery`;
+DROP TABLE IF EXISTS `isu_condition`;
+DROP TABLE IF EXISTS `isu_latest_condition`;
+DROP TABLE IF EXISTS `isu_graph_hourly`;
+DROP TABLE IF EXISTS `isu_graph_hourly_condition`;
+DROP TABLE IF EXISTS `isu_condition_secret`;
+DROP TABLE IF EXISTS `isu_activation`;
+DROP TABLE IF EXISTS `isu_member`;
+DROP TABLE IF EXISTS `isu_invitation`;
+DROP TABLE IF EXISTS `organization`;
+DROP TABLE IF EXISTS `organization_member`;
+DROP TABLE IF EXISTS `organization_isu`;
+DROP TABLE IF EXISTS `isu`;
+DROP TABLE IF EXISTS `user`;
+DROP TABLE IF EXISTS `user_preference`;
+
+CREATE TABLE `isu` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL UNIQUE,
+  `name` VARCHAR(255) NOT NULL,
+  `image` BLOB,
+  `character` VARCHAR(255),
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  `updated_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+
+CREATE TABLE `isu_condition` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `timestamp` DATETIME NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  `condition_level` VARCHAR(16) GENERATED ALWAYS AS (
+    CASE (LENGTH(`condition`) - LENGTH(REPLACE(`condition`, '=true', ''))) / 5
+      WHEN 0 THEN 'info'
+      WHEN 1 THEN 'warning'
+      WHEN 2 THEN 'warning'
+      WHEN 3 THEN 'critical'
+    END
+  ) STORED
+);
+CREATE UNIQUE INDEX `isu_condition_jia_isu_uuid_timestamp` ON `isu_condition` (`jia_isu_uuid`, `timestamp`);
+CREATE INDEX `isu_condition_level_timestamp` ON `isu_condition` (`jia_isu_uuid`, `condition_level`, `timestamp`);
+
+CREATE TABLE `isu_latest_condition` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `timestamp` DATETIME NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `updated_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+
+CREATE TABLE `isu_graph_hourly` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `condition_count` INT NOT NULL,
+  `sitting_count` INT NOT NULL,
+  `raw_score_sum` INT NOT NULL,
+  `info_count` INT NOT NULL,
+  `warning_count` INT NOT NULL,
+  `critical_count` INT NOT NULL,
+  `condition_timestamps` TEXT NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `start_at`)
+);
+
+CREATE TABLE `isu_graph_hourly_condition` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `condition_key` VARCHAR(64) NOT NULL,
+  `count` INT NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `start_at`, `condition_key`)
+);
+
+CREATE TABLE `isu_condition_secret` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `secret` VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE `isu_activation` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(16) NOT NULL,
+  `reason` TEXT,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  `updated_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+
+CREATE TABLE `isu_member` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  PRIMARY KEY(`jia_isu_uuid`, `jia_user_id`)
+);
+CREATE INDEX `isu_member_jia_user_id` ON `isu_member` (`jia_user_id`);
+
+CREATE TABLE `isu_invitation` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `invited_by` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+CREATE UNIQUE INDEX `isu_invitation_jia_isu_uuid_jia_user_id` ON `isu_invitation` (`jia_isu_uuid`, `jia_user_id`);
+CREATE INDEX `isu_invitation_jia_user_id` ON `isu_invitation` (`jia_user_id`);
+
+CREATE TABLE `organization` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `name` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+
+CREATE TABLE `organization_member` (
+  `organization_id` INTEGER NOT NULL,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  PRIMARY KEY(`organization_id`, `jia_user_id`)
+);
+CREATE INDEX `organization_member_jia_user_id` ON `organization_member` (`jia_user_id`);
+
+CREATE TABLE `organization_isu` (
+  `organization_id` INTEGER NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  PRIMARY KEY(`organization_id`, `jia_isu_uuid`)
+);
+CREATE INDEX `organization_isu_jia_isu_uuid` ON `organization_isu` (`jia_isu_uuid`);
+
+CREATE TABLE `user` (
+  `jia_user_id` VARCHAR(255) PRIMARY KEY,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+
+CREATE TABLE `user_preference` (
+  `jia_user_id` VARCHAR(255) PRIMARY KEY,
+  `timezone` VARCHAR(64) NOT NULL,
+  `updated_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+
+CREATE TABLE `isu_association_config` (
+  `name` VARCHAR(255) PRIMARY KEY,
+  `url` VARCHAR(255) NOT NULL UNIQUE
+);
+
+CREATE TABLE `alert_rule` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `jia_isu_uuid` CHAR(36),
+  `character` VARCHAR(255),
+  `condition_level` VARCHAR(16) NOT NULL,
+  `sustained_seconds` INT NOT NULL,
+  `webhook_url` VARCHAR(255) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  `updated_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+CREATE INDEX `alert_rule_jia_user_id` ON `alert_rule` (`jia_user_id`);
+
+CREATE TABLE `alert_delivery` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `alert_rule_id` INTEGER NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `event` VARCHAR(32) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `response_status` INT NOT NULL DEFAULT 0,
+  `last_error` VARCHAR(255) NOT NULL DEFAULT '',
+  `created_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+  `updated_at` DATETIME DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+);
+CREATE INDEX `alert_delivery_alert_rule_id` ON `alert_delivery` (`alert_rule_id`, `id`);